@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiKeyPrefix = "dk_"
+
+// APIKey is a user-managed credential for scripted access. Only a hash of the
+// key is stored; the key itself is shown once, when it is created.
+type APIKey struct {
+	ID         int
+	Name       string
+	Prefix     string
+	Scopes     []string
+	ExpiresAt  string
+	LastUsedAt string
+	CreatedAt  string
+}
+
+type apiKeyIdentity struct {
+	KeyID  int
+	UserID int
+	Scopes []string
+}
+
+type contextKey string
+
+const apiKeyContextKey contextKey = "api_key"
+
+const (
+	verifiedAPIKeyTTL  = 10 * time.Minute
+	maxVerifiedAPIKeys = 10000
+)
+
+// verifiedAPIKeys remembers recently authenticated keys by hash, so the rate
+// limiter, which runs before authentication, can give a key its own bucket
+// without trusting prefixes of keys that were never checked.
+var verifiedAPIKeys = struct {
+	sync.Mutex
+	entries map[string]verifiedAPIKey
+}{entries: make(map[string]verifiedAPIKey)}
+
+type verifiedAPIKey struct {
+	prefix  string
+	expires time.Time
+}
+
+func rememberVerifiedAPIKey(key, prefix string) {
+	now := time.Now()
+	verifiedAPIKeys.Lock()
+	defer verifiedAPIKeys.Unlock()
+	if len(verifiedAPIKeys.entries) >= maxVerifiedAPIKeys {
+		for hash, entry := range verifiedAPIKeys.entries {
+			if now.After(entry.expires) {
+				delete(verifiedAPIKeys.entries, hash)
+			}
+		}
+		if len(verifiedAPIKeys.entries) >= maxVerifiedAPIKeys {
+			return
+		}
+	}
+	verifiedAPIKeys.entries[hashAPIKey(key)] = verifiedAPIKey{prefix: prefix, expires: now.Add(verifiedAPIKeyTTL)}
+}
+
+// verifiedAPIKeyPrefix returns the prefix of key if it authenticated
+// recently.
+func verifiedAPIKeyPrefix(key string) (string, bool) {
+	verifiedAPIKeys.Lock()
+	defer verifiedAPIKeys.Unlock()
+	entry, ok := verifiedAPIKeys.entries[hashAPIKey(key)]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.prefix, true
+}
+
+// generateAPIKey returns a new key of the form dk_<prefix>_<secret>. The prefix
+// is stored in clear so the key row can be found without scanning every hash.
+func generateAPIKey() (key, prefix string, err error) {
+	prefix, err = generateToken(4)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := generateToken(24)
+	if err != nil {
+		return "", "", err
+	}
+	return apiKeyPrefix + prefix + "_" + secret, prefix, nil
+}
+
+func parseAPIKey(key string) (prefix string, ok bool) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 || len(parts[0]) != 8 || parts[1] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+func apiKeyIdentityFromContext(r *http.Request) *apiKeyIdentity {
+	identity, _ := r.Context().Value(apiKeyContextKey).(*apiKeyIdentity)
+	return identity
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+func authenticateAPIKey(key string) (*apiKeyIdentity, error) {
+	prefix, ok := parseAPIKey(key)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var identity apiKeyIdentity
+	var keyHash, scopes string
+	// Keys of disabled accounts stop working along with the account.
+	query := `SELECT k.id, k.user_id, k.key_hash, k.scopes FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.prefix = ? AND k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > NOW()) AND u.disabled = 0`
+	err = db.QueryRow(query, prefix).Scan(&identity.KeyID, &identity.UserID, &keyHash, &scopes)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errInvalidAPIKey
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashAPIKey(key))) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	identity.Scopes = splitScopes(scopes)
+	rememberVerifiedAPIKey(key, prefix)
+
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = NOW() WHERE id = ?", identity.KeyID); err != nil {
+		log.Error("Failed to record API key use: ", err)
+	}
+	return &identity, nil
+}
+
+func splitScopes(scopes string) []string {
+	var result []string
+	for _, s := range strings.Split(scopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// apiKeyAuth authenticates a request carrying an API key in the Authorization
+// header and attaches the key to the request context.
+func apiKeyAuth(w http.ResponseWriter, r *http.Request, key string, next http.HandlerFunc) {
+	identity, err := authenticateAPIKey(key)
+	if err != nil {
+		if err != errInvalidAPIKey {
+			log.Error("Failed to authenticate API key: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, identity)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func getAPIKeys(userID string) ([]APIKey, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, name, prefix, scopes, expires_at, last_used_at, created_at FROM api_keys WHERE user_id = ? AND revoked_at IS NULL ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullString
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &expiresAt, &lastUsedAt, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		key.Scopes = splitScopes(scopes)
+		key.ExpiresAt = expiresAt.String
+		key.LastUsedAt = lastUsedAt.String
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if apiKeyIdentityFromContext(r) != nil {
+		http.Error(w, "API keys cannot be managed with an API key", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	// A key's scopes are permissions, limited to those its owner holds, and
+	// ScopeSelf, which anyone may grant.
+	id, err := strconv.Atoi(userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	allowed, err := userPermissions(id)
+	if err != nil {
+		log.Error("Failed to retrieve user permissions: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	scopes := r.Form["scopes"]
+	if len(scopes) == 0 {
+		http.Error(w, "Select at least one scope", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range scopes {
+		if scope != ScopeSelf && !allowed[scope] {
+			http.Error(w, "Invalid scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	expiresDays := 0
+	if v := r.FormValue("expires_days"); v != "" {
+		expiresDays, err = strconv.Atoi(v)
+		if err != nil || expiresDays < 0 || expiresDays > 365 {
+			http.Error(w, "Expiry must be between 0 and 365 days", http.StatusBadRequest)
+			return
+		}
+	}
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var expiresAt interface{}
+	if expiresDays > 0 {
+		expiresAt = expiresDays
+	}
+	query := "INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at) VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? DAY))"
+	_, err = db.Exec(query, userID, name, prefix, hashAPIKey(key), strings.Join(scopes, ","), expiresAt)
+	if err != nil {
+		log.Error("Failed to create API key: ", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Name string
+		Key  string
+	}{
+		PageSecurity: pageSecurity(r),
+		Name:         name,
+		Key:          key,
+	}
+
+	tmpl, err := template.ParseFiles("pages/api_key_created.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if apiKeyIdentityFromContext(r) != nil {
+		http.Error(w, "API keys cannot be managed with an API key", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE id = ? AND user_id = ? AND revoked_at IS NULL", id, userID)
+	if err != nil {
+		log.Error("Failed to revoke API key: ", err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/user", http.StatusSeeOther)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -6,15 +6,23 @@ import (
 	"html/template"
 
 	"net/http"
+	"strconv"
 	"time"
 
+	"ASS1/validation"
+
 	"github.com/golang-jwt/jwt/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type AdminPageData struct {
-	Roles   []Role
-	Devices []Device
+	PageSecurity
+	Roles           []Role
+	Devices         []Device
+	Prices          map[int]string
+	LockedAccounts  []LockedAccount
+	Permissions     []Permission
+	RolePermissions map[int]map[string]bool
+	DeviceErrors    validation.Errors
 }
 
 var jwtKey = []byte("my_secret_key")
@@ -27,11 +35,35 @@ type Claims struct {
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		http.ServeFile(w, r, "pages/login.html")
+		data := struct {
+			PageSecurity
+			Providers []*OIDCProvider
+		}{
+			PageSecurity: pageSecurity(r),
+			Providers:    listOIDCProviders(),
+		}
+
+		tmpl, err := template.ParseFiles("pages/login.html")
+		if err != nil {
+			http.Error(w, "Failed to load template", http.StatusInternalServerError)
+			return
+		}
+
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			return
+		}
 		return
 	} else if r.Method == "POST" {
 		username := r.FormValue("username")
 		password := r.FormValue("password")
+		ip := clientIP(r)
+
+		if wait := loginRetryAfter(username, ip, time.Now()); wait > 0 {
+			writeLoginThrottled(w, wait)
+			return
+		}
 
 		dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
 		db, err := sql.Open(dbDriver, dsn)
@@ -42,9 +74,10 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		defer db.Close()
 
 		var user User
-		err = db.QueryRow("SELECT id, username, email, password, token, confirmed FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Token, &user.Confirmed)
+		err = db.QueryRow("SELECT id, username, email, password, token, confirmed, disabled, password_reset_required FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Token, &user.Confirmed, &user.Disabled, &user.PasswordResetRequired)
 		if err != nil {
 			log.Printf("Failed to retrieve user information: %v\n", err)
+			recordLoginFailure(username, ip, time.Now())
 			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 			return
 		}
@@ -55,56 +88,105 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+		ok, needsRehash, err := verifyPassword(user.Password, password)
 		if err != nil {
+			log.Printf("Failed to verify password: %v\n", err)
+		}
+		if !ok {
 			log.Println("Invalid password")
+			recordLoginFailure(username, ip, time.Now())
 			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 			return
 		}
 
-		var role string
-		log.Printf("Retrieving role for user ID: %d\n", user.ID)
-		err = db.QueryRow("SELECT r.name FROM roles r JOIN user_roles ur ON r.id = ur.role_id WHERE ur.user_id = ?", user.ID).Scan(&role)
-		if err != nil {
-			log.Printf("Failed to retrieve user role: %v\n", err)
-			http.Error(w, "Failed to retrieve user role", http.StatusInternalServerError)
-			return
+		recordLoginSuccess(username)
+		if needsRehash {
+			rehashPassword(db, user.ID, password)
 		}
 
-		log.Printf("User role: %s\n", role)
-
-		expirationTime := time.Now().Add(5 * time.Minute)
-		claims := &Claims{
-			Username: username,
-			RegisteredClaims: jwt.RegisteredClaims{
-				ExpiresAt: jwt.NewNumericDate(expirationTime),
-			},
-			UserID: user.ID,
-		}
+		completeLogin(w, r, user.ID, user.Username)
+	}
+}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString(jwtKey)
-		if err != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+// completeLogin issues the session cookie for an authenticated user and sends
+// them to the admin panel if they may use it, or to their profile otherwise.
+// Every sign-in method ends here, so this is where disabled accounts and
+// forced password resets are enforced.
+func completeLogin(w http.ResponseWriter, r *http.Request, userID int, username string) {
+	if err := checkLoginAllowed(userID); err != nil {
+		if err == errAccountDisabled || err == errPasswordResetRequired {
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
+		log.Printf("Failed to check account status: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:    "token",
-			Value:   tokenString,
-			Expires: expirationTime,
-		})
+	// Permissions are reloaded on every login so role changes apply immediately.
+	invalidateUserPermissions(userID)
+	permissions, err := userPermissions(userID)
+	if err != nil {
+		log.Printf("Failed to retrieve user permissions: %v\n", err)
+		http.Error(w, "Failed to retrieve user permissions", http.StatusInternalServerError)
+		return
+	}
 
-		if role == "admin" {
-			http.Redirect(w, r, "/admin", http.StatusSeeOther)
-		} else {
-			http.Redirect(w, r, "/user", http.StatusSeeOther)
-		}
+	expirationTime := time.Now().Add(5 * time.Minute)
+	claims := &Claims{
+		Username: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+		},
+		UserID: userID,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(jwtKey)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(w, tokenString, expirationTime)
+
+	if permissions[PermAdminAccess] {
+		http.Redirect(w, r, "/admin", http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, "/user", http.StatusSeeOther)
 	}
 }
 
+// checkLoginAllowed returns errAccountDisabled or errPasswordResetRequired
+// when the user may not sign in.
+func checkLoginAllowed(userID int) error {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var disabled, resetRequired bool
+	if err := db.QueryRow("SELECT disabled, password_reset_required FROM users WHERE id = ?", userID).Scan(&disabled, &resetRequired); err != nil {
+		return err
+	}
+	if disabled {
+		return errAccountDisabled
+	}
+	if resetRequired {
+		return errPasswordResetRequired
+	}
+	return nil
+}
+
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if key := apiKeyFromRequest(r); key != "" {
+			apiKeyAuth(w, r, key, next)
+			return
+		}
+
 		cookie, err := r.Cookie("token")
 		if err != nil {
 			if err == http.ErrNoCookie {
@@ -141,6 +223,12 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 }
 
 func userProfileHandler(w http.ResponseWriter, r *http.Request) {
+	renderUserProfile(w, r, http.StatusOK, nil)
+}
+
+// renderUserProfile renders the profile page; formErrors holds field errors
+// from a rejected change-password or change-email submission.
+func renderUserProfile(w http.ResponseWriter, r *http.Request, status int, formErrors validation.Errors) {
 	userID := getUserIDFromRequest(r)
 	if userID == "" {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -151,10 +239,75 @@ func userProfileHandler(w http.ResponseWriter, r *http.Request) {
 	cart := cartStorage.carts[userID]
 	cartStorage.RUnlock()
 
+	pendingEmail, err := getPendingEmailChange(userID)
+	if err != nil {
+		log.Error("Failed to retrieve pending email change: ", err)
+	}
+
+	pendingDeletion, err := getPendingAccountDeletion(userID)
+	if err != nil {
+		log.Error("Failed to retrieve pending account deletion: ", err)
+	}
+
+	apiKeys, err := getAPIKeys(userID)
+	if err != nil {
+		log.Error("Failed to retrieve API keys: ", err)
+	}
+
+	preferences := CommunicationPreferences{Marketing: true, ProductAlerts: true}
+	var suppression *Suppression
+	var notifications []Notification
+	var unreadNotifications int
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	if db, err := sql.Open(dbDriver, dsn); err == nil {
+		if preferences, err = getCommunicationPreferences(db, userID); err != nil {
+			log.Error("Failed to retrieve communication preferences: ", err)
+		}
+		var email string
+		if err := db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err == nil {
+			if suppression, err = getEmailSuppression(db, email); err != nil {
+				log.Error("Failed to retrieve email suppression: ", err)
+			}
+		}
+		if notifications, unreadNotifications, err = getNotifications(db, userID, notificationsPageSize, false); err != nil {
+			log.Error("Failed to retrieve notifications: ", err)
+		}
+		db.Close()
+	}
+
+	var scopes []string
+	if id, err := strconv.Atoi(userID); err == nil {
+		permissions, err := userPermissions(id)
+		if err != nil {
+			log.Error("Failed to retrieve user permissions: ", err)
+		}
+		scopes = append([]string{ScopeSelf}, sortedPermissionNames(permissions)...)
+	}
+
 	data := struct {
-		Cart []Device
+		PageSecurity
+		Cart                []Device
+		PendingEmail        string
+		PendingDeletion     string
+		Preferences         CommunicationPreferences
+		Suppression         *Suppression
+		Notifications       []Notification
+		UnreadNotifications int
+		APIKeys             []APIKey
+		APIScopes           []string
+		FormErrors          validation.Errors
 	}{
-		Cart: cart,
+		PageSecurity:        pageSecurity(r),
+		Cart:                cart,
+		PendingEmail:        pendingEmail,
+		PendingDeletion:     pendingDeletion,
+		Preferences:         preferences,
+		Suppression:         suppression,
+		Notifications:       notifications,
+		UnreadNotifications: unreadNotifications,
+		APIKeys:             apiKeys,
+		APIScopes:           scopes,
+		FormErrors:          formErrors,
 	}
 
 	tmpl, err := template.ParseFiles("pages/profile.html")
@@ -163,14 +316,20 @@ func userProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.WriteHeader(status)
 	err = tmpl.Execute(w, data)
 	if err != nil {
-		http.Error(w, "Failed to render template", http.StatusInternalServerError)
-		return
+		log.Println("Failed to render template: ", err)
 	}
 }
 
 func adminProfileHandler(w http.ResponseWriter, r *http.Request) {
+	renderAdminPage(w, r, http.StatusOK, nil)
+}
+
+// renderAdminPage renders the admin page; deviceErrors holds field errors
+// from a rejected device form.
+func renderAdminPage(w http.ResponseWriter, r *http.Request, status int, deviceErrors validation.Errors) {
 	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
 	db, err := sql.Open(dbDriver, dsn)
 	if err != nil {
@@ -181,7 +340,7 @@ func adminProfileHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	// Fetch roles
-	rows, err := db.Query("SELECT id, name FROM roles")
+	rows, err := db.Query("SELECT id, name, is_system FROM roles")
 	if err != nil {
 		log.Println("Failed to fetch roles: ", err)
 		http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
@@ -192,7 +351,7 @@ func adminProfileHandler(w http.ResponseWriter, r *http.Request) {
 	var roles []Role
 	for rows.Next() {
 		var role Role
-		if err := rows.Scan(&role.ID, &role.Name); err != nil {
+		if err := rows.Scan(&role.ID, &role.Name, &role.IsSystem); err != nil {
 			log.Println("Failed to scan role: ", err)
 			http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
 			return
@@ -206,7 +365,7 @@ func adminProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch devices
-	deviceRows, err := db.Query("SELECT id, type1, brand, model FROM electronic")
+	deviceRows, err := db.Query("SELECT e.id, e.type1, e.brand, e.model, p.price FROM electronic e LEFT JOIN device_prices p ON p.device_id = e.id")
 	if err != nil {
 		log.Println("Failed to fetch devices: ", err)
 		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
@@ -215,14 +374,19 @@ func adminProfileHandler(w http.ResponseWriter, r *http.Request) {
 	defer deviceRows.Close()
 
 	var devices []Device
+	prices := make(map[int]string)
 	for deviceRows.Next() {
 		var device Device
-		if err := deviceRows.Scan(&device.ID, &device.Type1, &device.Brand, &device.Model); err != nil {
+		var price sql.NullString
+		if err := deviceRows.Scan(&device.ID, &device.Type1, &device.Brand, &device.Model, &price); err != nil {
 			log.Println("Failed to scan device: ", err)
 			http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
 			return
 		}
 		devices = append(devices, device)
+		if price.Valid {
+			prices[device.ID] = price.String
+		}
 	}
 	if err := deviceRows.Err(); err != nil {
 		log.Println("Device rows error: ", err)
@@ -230,9 +394,28 @@ func adminProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	permissions, err := getPermissions(db)
+	if err != nil {
+		log.Println("Failed to fetch permissions: ", err)
+		http.Error(w, "Failed to fetch permissions", http.StatusInternalServerError)
+		return
+	}
+	rolePermissions, err := getRolePermissions(db)
+	if err != nil {
+		log.Println("Failed to fetch role permissions: ", err)
+		http.Error(w, "Failed to fetch permissions", http.StatusInternalServerError)
+		return
+	}
+
 	data := AdminPageData{
-		Roles:   roles,
-		Devices: devices,
+		PageSecurity:    pageSecurity(r),
+		Roles:           roles,
+		Devices:         devices,
+		Prices:          prices,
+		LockedAccounts:  lockedLogins(time.Now()),
+		Permissions:     permissions,
+		RolePermissions: rolePermissions,
+		DeviceErrors:    deviceErrors,
 	}
 	tmpl, err := template.ParseFiles("pages/admin.html")
 	if err != nil {
@@ -241,6 +424,7 @@ func adminProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.WriteHeader(status)
 	err = tmpl.Execute(w, data)
 	if err != nil {
 		log.Println("Failed to execute template: ", err)
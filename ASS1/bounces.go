@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Addresses that cannot receive email are kept on a suppression list. It is
+// fed by hard bounces during SMTP delivery and by bounce and complaint
+// reports that arrive later, from a BounceSource polled in the background or
+// pushed to the bounce webhook. The outbox does not send to suppressed
+// addresses and campaigns leave them out of their audience.
+const (
+	suppressionHardBounce = "hard_bounce"
+	suppressionComplaint  = "complaint"
+	suppressionManual     = "manual"
+)
+
+const (
+	bounceWebhookPath     = "/webhooks/bounces"
+	maxBounceWebhookSize  = 1 << 20
+	bouncePollInterval    = time.Minute
+	bounceSourceProcessed = "processed"
+	bounceSourceFailed    = "failed"
+)
+
+// bounceWebhookSecret authenticates the bounce webhook; the webhook is off
+// when it is empty.
+var bounceWebhookSecret = os.Getenv("BOUNCE_WEBHOOK_SECRET")
+
+type Suppression struct {
+	Email     string
+	Reason    string
+	Source    string
+	Detail    string
+	CreatedAt string
+}
+
+// suppressionCondition is a WHERE clause fragment excluding users, aliased u,
+// whose address is suppressed.
+func suppressionCondition() string {
+	return "NOT EXISTS (SELECT 1 FROM email_suppressions s WHERE s.email = u.email)"
+}
+
+func suppressEmail(exec sqlExecer, email, reason, source, detail string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	_, err := exec.Exec(`INSERT INTO email_suppressions (email, reason, source, detail, created_at) VALUES (?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE reason = VALUES(reason), source = VALUES(source), detail = VALUES(detail)`,
+		email, reason, source, detail)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"event":  "email_suppressed",
+		"email":  email,
+		"reason": reason,
+		"source": source,
+	}).Warn("Email address suppressed: ", detail)
+	return nil
+}
+
+// getEmailSuppression returns the suppression for email, or nil.
+func getEmailSuppression(db *sql.DB, email string) (*Suppression, error) {
+	var s Suppression
+	var detail sql.NullString
+	err := db.QueryRow("SELECT email, reason, source, detail, created_at FROM email_suppressions WHERE email = ?", email).
+		Scan(&s.Email, &s.Reason, &s.Source, &detail, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Detail = detail.String
+	return &s, nil
+}
+
+// unsuppressedRecipients returns the addresses in to that are not
+// suppressed.
+func unsuppressedRecipients(db *sql.DB, to []string) ([]string, error) {
+	if len(to) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(to))
+	for i, address := range to {
+		args[i] = address
+	}
+	rows, err := db.Query("SELECT email FROM email_suppressions WHERE email IN (?"+strings.Repeat(", ?", len(to)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suppressed := map[string]bool{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		suppressed[strings.ToLower(email)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var deliverable []string
+	for _, address := range to {
+		if !suppressed[strings.ToLower(address)] {
+			deliverable = append(deliverable, address)
+		}
+	}
+	return deliverable, nil
+}
+
+// BounceReport is a bounce or complaint received after a message left the
+// mail server.
+type BounceReport struct {
+	Email string `json:"email"`
+	// Type is "bounce" or "complaint".
+	Type string `json:"type"`
+	// Permanent is set for bounces that will recur, such as an unknown
+	// mailbox; temporary bounces are only logged.
+	Permanent bool   `json:"permanent"`
+	Detail    string `json:"detail"`
+
+	ref string
+}
+
+func (r BounceReport) validate() error {
+	if !strings.Contains(r.Email, "@") {
+		return fmt.Errorf("invalid email %q", r.Email)
+	}
+	if r.Type != "bounce" && r.Type != "complaint" {
+		return fmt.Errorf("invalid report type %q", r.Type)
+	}
+	return nil
+}
+
+// BounceSource supplies bounce and complaint reports collected outside the
+// SMTP conversation, such as DSNs in a bounce mailbox or a provider's
+// feedback loop.
+type BounceSource interface {
+	// Fetch returns the reports waiting in the source.
+	Fetch() ([]BounceReport, error)
+	// Done removes reports from the source once they are recorded, so reports
+	// are fetched again if recording fails.
+	Done(reports []BounceReport) error
+}
+
+var bounceSource BounceSource
+
+// loadBounceSource selects the bounce source from BOUNCE_SOURCE: empty (the
+// default) for none, or "file" to read reports dropped in BOUNCE_DIR, a local
+// stand-in for a bounce mailbox.
+func loadBounceSource() error {
+	switch kind := os.Getenv("BOUNCE_SOURCE"); kind {
+	case "":
+		bounceSource = nil
+	case "file":
+		dir := envOrDefault("BOUNCE_DIR", "bounces")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		bounceSource = &FileBounceSource{Dir: dir}
+	default:
+		return fmt.Errorf("unknown BOUNCE_SOURCE %q", kind)
+	}
+	return nil
+}
+
+// FileBounceSource reads reports from files in Dir: .json files holding a
+// BounceReport or a list of them, and .eml files holding a delivery status
+// notification (RFC 3464) or an abuse report (RFC 5965). Recorded files move
+// to Dir/processed; files that cannot be parsed move to Dir/failed.
+type FileBounceSource struct {
+	Dir string
+}
+
+func (s *FileBounceSource) Fetch() ([]BounceReport, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []BounceReport
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".json" && ext != ".eml") {
+			continue
+		}
+		path := filepath.Join(s.Dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var fileReports []BounceReport
+		if ext == ".json" {
+			fileReports, err = parseBounceJSON(data)
+		} else {
+			fileReports, err = parseBounceMessage(data)
+		}
+		if err != nil {
+			log.WithField("file", path).Error("Failed to parse bounce report: ", err)
+			if err := s.move(path, bounceSourceFailed); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, report := range fileReports {
+			report.ref = path
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
+
+func (s *FileBounceSource) Done(reports []BounceReport) error {
+	for _, report := range reports {
+		err := s.move(report.ref, bounceSourceProcessed)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileBounceSource) move(path, subdir string) error {
+	dir := filepath.Join(s.Dir, subdir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
+
+// parseBounceJSON accepts a single report or a list of reports.
+func parseBounceJSON(data []byte) ([]BounceReport, error) {
+	var reports []BounceReport
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &reports); err != nil {
+			return nil, err
+		}
+	} else {
+		var report BounceReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	for _, report := range reports {
+		if err := report.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+// parseBounceMessage extracts reports from a multipart/report email: one
+// bounce per failed or delayed recipient of a delivery status notification,
+// or a complaint from an abuse feedback report.
+func parseBounceMessage(raw []byte) ([]BounceReport, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/report" {
+		return nil, fmt.Errorf("not a report: %s", mediaType)
+	}
+
+	var reports []BounceReport
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status":
+			groups, err := readHeaderGroups(part)
+			if err != nil {
+				return nil, err
+			}
+			// The first group describes the message; each later one a
+			// recipient.
+			for _, group := range groups[1:] {
+				if report, ok := deliveryStatusReport(group); ok {
+					reports = append(reports, report)
+				}
+			}
+		case "message/feedback-report":
+			groups, err := readHeaderGroups(part)
+			if err != nil {
+				return nil, err
+			}
+			group := groups[0]
+			email := group.Get("Original-Rcpt-To")
+			if email == "" {
+				return nil, errors.New("feedback report without Original-Rcpt-To")
+			}
+			reports = append(reports, BounceReport{
+				Email:     email,
+				Type:      "complaint",
+				Permanent: true,
+				Detail:    "Feedback-Type: " + group.Get("Feedback-Type"),
+			})
+		}
+	}
+	if len(reports) == 0 {
+		return nil, errors.New("no bounced recipients in report")
+	}
+	return reports, nil
+}
+
+// deliveryStatusReport converts one per-recipient group of a delivery status
+// notification. Delivered and relayed recipients are not reported.
+func deliveryStatusReport(group textproto.MIMEHeader) (BounceReport, bool) {
+	action := strings.ToLower(strings.TrimSpace(group.Get("Action")))
+	if action != "failed" && action != "delayed" {
+		return BounceReport{}, false
+	}
+	recipient := group.Get("Final-Recipient")
+	if recipient == "" {
+		recipient = group.Get("Original-Recipient")
+	}
+	// The value is "address-type; address", normally "rfc822; a@b".
+	if _, address, ok := strings.Cut(recipient, ";"); ok {
+		recipient = address
+	}
+	status := strings.TrimSpace(group.Get("Status"))
+	detail := status
+	if diagnostic := group.Get("Diagnostic-Code"); diagnostic != "" {
+		detail += " " + diagnostic
+	}
+	return BounceReport{
+		Email:     strings.TrimSpace(recipient),
+		Type:      "bounce",
+		Permanent: action == "failed" && strings.HasPrefix(status, "5."),
+		Detail:    detail,
+	}, true
+}
+
+// readHeaderGroups reads blank-line separated header blocks, the body format
+// of delivery status and feedback report parts.
+func readHeaderGroups(r io.Reader) ([]textproto.MIMEHeader, error) {
+	reader := textproto.NewReader(bufio.NewReader(r))
+	var groups []textproto.MIMEHeader
+	for {
+		group, err := reader.ReadMIMEHeader()
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(groups) == 0 {
+		return nil, errors.New("empty report")
+	}
+	return groups, nil
+}
+
+// recordBounceReport suppresses the address for complaints and permanent
+// bounces.
+func recordBounceReport(exec sqlExecer, report BounceReport, source string) error {
+	switch {
+	case report.Type == "complaint":
+		return suppressEmail(exec, report.Email, suppressionComplaint, source, report.Detail)
+	case report.Permanent:
+		return suppressEmail(exec, report.Email, suppressionHardBounce, source, report.Detail)
+	}
+	log.WithFields(logrus.Fields{
+		"event":  "email_soft_bounce",
+		"email":  report.Email,
+		"source": source,
+	}).Info("Temporary bounce: ", report.Detail)
+	return nil
+}
+
+// startBounceWorker polls the configured bounce source, if any.
+func startBounceWorker(interval time.Duration) {
+	if bounceSource == nil {
+		return
+	}
+	go func() {
+		for {
+			if err := processBounceSource(bounceSource); err != nil {
+				log.Error("Failed to process bounces: ", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func processBounceSource(source BounceSource) error {
+	reports, err := source.Fetch()
+	if err != nil || len(reports) == 0 {
+		return err
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, report := range reports {
+		if err := recordBounceReport(db, report, "bounce_source"); err != nil {
+			return err
+		}
+	}
+	return source.Done(reports)
+}
+
+// bounceWebhookHandler records reports pushed by an email provider, as JSON
+// in the BounceReport format. The provider authenticates with the shared
+// secret in the X-Webhook-Secret header.
+func bounceWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if bounceWebhookSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get("X-Webhook-Secret")), []byte(bounceWebhookSecret)) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBounceWebhookSize+1))
+	if err != nil || len(body) > maxBounceWebhookSize {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+	reports, err := parseBounceJSON(body)
+	if err != nil {
+		http.Error(w, "Invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	for _, report := range reports {
+		if err := recordBounceReport(db, report, "webhook"); err != nil {
+			log.Error("Failed to record bounce report: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminSuppressionsHandler lists suppressed addresses, optionally filtered by
+// ?q=.
+func adminSuppressionsHandler(w http.ResponseWriter, r *http.Request) {
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	query := "SELECT email, reason, source, detail, created_at FROM email_suppressions"
+	var args []interface{}
+	if search != "" {
+		query += " WHERE email LIKE ?"
+		args = append(args, "%"+search+"%")
+	}
+	query += " ORDER BY created_at DESC LIMIT 100"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Println("Failed to fetch suppressions: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var suppressions []Suppression
+	for rows.Next() {
+		var s Suppression
+		var detail sql.NullString
+		if err := rows.Scan(&s.Email, &s.Reason, &s.Source, &detail, &s.CreatedAt); err != nil {
+			log.Println("Failed to scan suppression: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		s.Detail = detail.String
+		suppressions = append(suppressions, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Search       string
+		Suppressions []Suppression
+	}{
+		PageSecurity: pageSecurity(r),
+		Search:       search,
+		Suppressions: suppressions,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_suppressions.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// addSuppressionHandler suppresses an address by hand, for example after a
+// user asks by phone to stop all email.
+func addSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	if !strings.Contains(email, "@") {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if err := suppressEmail(db, email, suppressionManual, "admin:"+getUserIDFromRequest(r), r.FormValue("detail")); err != nil {
+		log.Println("Failed to add suppression: ", err)
+		http.Error(w, "Failed to add suppression", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/suppressions", http.StatusSeeOther)
+}
+
+// removeSuppressionHandler lets email go to an address again, once it is
+// known to work.
+func removeSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	email := r.FormValue("email")
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DELETE FROM email_suppressions WHERE email = ?", email); err != nil {
+		log.Println("Failed to remove suppression: ", err)
+		http.Error(w, "Failed to remove suppression", http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"event":    "email_unsuppressed",
+		"email":    email,
+		"admin_id": getUserIDFromRequest(r),
+	}).Info("Email address removed from the suppression list")
+	http.Redirect(w, r, "/admin/suppressions", http.StatusSeeOther)
+}
@@ -0,0 +1,889 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"ASS1/validation"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Marketing campaigns go to an audience segment at a scheduled time. When a
+// campaign starts, its audience is fixed in campaign_recipients; the campaign
+// worker then moves campaignBatchSize recipients into the email outbox per
+// campaignBatchInterval so large sends do not flood the mail server.
+const (
+	campaignBatchSize     = 100
+	campaignBatchInterval = time.Minute
+)
+
+const (
+	campaignScheduled = "scheduled"
+	campaignSending   = "sending"
+	campaignSent      = "sent"
+	campaignCancelled = "cancelled"
+)
+
+// CampaignSegment selects a campaign's audience. Empty fields do not narrow
+// it; disabled and erased accounts, users who opted out of marketing email
+// and suppressed addresses are never included.
+type CampaignSegment struct {
+	RoleIDs []int `json:"role_ids,omitempty"`
+	// Confirmation is "confirmed", "unconfirmed" or "" for both.
+	Confirmation string `json:"confirmation,omitempty"`
+	// Purchases is "buyers" (at least one order), "non_buyers" or "".
+	Purchases string `json:"purchases,omitempty"`
+	// Brands matches users who showed interest in any of the brands by
+	// adding their devices to the cart.
+	Brands []string `json:"brands,omitempty"`
+}
+
+// audienceQuery returns a query selecting the id and email of every user in
+// the segment.
+func (s CampaignSegment) audienceQuery() (string, []interface{}) {
+	query := "SELECT u.id, u.email FROM users u WHERE u.disabled = 0 AND " + optOutCondition(emailMarketing) + " AND " + suppressionCondition()
+	var args []interface{}
+
+	switch s.Confirmation {
+	case "confirmed":
+		query += " AND u.confirmed = 1"
+	case "unconfirmed":
+		query += " AND u.confirmed = 0"
+	}
+	if len(s.RoleIDs) > 0 {
+		query += " AND u.id IN (SELECT user_id FROM user_roles WHERE role_id IN (?" + strings.Repeat(", ?", len(s.RoleIDs)-1) + "))"
+		for _, id := range s.RoleIDs {
+			args = append(args, id)
+		}
+	}
+	switch s.Purchases {
+	case "buyers":
+		query += " AND EXISTS (SELECT 1 FROM transactions1 t WHERE t.customer_id = u.id)"
+	case "non_buyers":
+		query += " AND NOT EXISTS (SELECT 1 FROM transactions1 t WHERE t.customer_id = u.id)"
+	}
+	if len(s.Brands) > 0 {
+		query += " AND u.id IN (SELECT user_id FROM device_interest WHERE brand IN (?" + strings.Repeat(", ?", len(s.Brands)-1) + "))"
+		for _, brand := range s.Brands {
+			args = append(args, brand)
+		}
+	}
+	return query + " ORDER BY u.id", args
+}
+
+// Describe summarizes the segment for the admin pages.
+func (s CampaignSegment) Describe(roleNames map[int]string) string {
+	var parts []string
+	switch s.Confirmation {
+	case "confirmed":
+		parts = append(parts, "confirmed accounts")
+	case "unconfirmed":
+		parts = append(parts, "unconfirmed accounts")
+	default:
+		parts = append(parts, "all accounts")
+	}
+	if len(s.RoleIDs) > 0 {
+		names := make([]string, len(s.RoleIDs))
+		for i, id := range s.RoleIDs {
+			names[i] = roleNames[id]
+			if names[i] == "" {
+				names[i] = "#" + strconv.Itoa(id)
+			}
+		}
+		parts = append(parts, "with role "+strings.Join(names, " or "))
+	}
+	switch s.Purchases {
+	case "buyers":
+		parts = append(parts, "who have ordered")
+	case "non_buyers":
+		parts = append(parts, "who have never ordered")
+	}
+	if len(s.Brands) > 0 {
+		parts = append(parts, "interested in "+strings.Join(s.Brands, ", "))
+	}
+	return strings.Join(parts, " ")
+}
+
+// recordDeviceInterest notes that a user looked at buying a device of the
+// given brand, for brand-interest segments. Failures are only logged.
+func recordDeviceInterest(db *sql.DB, userID, brand string) {
+	_, err := db.Exec(`INSERT INTO device_interest (user_id, brand, interactions, last_seen_at) VALUES (?, ?, 1, NOW())
+		ON DUPLICATE KEY UPDATE interactions = interactions + 1, last_seen_at = NOW()`, userID, brand)
+	if err != nil {
+		log.Error("Failed to record device interest: ", err)
+	}
+}
+
+var (
+	// Trailing punctuation is left out so "see https://example.com." links
+	// to the site rather than to "https://example.com.".
+	campaignLinkPattern      = regexp.MustCompile(`https?://[^\s<>"]*[^\s<>".,;:!?)']`)
+	campaignParagraphPattern = regexp.MustCompile(`\n\s*\n`)
+)
+
+// campaignLinks returns the URLs in a campaign body. Click tracking only
+// redirects to these, so the tracking endpoint cannot be used as an open
+// redirect.
+func campaignLinks(body string) []string {
+	return campaignLinkPattern.FindAllString(body, -1)
+}
+
+func campaignClickURL(token, link string) string {
+	return "http://localhost:8080/c/c/" + token + "?u=" + url.QueryEscape(link)
+}
+
+// campaignContent turns the plain-text campaign body written by an admin into
+// HTML paragraphs and a plain-text part, with every link rewritten to go
+// through click tracking for the recipient's token.
+func campaignContent(body, token string) (paragraphs []template.HTML, text string) {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	for _, paragraph := range campaignParagraphPattern.Split(strings.TrimSpace(body), -1) {
+		var b strings.Builder
+		last := 0
+		for _, loc := range campaignLinkPattern.FindAllStringIndex(paragraph, -1) {
+			b.WriteString(template.HTMLEscapeString(paragraph[last:loc[0]]))
+			link := paragraph[loc[0]:loc[1]]
+			fmt.Fprintf(&b, `<a href="%s">%s</a>`, template.HTMLEscapeString(campaignClickURL(token, link)), template.HTMLEscapeString(link))
+			last = loc[1]
+		}
+		b.WriteString(template.HTMLEscapeString(paragraph[last:]))
+		paragraphs = append(paragraphs, template.HTML(strings.ReplaceAll(b.String(), "\n", "<br>\n")))
+	}
+
+	text = campaignLinkPattern.ReplaceAllStringFunc(strings.TrimSpace(body), func(link string) string {
+		return campaignClickURL(token, link)
+	})
+	return paragraphs, text
+}
+
+func campaignEmail(userID int, to, token, subject, body string) (*Message, error) {
+	paragraphs, text := campaignContent(body, token)
+	msg, err := newTemplatedEmail(to, "campaign", nil, map[string]interface{}{
+		"Subject":        subject,
+		"Paragraphs":     paragraphs,
+		"Text":           text,
+		"OpenURL":        "http://localhost:8080/c/o/" + token + ".gif",
+		"UnsubscribeURL": unsubscribeURL(userID, emailMarketing),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withUnsubscribe(msg, userID, emailMarketing), nil
+}
+
+// startCampaignWorker starts due campaigns and queues the next batch of each
+// running campaign every campaignBatchInterval.
+func startCampaignWorker() {
+	go func() {
+		for {
+			if err := processCampaigns(); err != nil {
+				log.Error("Campaign worker failed: ", err)
+			}
+			time.Sleep(campaignBatchInterval)
+		}
+	}()
+}
+
+func processCampaigns() error {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	due, err := campaignIDs(db, "SELECT id FROM campaigns WHERE status = ? AND scheduled_at <= NOW() ORDER BY id", campaignScheduled)
+	if err != nil {
+		return err
+	}
+	for _, id := range due {
+		if err := startCampaign(db, id); err != nil {
+			log.WithField("campaign_id", id).Error("Failed to start campaign: ", err)
+		}
+	}
+
+	running, err := campaignIDs(db, "SELECT id FROM campaigns WHERE status = ? ORDER BY id", campaignSending)
+	if err != nil {
+		return err
+	}
+	for _, id := range running {
+		if err := sendCampaignBatch(db, id, campaignBatchSize); err != nil {
+			log.WithField("campaign_id", id).Error("Failed to queue campaign batch: ", err)
+		}
+	}
+	return nil
+}
+
+func campaignIDs(db *sql.DB, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// startCampaign fixes the campaign's audience. Users who join the segment
+// after this point do not receive the campaign.
+func startCampaign(db *sql.DB, campaignID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE campaigns SET status = ?, started_at = NOW() WHERE id = ? AND status = ?", campaignSending, campaignID, campaignScheduled)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Cancelled, or started by another instance.
+		return nil
+	}
+
+	var segmentJSON string
+	if err := tx.QueryRow("SELECT segment FROM campaigns WHERE id = ?", campaignID).Scan(&segmentJSON); err != nil {
+		return err
+	}
+	var segment CampaignSegment
+	if err := json.Unmarshal([]byte(segmentJSON), &segment); err != nil {
+		return fmt.Errorf("decode segment: %w", err)
+	}
+
+	query, args := segment.audienceQuery()
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	type recipient struct {
+		userID int
+		email  string
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var rcpt recipient
+		if err := rows.Scan(&rcpt.userID, &rcpt.email); err != nil {
+			rows.Close()
+			return err
+		}
+		recipients = append(recipients, rcpt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rcpt := range recipients {
+		token, err := generateToken(16)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO campaign_recipients (campaign_id, user_id, email, token) VALUES (?, ?, ?, ?)", campaignID, rcpt.userID, rcpt.email, token)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":       "campaign_started",
+		"campaign_id": campaignID,
+		"recipients":  len(recipients),
+	}).Info("Campaign started")
+	return nil
+}
+
+// sendCampaignBatch moves up to limit pending recipients into the outbox and
+// marks the campaign sent once none are left. Recipients who opted out of
+// marketing email since the campaign started are skipped.
+func sendCampaignBatch(db *sql.DB, campaignID, limit int) error {
+	var subject, body string
+	if err := db.QueryRow("SELECT subject, body FROM campaigns WHERE id = ?", campaignID).Scan(&subject, &body); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT cr.id, cr.user_id, cr.email, cr.token, COALESCE(p.marketing, 1)
+		FROM campaign_recipients cr
+		LEFT JOIN communication_preferences p ON p.user_id = cr.user_id
+		WHERE cr.campaign_id = ? AND cr.status = 'pending' ORDER BY cr.id LIMIT ? FOR UPDATE`, campaignID, limit)
+	if err != nil {
+		return err
+	}
+	type pendingRecipient struct {
+		id, userID   int
+		email, token string
+		subscribed   bool
+	}
+	var batch []pendingRecipient
+	for rows.Next() {
+		var rcpt pendingRecipient
+		if err := rows.Scan(&rcpt.id, &rcpt.userID, &rcpt.email, &rcpt.token, &rcpt.subscribed); err != nil {
+			rows.Close()
+			return err
+		}
+		batch = append(batch, rcpt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(batch) == 0 {
+		if _, err := tx.Exec("UPDATE campaigns SET status = ?, finished_at = NOW() WHERE id = ? AND status = ?", campaignSent, campaignID, campaignSending); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{"event": "campaign_sent", "campaign_id": campaignID}).Info("Campaign fully queued")
+		return nil
+	}
+
+	for _, rcpt := range batch {
+		if !rcpt.subscribed {
+			if _, err := tx.Exec("UPDATE campaign_recipients SET status = 'skipped' WHERE id = ?", rcpt.id); err != nil {
+				return err
+			}
+			continue
+		}
+		msg, err := campaignEmail(rcpt.userID, rcpt.email, rcpt.token, subject, body)
+		if err != nil {
+			return err
+		}
+		outboxID, err := enqueueEmailID(tx, msg)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE campaign_recipients SET status = 'queued', outbox_id = ?, queued_at = NOW() WHERE id = ?", outboxID, rcpt.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// trackingPixel is a transparent 1x1 GIF.
+var trackingPixel = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+// campaignOpenHandler records that a recipient opened the email, as far as
+// their client loads images. The pixel is served whatever the token.
+func campaignOpenHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err == nil {
+		_, err = db.Exec("UPDATE campaign_recipients SET opened_at = COALESCE(opened_at, NOW()) WHERE token = ?", token)
+		db.Close()
+	}
+	if err != nil {
+		log.Error("Failed to record campaign open: ", err)
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(trackingPixel)
+}
+
+// campaignClickHandler records a click and redirects to the link, which must
+// appear in the campaign the token belongs to.
+func campaignClickHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	target := r.URL.Query().Get("u")
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var recipientID int
+	var body string
+	err = db.QueryRow("SELECT cr.id, c.body FROM campaign_recipients cr JOIN campaigns c ON c.id = cr.campaign_id WHERE cr.token = ?", token).Scan(&recipientID, &body)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Error("Failed to look up campaign recipient: ", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	allowed := false
+	for _, link := range campaignLinks(body) {
+		if link == target {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A click implies the email was opened even if images were blocked.
+	_, err = db.Exec(`UPDATE campaign_recipients SET click_count = click_count + 1,
+		clicked_at = COALESCE(clicked_at, NOW()), opened_at = COALESCE(opened_at, NOW()) WHERE id = ?`, recipientID)
+	if err != nil {
+		log.Error("Failed to record campaign click: ", err)
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+type CampaignStats struct {
+	Recipients int
+	Queued     int
+	Skipped    int
+	Delivered  int
+	Failed     int
+	Opened     int
+	Clicked    int
+	Clicks     int
+}
+
+func percentOf(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+}
+
+func (s CampaignStats) OpenRate() string  { return percentOf(s.Opened, s.Delivered) }
+func (s CampaignStats) ClickRate() string { return percentOf(s.Clicked, s.Delivered) }
+
+type Campaign struct {
+	ID          int
+	Name        string
+	Subject     string
+	Body        string
+	Segment     CampaignSegment
+	Audience    string
+	Status      string
+	ScheduledAt string
+	StartedAt   string
+	FinishedAt  string
+	CreatedAt   string
+	Stats       CampaignStats
+}
+
+func campaignStats(db *sql.DB, campaignID int) (CampaignStats, error) {
+	var stats CampaignStats
+	err := db.QueryRow(`SELECT COUNT(*),
+			COALESCE(SUM(cr.status = 'queued'), 0),
+			COALESCE(SUM(cr.status = 'skipped'), 0),
+			COALESCE(SUM(o.status = 'sent'), 0),
+			COALESCE(SUM(o.status = 'dead'), 0),
+			COALESCE(SUM(cr.opened_at IS NOT NULL), 0),
+			COALESCE(SUM(cr.clicked_at IS NOT NULL), 0),
+			COALESCE(SUM(cr.click_count), 0)
+		FROM campaign_recipients cr
+		LEFT JOIN email_outbox o ON o.id = cr.outbox_id
+		WHERE cr.campaign_id = ?`, campaignID).Scan(
+		&stats.Recipients, &stats.Queued, &stats.Skipped, &stats.Delivered, &stats.Failed, &stats.Opened, &stats.Clicked, &stats.Clicks)
+	return stats, err
+}
+
+func roleNamesByID(db *sql.DB) (map[int]string, []Role, error) {
+	rows, err := db.Query("SELECT id, name, is_system FROM roles ORDER BY name")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[int]string)
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Name, &role.IsSystem); err != nil {
+			return nil, nil, err
+		}
+		names[role.ID] = role.Name
+		roles = append(roles, role)
+	}
+	return names, roles, rows.Err()
+}
+
+func scanCampaign(scanner interface{ Scan(...interface{}) error }, roleNames map[int]string) (Campaign, error) {
+	var c Campaign
+	var segmentJSON string
+	var startedAt, finishedAt sql.NullString
+	err := scanner.Scan(&c.ID, &c.Name, &c.Subject, &c.Body, &segmentJSON, &c.Status, &c.ScheduledAt, &startedAt, &finishedAt, &c.CreatedAt)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal([]byte(segmentJSON), &c.Segment); err != nil {
+		return c, fmt.Errorf("decode segment of campaign %d: %w", c.ID, err)
+	}
+	c.Audience = c.Segment.Describe(roleNames)
+	c.StartedAt = startedAt.String
+	c.FinishedAt = finishedAt.String
+	return c, nil
+}
+
+const campaignColumns = "id, name, subject, body, segment, status, scheduled_at, started_at, finished_at, created_at"
+
+// renderCampaignsPage lists campaigns with their statistics, plus the form
+// for a new one, refilled from the submitted values after a validation error.
+func renderCampaignsPage(w http.ResponseWriter, r *http.Request, status int, errs validation.Errors) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	roleNames, roles, err := roleNamesByID(db)
+	if err != nil {
+		log.Println("Failed to fetch roles: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query("SELECT " + campaignColumns + " FROM campaigns ORDER BY id DESC LIMIT 50")
+	if err != nil {
+		log.Println("Failed to fetch campaigns: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var campaigns []Campaign
+	for rows.Next() {
+		c, err := scanCampaign(rows, roleNames)
+		if err != nil {
+			rows.Close()
+			log.Println("Failed to scan campaign: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		campaigns = append(campaigns, c)
+	}
+	rows.Close()
+	for i := range campaigns {
+		if campaigns[i].Stats, err = campaignStats(db, campaigns[i].ID); err != nil {
+			log.Println("Failed to fetch campaign statistics: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	brands, err := distinctBrands(db)
+	if err != nil {
+		log.Println("Failed to fetch brands: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	selectedRoles := make(map[int]bool)
+	for _, value := range r.Form["role_id"] {
+		if id, err := strconv.Atoi(value); err == nil {
+			selectedRoles[id] = true
+		}
+	}
+	selectedBrands := make(map[string]bool)
+	for _, brand := range r.Form["brand"] {
+		selectedBrands[brand] = true
+	}
+	confirmation := r.FormValue("confirmation")
+	if r.Method == http.MethodGet {
+		confirmation = "confirmed"
+	}
+
+	data := struct {
+		PageSecurity
+		Campaigns      []Campaign
+		Roles          []Role
+		Brands         []string
+		Errors         validation.Errors
+		Name           string
+		Subject        string
+		Body           string
+		ScheduledAt    string
+		Confirmation   string
+		Purchases      string
+		SelectedRoles  map[int]bool
+		SelectedBrands map[string]bool
+	}{
+		PageSecurity:   pageSecurity(r),
+		Campaigns:      campaigns,
+		Roles:          roles,
+		Brands:         brands,
+		Errors:         errs,
+		Name:           r.FormValue("name"),
+		Subject:        r.FormValue("subject"),
+		Body:           r.FormValue("body"),
+		ScheduledAt:    r.FormValue("scheduled_at"),
+		Confirmation:   confirmation,
+		Purchases:      r.FormValue("purchases"),
+		SelectedRoles:  selectedRoles,
+		SelectedBrands: selectedBrands,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_campaigns.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println("Failed to render template:", err)
+	}
+}
+
+func distinctBrands(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT brand FROM electronic ORDER BY brand")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var brands []string
+	for rows.Next() {
+		var brand string
+		if err := rows.Scan(&brand); err != nil {
+			return nil, err
+		}
+		brands = append(brands, brand)
+	}
+	return brands, rows.Err()
+}
+
+func campaignsHandler(w http.ResponseWriter, r *http.Request) {
+	renderCampaignsPage(w, r, http.StatusOK, nil)
+}
+
+// campaignScheduleLayout is the format of <input type="datetime-local">.
+const campaignScheduleLayout = "2006-01-02T15:04"
+
+func createCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	subject := strings.TrimSpace(r.FormValue("subject"))
+	body := strings.TrimSpace(r.FormValue("body"))
+	scheduledAt := r.FormValue("scheduled_at")
+
+	errs := validation.Validate(
+		validation.Field("name", name, validation.Required, validation.MaxLength(100)),
+		validation.Field("subject", subject, validation.Required, validation.MaxLength(255)),
+		validation.Field("body", body, validation.Required, validation.MaxLength(20000)),
+	)
+
+	schedule := time.Now()
+	if scheduledAt != "" {
+		t, err := time.ParseInLocation(campaignScheduleLayout, scheduledAt, time.Local)
+		if err != nil {
+			errs.Add("scheduled_at", "Enter a valid date and time")
+		} else {
+			schedule = t
+		}
+	}
+
+	segment := CampaignSegment{
+		Confirmation: r.FormValue("confirmation"),
+		Purchases:    r.FormValue("purchases"),
+		Brands:       r.Form["brand"],
+	}
+	if segment.Confirmation != "confirmed" && segment.Confirmation != "unconfirmed" && segment.Confirmation != "" {
+		errs.Add("confirmation", "Unknown confirmation status")
+	}
+	if segment.Purchases != "buyers" && segment.Purchases != "non_buyers" && segment.Purchases != "" {
+		errs.Add("purchases", "Unknown purchase history option")
+	}
+	for _, value := range r.Form["role_id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			errs.Add("role_id", "Invalid role")
+			break
+		}
+		segment.RoleIDs = append(segment.RoleIDs, id)
+	}
+	if errs.Any() {
+		rejectInput(w, r, errs, renderCampaignsPage)
+		return
+	}
+
+	segmentJSON, err := json.Marshal(segment)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO campaigns (name, subject, body, segment, status, scheduled_at, created_by) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		name, subject, body, segmentJSON, campaignScheduled, schedule.Format("2006-01-02 15:04:05"), getUserIDFromRequest(r))
+	if err != nil {
+		log.Println("Failed to create campaign: ", err)
+		http.Error(w, "Failed to create campaign", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":       "campaign_created",
+		"campaign_id": id,
+		"admin_id":    getUserIDFromRequest(r),
+	}).Info("Campaign scheduled")
+	http.Redirect(w, r, "/admin/campaigns/"+strconv.FormatInt(id, 10), http.StatusSeeOther)
+}
+
+// campaignHandler shows one campaign: its statistics once started, or the
+// current size of its audience while it is still scheduled.
+func campaignHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid campaign ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	roleNames, _, err := roleNamesByID(db)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	campaign, err := scanCampaign(db.QueryRow("SELECT "+campaignColumns+" FROM campaigns WHERE id = ?", id), roleNames)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to fetch campaign: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if campaign.Stats, err = campaignStats(db, id); err != nil {
+		log.Println("Failed to fetch campaign statistics: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	audienceSize := campaign.Stats.Recipients
+	if campaign.Status == campaignScheduled {
+		query, args := campaign.Segment.audienceQuery()
+		if err := db.QueryRow("SELECT COUNT(*) FROM ("+query+") audience", args...).Scan(&audienceSize); err != nil {
+			log.Println("Failed to count campaign audience: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	preview, err := campaignEmail(0, "preview@example.com", "preview", campaign.Subject, campaign.Body)
+	if err != nil {
+		log.Println("Failed to render campaign preview: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Campaign     Campaign
+		AudienceSize int
+		Preview      string
+		Cancellable  bool
+	}{
+		PageSecurity: pageSecurity(r),
+		Campaign:     campaign,
+		AudienceSize: audienceSize,
+		Preview:      preview.Text,
+		Cancellable:  campaign.Status == campaignScheduled || campaign.Status == campaignSending,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_campaign.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// cancelCampaignHandler stops a campaign. Recipients already moved to the
+// outbox still get the email.
+func cancelCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid campaign ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("UPDATE campaigns SET status = ?, finished_at = NOW() WHERE id = ? AND status IN (?, ?)", campaignCancelled, id, campaignScheduled, campaignSending)
+	if err != nil {
+		log.Println("Failed to cancel campaign: ", err)
+		http.Error(w, "Failed to cancel campaign", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Only scheduled or sending campaigns can be cancelled", http.StatusBadRequest)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":       "campaign_cancelled",
+		"campaign_id": id,
+		"admin_id":    getUserIDFromRequest(r),
+	}).Info("Campaign cancelled")
+	http.Redirect(w, r, "/admin/campaigns/"+strconv.Itoa(id), http.StatusSeeOther)
+}
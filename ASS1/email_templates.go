@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/gorilla/mux"
+)
+
+// Email templates live under pages/emails/<name>/<locale>/ as subject.txt,
+// body.html and an optional body.txt; without body.txt the plain-text part is
+// generated from the HTML. Each template directory may also hold a
+// sample.json with the data used for previews in the admin panel.
+const (
+	emailTemplatesDir  = "pages/emails"
+	defaultEmailLocale = "en"
+)
+
+type EmailTemplate struct {
+	Name    string
+	Locale  string
+	subject *texttemplate.Template
+	html    *template.Template
+	text    *texttemplate.Template
+}
+
+// EmailTemplateRegistry holds every template and locale found at startup, so
+// a broken template is reported when the server starts rather than when the
+// email is sent.
+type EmailTemplateRegistry struct {
+	templates map[string]map[string]*EmailTemplate
+	samples   map[string]map[string]interface{}
+}
+
+var emailTemplates *EmailTemplateRegistry
+
+func loadEmailTemplates(dir string) (*EmailTemplateRegistry, error) {
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := &EmailTemplateRegistry{
+		templates: make(map[string]map[string]*EmailTemplate),
+		samples:   make(map[string]map[string]interface{}),
+	}
+	for _, nameEntry := range names {
+		if !nameEntry.IsDir() {
+			continue
+		}
+		name := nameEntry.Name()
+		templateDir := filepath.Join(dir, name)
+
+		locales, err := os.ReadDir(templateDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, localeEntry := range locales {
+			if !localeEntry.IsDir() {
+				continue
+			}
+			t, err := parseEmailTemplate(filepath.Join(templateDir, localeEntry.Name()), name, localeEntry.Name())
+			if err != nil {
+				return nil, err
+			}
+			if registry.templates[name] == nil {
+				registry.templates[name] = make(map[string]*EmailTemplate)
+			}
+			registry.templates[name][t.Locale] = t
+		}
+		if registry.templates[name][defaultEmailLocale] == nil {
+			return nil, fmt.Errorf("email template %q has no %q version", name, defaultEmailLocale)
+		}
+
+		sample, err := os.ReadFile(filepath.Join(templateDir, "sample.json"))
+		if err == nil {
+			var data map[string]interface{}
+			if err := json.Unmarshal(sample, &data); err != nil {
+				return nil, fmt.Errorf("email template %q: sample.json: %w", name, err)
+			}
+			registry.samples[name] = data
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+func parseEmailTemplate(dir, name, locale string) (*EmailTemplate, error) {
+	t := &EmailTemplate{Name: name, Locale: strings.ToLower(locale)}
+
+	subject, err := os.ReadFile(filepath.Join(dir, "subject.txt"))
+	if err != nil {
+		return nil, err
+	}
+	if t.subject, err = texttemplate.New("subject").Parse(strings.TrimSpace(string(subject))); err != nil {
+		return nil, fmt.Errorf("%s/subject.txt: %w", dir, err)
+	}
+	if t.html, err = template.ParseFiles(filepath.Join(dir, "body.html")); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "body.txt")); err == nil {
+		if t.text, err = texttemplate.ParseFiles(filepath.Join(dir, "body.txt")); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Lookup returns the named template in the first available of the preferred
+// locales. "pt-br" falls back to "pt", and anything unavailable falls back to
+// defaultEmailLocale.
+func (reg *EmailTemplateRegistry) Lookup(name string, locales []string) (*EmailTemplate, error) {
+	versions := reg.templates[name]
+	if versions == nil {
+		return nil, fmt.Errorf("unknown email template %q", name)
+	}
+	for _, locale := range locales {
+		locale = strings.ToLower(locale)
+		if t := versions[locale]; t != nil {
+			return t, nil
+		}
+		if base, _, found := strings.Cut(locale, "-"); found {
+			if t := versions[base]; t != nil {
+				return t, nil
+			}
+		}
+	}
+	return versions[defaultEmailLocale], nil
+}
+
+func (reg *EmailTemplateRegistry) Names() []string {
+	names := make([]string, 0, len(reg.templates))
+	for name := range reg.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (reg *EmailTemplateRegistry) Locales(name string) []string {
+	locales := make([]string, 0, len(reg.templates[name]))
+	for locale := range reg.templates[name] {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Render executes the subject, HTML and plain-text parts with data.
+func (t *EmailTemplate) Render(data interface{}) (subject, htmlBody, textBody string, err error) {
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return "", "", "", err
+	}
+	subject = buf.String()
+
+	buf.Reset()
+	if err := t.html.Execute(&buf, data); err != nil {
+		return "", "", "", err
+	}
+	htmlBody = buf.String()
+
+	if t.text == nil {
+		return subject, htmlBody, htmlToText(htmlBody), nil
+	}
+	buf.Reset()
+	if err := t.text.Execute(&buf, data); err != nil {
+		return "", "", "", err
+	}
+	return subject, htmlBody, buf.String(), nil
+}
+
+// newTemplatedEmail renders the named template for one recipient in the
+// best matching locale.
+func newTemplatedEmail(to, name string, locales []string, data interface{}) (*Message, error) {
+	if emailTemplates == nil {
+		return nil, fmt.Errorf("email templates are not loaded")
+	}
+	t, err := emailTemplates.Lookup(name, locales)
+	if err != nil {
+		return nil, err
+	}
+	subject, htmlBody, textBody, err := t.Render(data)
+	if err != nil {
+		return nil, fmt.Errorf("render email %s/%s: %w", name, t.Locale, err)
+	}
+	return &Message{To: []string{to}, Subject: subject, HTML: htmlBody, Text: textBody}, nil
+}
+
+// requestLocales lists the locales from the Accept-Language header, most
+// preferred first.
+func requestLocales(r *http.Request) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		locale, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if _, err := fmt.Sscanf(value, "%g", &q); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{strings.ToLower(locale), q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	locales := make([]string, len(prefs))
+	for i, pref := range prefs {
+		locales[i] = pref.locale
+	}
+	return locales
+}
+
+var (
+	htmlWhitespacePattern = regexp.MustCompile(`\s+`)
+	htmlHiddenPattern     = regexp.MustCompile(`(?is)<(head|style|script)\b.*?</(head|style|script)>`)
+	htmlLinkPattern       = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+	htmlBreakPattern      = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlBlockPattern      = regexp.MustCompile(`(?i)</?(p|div|h[1-6]|table|tr|ul|ol)\b[^>]*>`)
+	htmlItemPattern       = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	htmlTagPattern        = regexp.MustCompile(`<[^>]*>`)
+	blankLinesPattern     = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText produces the plain-text part of an email from its HTML part:
+// block elements become paragraphs, list items become "- " lines and links
+// keep their target in parentheses.
+func htmlToText(s string) string {
+	s = htmlHiddenPattern.ReplaceAllString(s, "")
+	s = htmlWhitespacePattern.ReplaceAllString(s, " ")
+	s = htmlLinkPattern.ReplaceAllStringFunc(s, func(link string) string {
+		match := htmlLinkPattern.FindStringSubmatch(link)
+		href, label := match[1], strings.TrimSpace(htmlTagPattern.ReplaceAllString(match[2], ""))
+		if label == "" || label == href {
+			return href
+		}
+		return label + " (" + href + ")"
+	})
+	s = htmlBreakPattern.ReplaceAllString(s, "\n")
+	s = htmlItemPattern.ReplaceAllString(s, "\n- ")
+	s = htmlBlockPattern.ReplaceAllString(s, "\n\n")
+	s = html.UnescapeString(htmlTagPattern.ReplaceAllString(s, ""))
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+type EmailTemplateSummary struct {
+	Name    string
+	Locales []string
+}
+
+func emailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	var summaries []EmailTemplateSummary
+	for _, name := range emailTemplates.Names() {
+		summaries = append(summaries, EmailTemplateSummary{Name: name, Locales: emailTemplates.Locales(name)})
+	}
+
+	data := struct {
+		PageSecurity
+		Templates []EmailTemplateSummary
+	}{
+		PageSecurity: pageSecurity(r),
+		Templates:    summaries,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_emails.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// renderEmailPreview renders the template named in the URL with its sample
+// data, in the locale given by ?locale=.
+func renderEmailPreview(w http.ResponseWriter, r *http.Request) (t *EmailTemplate, subject, htmlBody, textBody string, ok bool) {
+	name := mux.Vars(r)["name"]
+	locale := r.URL.Query().Get("locale")
+	t, err := emailTemplates.Lookup(name, []string{locale})
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, "", "", "", false
+	}
+	subject, htmlBody, textBody, err = t.Render(emailTemplates.samples[name])
+	if err != nil {
+		log.Println("Failed to render email preview: ", err)
+		http.Error(w, "Failed to render email: "+err.Error(), http.StatusInternalServerError)
+		return nil, "", "", "", false
+	}
+	return t, subject, htmlBody, textBody, true
+}
+
+func emailPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	t, subject, _, textBody, ok := renderEmailPreview(w, r)
+	if !ok {
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Name    string
+		Locale  string
+		Locales []string
+		Subject string
+		Text    string
+	}{
+		PageSecurity: pageSecurity(r),
+		Name:         t.Name,
+		Locale:       t.Locale,
+		Locales:      emailTemplates.Locales(t.Name),
+		Subject:      subject,
+		Text:         textBody,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_email_preview.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// emailPreviewHTMLHandler serves the rendered HTML part on its own for the
+// preview page's sandboxed iframe. Email HTML relies on inline styles, so it
+// gets a policy of its own that allows those but no scripts.
+func emailPreviewHTMLHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, htmlBody, _, ok := renderEmailPreview(w, r)
+	if !ok {
+		return
+	}
+
+	header := w.Header()
+	header.Del("Content-Security-Policy-Report-Only")
+	header.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src * data:; frame-ancestors 'self'")
+	header.Set("X-Frame-Options", "SAMEORIGIN")
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, htmlBody)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Open pages receive live updates as Server-Sent Events from /events. Events
+// go through a Broker: eventHub, the in-process implementation, serves a
+// single application instance; running several instances needs a Broker
+// backed by an external message broker so every instance sees every event.
+const (
+	eventsHeartbeat     = 25 * time.Second
+	eventsRetry         = 5 * time.Second
+	eventsWriteTimeout  = 10 * time.Second
+	eventReplayWindow   = 5 * time.Minute
+	eventReplayLimit    = 100
+	maxStreamsPerUser   = 5
+	maxStreams          = 10000
+	subscriberQueueSize = 32
+)
+
+// Event types sent to pages.
+const (
+	eventNotification     = "notification"
+	eventNotificationRead = "notifications_read"
+	eventCart             = "cart"
+	// eventResync tells the client it may have missed events and should
+	// reload its state.
+	eventResync = "resync"
+)
+
+var errTooManyStreams = errors.New("too many event streams")
+
+type Event struct {
+	ID   string
+	Type string
+	Data []byte
+}
+
+// Broker delivers events to users' open event streams.
+type Broker interface {
+	// Publish sends an event with data, encoded as JSON, to one user.
+	Publish(userID, eventType string, data interface{}) error
+	// Broadcast sends an event to every user.
+	Broadcast(eventType string, data interface{}) error
+	// Subscribe opens a stream of the user's events. With the ID of the last
+	// event the client saw, events published since are replayed first, or a
+	// resync event is sent when they are no longer available. It returns
+	// errTooManyStreams when connection limits are reached.
+	Subscribe(userID, lastEventID string) (Subscription, error)
+}
+
+type Subscription interface {
+	// Events is closed when the subscriber falls too far behind; the client
+	// reconnects and catches up through Last-Event-ID.
+	Events() <-chan Event
+	Close()
+}
+
+var broker Broker = newEventHub()
+
+// publishEvent publishes to a user, logging rather than failing the request
+// that caused the event.
+func publishEvent(userID int, eventType string, data interface{}) {
+	if err := broker.Publish(strconv.Itoa(userID), eventType, data); err != nil {
+		log.WithFields(logrus.Fields{"event_type": eventType, "user_id": userID}).Error("Failed to publish event: ", err)
+	}
+}
+
+type hubEvent struct {
+	Event
+	seq uint64
+	at  time.Time
+}
+
+// eventLog is the replay buffer of one user, or of broadcasts.
+type eventLog struct {
+	events []hubEvent
+	// dropped is the highest sequence number removed from events; a client
+	// that last saw an older event may have missed some.
+	dropped uint64
+}
+
+type eventHub struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	logs        map[string]*eventLog
+	subscribers map[string]map[*hubSubscription]bool
+	streams     int
+	lastPrune   time.Time
+	// forgotten is the highest sequence number dropped from a log that has
+	// since been deleted.
+	forgotten uint64
+
+	replayWindow time.Duration
+	replayLimit  int
+	maxPerUser   int
+	maxStreams   int
+}
+
+// newEventHub returns an in-process Broker. Event IDs start with the hub's
+// creation time, so IDs from before a restart are recognized as stale.
+func newEventHub() *eventHub {
+	return &eventHub{
+		epoch:        strconv.FormatInt(time.Now().UnixNano(), 36),
+		logs:         make(map[string]*eventLog),
+		subscribers:  make(map[string]map[*hubSubscription]bool),
+		replayWindow: eventReplayWindow,
+		replayLimit:  eventReplayLimit,
+		maxPerUser:   maxStreamsPerUser,
+		maxStreams:   maxStreams,
+	}
+}
+
+// broadcastKey holds broadcasts in logs; user IDs are never empty.
+const broadcastKey = ""
+
+func (h *eventHub) Publish(userID, eventType string, data interface{}) error {
+	return h.publish(userID, eventType, data)
+}
+
+func (h *eventHub) Broadcast(eventType string, data interface{}) error {
+	return h.publish(broadcastKey, eventType, data)
+}
+
+func (h *eventHub) publish(key, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.prune(now)
+	h.seq++
+	event := hubEvent{Event: Event{ID: h.eventID(h.seq), Type: eventType, Data: payload}, seq: h.seq, at: now}
+
+	l := h.logs[key]
+	if l == nil {
+		l = &eventLog{}
+		h.logs[key] = l
+	}
+	l.events = append(l.events, event)
+	if len(l.events) > h.replayLimit {
+		l.dropped = l.events[0].seq
+		l.events = l.events[1:]
+	}
+
+	if key == broadcastKey {
+		for _, subs := range h.subscribers {
+			for sub := range subs {
+				h.deliver(sub, event.Event)
+			}
+		}
+	} else {
+		for sub := range h.subscribers[key] {
+			h.deliver(sub, event.Event)
+		}
+	}
+	return nil
+}
+
+// deliver queues an event without blocking the publisher. A subscriber
+// whose queue is full is disconnected. The caller holds h.mu.
+func (h *eventHub) deliver(sub *hubSubscription, event Event) {
+	select {
+	case sub.events <- event:
+	default:
+		log.WithField("user_id", sub.userID).Warn("Event stream fell behind, disconnecting")
+		h.remove(sub)
+	}
+}
+
+// prune drops events older than the replay window, at most once a minute.
+// The caller holds h.mu.
+func (h *eventHub) prune(now time.Time) {
+	if now.Sub(h.lastPrune) < time.Minute {
+		return
+	}
+	h.lastPrune = now
+	cutoff := now.Add(-h.replayWindow)
+	for key, l := range h.logs {
+		n := 0
+		for n < len(l.events) && l.events[n].at.Before(cutoff) {
+			n++
+		}
+		if n > 0 {
+			l.dropped = l.events[n-1].seq
+			l.events = l.events[n:]
+		}
+		if len(l.events) == 0 && len(h.subscribers[key]) == 0 {
+			if l.dropped > h.forgotten {
+				h.forgotten = l.dropped
+			}
+			delete(h.logs, key)
+		}
+	}
+}
+
+func (h *eventHub) eventID(seq uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+func (h *eventHub) Subscribe(userID, lastEventID string) (Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.streams >= h.maxStreams || len(h.subscribers[userID]) >= h.maxPerUser {
+		return nil, errTooManyStreams
+	}
+
+	sub := &hubSubscription{hub: h, userID: userID, events: make(chan Event, subscriberQueueSize)}
+	if lastEventID != "" {
+		replay, ok := h.replay(userID, lastEventID)
+		if !ok || len(replay) > subscriberQueueSize {
+			sub.events <- Event{ID: h.eventID(h.seq), Type: eventResync, Data: []byte("{}")}
+		} else {
+			for _, event := range replay {
+				sub.events <- event
+			}
+		}
+	}
+
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[*hubSubscription]bool)
+	}
+	h.subscribers[userID][sub] = true
+	h.streams++
+	return sub, nil
+}
+
+// replay returns the user's and broadcast events after lastEventID, in
+// order. It reports false when some may be missing. The caller holds h.mu.
+func (h *eventHub) replay(userID, lastEventID string) ([]Event, bool) {
+	epoch, seqText, _ := strings.Cut(lastEventID, "-")
+	last, err := strconv.ParseUint(seqText, 10, 64)
+	if err != nil || epoch != h.epoch || last > h.seq {
+		return nil, false
+	}
+
+	var events []hubEvent
+	for _, key := range []string{userID, broadcastKey} {
+		l := h.logs[key]
+		if l == nil {
+			if last < h.forgotten {
+				return nil, false
+			}
+			continue
+		}
+		if last < l.dropped {
+			return nil, false
+		}
+		for _, event := range l.events {
+			if event.seq > last {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].seq < events[j].seq })
+
+	replay := make([]Event, len(events))
+	for i, event := range events {
+		replay[i] = event.Event
+	}
+	return replay, true
+}
+
+// remove unregisters sub and closes its channel. The caller holds h.mu.
+func (h *eventHub) remove(sub *hubSubscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(h.subscribers[sub.userID], sub)
+	if len(h.subscribers[sub.userID]) == 0 {
+		delete(h.subscribers, sub.userID)
+	}
+	h.streams--
+	close(sub.events)
+}
+
+type hubSubscription struct {
+	hub    *eventHub
+	userID string
+	events chan Event
+	closed bool // guarded by hub.mu
+}
+
+func (s *hubSubscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *hubSubscription) Close() {
+	s.hub.mu.Lock()
+	s.hub.remove(s)
+	s.hub.mu.Unlock()
+}
+
+// writeEvent writes one event in the text/event-stream format.
+func writeEvent(w io.Writer, event Event) error {
+	var b strings.Builder
+	if event.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", event.ID)
+	}
+	fmt.Fprintf(&b, "event: %s\n", event.Type)
+	for _, line := range strings.Split(string(event.Data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// eventsHandler streams the signed-in user's events. Browsers reconnect on
+// their own after a dropped connection, sending the Last-Event-ID header so
+// missed events are replayed.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sub, err := broker.Subscribe(userID, r.Header.Get("Last-Event-ID"))
+	if errors.Is(err, errTooManyStreams) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(eventsRetry.Seconds())))
+		http.Error(w, "Too many open event streams", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to subscribe to events: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Stop reverse proxies such as nginx from buffering the stream.
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// A client that stops reading must not hold the connection forever, so
+	// every write gets a deadline.
+	rc := http.NewResponseController(w)
+	send := func(write func() error) bool {
+		rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		if err := write(); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	if !send(func() error {
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+		return err
+	}) {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events():
+			if !ok || !send(func() error { return writeEvent(w, event) }) {
+				return
+			}
+		case <-heartbeat.C:
+			// Comments keep idle connections open through proxies.
+			if !send(func() error {
+				_, err := io.WriteString(w, ": heartbeat\n\n")
+				return err
+			}) {
+				return
+			}
+		}
+	}
+}
@@ -5,8 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+
+	"ASS1/validation"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
@@ -28,7 +34,51 @@ type Device struct {
 	Model string `json:"model"`
 }
 
-func GetDevicesFromDBWithPagination(query string) ([]Device, error) {
+const devicesPerPage = 10
+
+// deviceSortColumns are the columns the device list can be sorted by.
+var deviceSortColumns = map[string]bool{"id": true, "type1": true, "brand": true, "model": true}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// deviceListQuery builds the device list query from the filter, sort and
+// page parameters. The filter is matched literally against the brand and
+// bound as a parameter; sort must be one of deviceSortColumns, optionally
+// followed by "asc" or "desc".
+func deviceListQuery(params url.Values) (string, []interface{}, validation.Errors) {
+	filter := strings.TrimSpace(params.Get("filter"))
+	errs := validation.Validate(validation.Field("filter", filter, validation.MaxLength(50)))
+
+	query := "SELECT id, type1, brand, model FROM electronic"
+	var args []interface{}
+	if filter != "" {
+		query += ` WHERE brand LIKE ? ESCAPE '\\'`
+		args = append(args, "%"+likeEscaper.Replace(filter)+"%")
+	}
+
+	if sort := strings.Fields(strings.ToLower(params.Get("sort"))); len(sort) > 0 {
+		if len(sort) > 2 || !deviceSortColumns[sort[0]] || (len(sort) == 2 && sort[1] != "asc" && sort[1] != "desc") {
+			errs.Add("sort", "Sort by id, type1, brand or model, optionally followed by asc or desc")
+		} else {
+			query += " ORDER BY " + strings.Join(sort, " ")
+		}
+	}
+
+	offset := 0
+	if page := params.Get("page"); page != "" {
+		p, err := strconv.Atoi(page)
+		if err != nil || p < 1 {
+			errs.Add("page", "Page must be a positive number")
+		} else {
+			offset = (p - 1) * devicesPerPage
+		}
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, devicesPerPage, offset)
+	return query, args, errs
+}
+
+func GetDevicesFromDBWithPagination(query string, args ...interface{}) ([]Device, error) {
 	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
 	db, err := sql.Open(dbDriver, dsn)
 	if err != nil {
@@ -36,7 +86,7 @@ func GetDevicesFromDBWithPagination(query string) ([]Device, error) {
 	}
 	defer db.Close()
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -95,11 +145,17 @@ func createDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	type1 := r.FormValue("type1")
-	brand := r.FormValue("brand")
-	model := r.FormValue("model")
+	device, err := deviceInput(r)
+	if err != nil {
+		http.Error(w, "Invalid JSON Format", http.StatusBadRequest)
+		return
+	}
+	if errs := validateDevice(device); errs.Any() {
+		rejectInput(w, r, errs, renderAdminPage)
+		return
+	}
 
-	err = CreateDevice(db, type1, brand, model)
+	err = CreateDevice(db, device.Type1, device.Brand, device.Model)
 	if err != nil {
 		http.Error(w, "Failed to create device", http.StatusInternalServerError)
 		return
@@ -108,10 +164,52 @@ func createDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin", http.StatusSeeOther)
 }
 
+// deviceInput reads device fields from a JSON body or, for browser forms,
+// from the form values.
+func deviceInput(r *http.Request) (Device, error) {
+	var device Device
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		err := json.NewDecoder(r.Body).Decode(&device)
+		device.Type1 = strings.TrimSpace(device.Type1)
+		device.Brand = strings.TrimSpace(device.Brand)
+		device.Model = strings.TrimSpace(device.Model)
+		return device, err
+	}
+	device.Type1 = strings.TrimSpace(r.FormValue("type1"))
+	device.Brand = strings.TrimSpace(r.FormValue("brand"))
+	device.Model = strings.TrimSpace(r.FormValue("model"))
+	return device, nil
+}
+
+func validateDevice(device Device) validation.Errors {
+	return validation.Validate(
+		validation.Field("type1", device.Type1, validation.Required, validation.MaxLength(50)),
+		validation.Field("brand", device.Brand, validation.Required, validation.MaxLength(50)),
+		validation.Field("model", device.Model, validation.Required, validation.MaxLength(100)),
+	)
+}
+
 func CreateDevice(db *sql.DB, type1, brand, model string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := "INSERT INTO electronic (type1, brand, model) VALUES (?, ?, ?)"
-	_, err := db.Exec(query, type1, brand, model)
-	return err
+	result, err := tx.Exec(query, type1, brand, model)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	device := Device{ID: int(id), Type1: type1, Brand: brand, Model: model}
+	if err := enqueueWebhookEvent(tx, webhookDeviceCreated, device); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func getDeviceHandler(w http.ResponseWriter, r *http.Request) {
@@ -175,11 +273,17 @@ func updateDeviceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	type1 := r.FormValue("type1")
-	brand := r.FormValue("brand")
-	model := r.FormValue("model")
+	device, err := deviceInput(r)
+	if err != nil {
+		http.Error(w, "Invalid JSON Format", http.StatusBadRequest)
+		return
+	}
+	if errs := validateDevice(device); errs.Any() {
+		rejectInput(w, r, errs, renderAdminPage)
+		return
+	}
 
-	err = UpdateDevice(db, deviceID, type1, brand, model)
+	err = UpdateDevice(db, deviceID, device.Type1, device.Brand, device.Model)
 	if err != nil {
 		http.Error(w, "Failed to update device", http.StatusInternalServerError)
 		return
@@ -189,9 +293,102 @@ func updateDeviceHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func UpdateDevice(db *sql.DB, id int, type1, brand, model string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := "UPDATE electronic SET type1 = ?, brand = ?, model = ? WHERE id = ?"
-	_, err := db.Exec(query, type1, brand, model, id)
-	return err
+	_, err = tx.Exec(query, type1, brand, model, id)
+	if err != nil {
+		return err
+	}
+	device := Device{ID: id, Type1: type1, Brand: brand, Model: model}
+	if err := enqueueWebhookEvent(tx, webhookDeviceUpdated, device); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setDevicePriceHandler sets a device's price from the price form value or
+// a JSON {"price": ...} body. A lower price notifies users who have the
+// device in their cart.
+func setDevicePriceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		Price float64 `json:"price"`
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		err = json.NewDecoder(r.Body).Decode(&input)
+	} else {
+		input.Price, err = strconv.ParseFloat(strings.TrimSpace(r.FormValue("price")), 64)
+	}
+	if err != nil || input.Price <= 0 || input.Price >= 1e8 {
+		rejectInput(w, r, validation.Errors{"price": "Enter a price greater than 0"}, renderAdminPage)
+		return
+	}
+	price := math.Round(input.Price*100) / 100
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	device, err := GetDevice(db, deviceID)
+	if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	if err := SetDevicePrice(db, *device, price); err != nil {
+		log.Error("Failed to set device price: ", err)
+		http.Error(w, "Failed to set price", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+func SetDevicePrice(db *sql.DB, device Device, price float64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldPrice sql.NullFloat64
+	err = tx.QueryRow("SELECT price FROM device_prices WHERE device_id = ? FOR UPDATE", device.ID).Scan(&oldPrice)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO device_prices (device_id, price, updated_at) VALUES (?, ?, NOW())
+		ON DUPLICATE KEY UPDATE price = VALUES(price), updated_at = NOW()`, device.ID, price)
+	if err != nil {
+		return err
+	}
+	var notified map[int]Notification
+	if oldPrice.Valid && price < oldPrice.Float64 {
+		notified, err = notifyPriceDrop(tx, device, oldPrice.Float64, price)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for userID, n := range notified {
+		publishEvent(userID, eventNotification, n)
+	}
+	return nil
 }
 
 func deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
@@ -222,8 +419,18 @@ func deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
 
 func DeleteDevice(db *sql.DB, id int) error {
 	log.Printf("Deleting device with ID %d\n", id) // Log the ID being deleted
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM device_prices WHERE device_id = ?", id); err != nil {
+		log.Printf("Error deleting device price: %v\n", err)
+		return err
+	}
 	query := "DELETE FROM electronic WHERE id = ?"
-	result, err := db.Exec(query, id)
+	result, err := tx.Exec(query, id)
 	if err != nil {
 		log.Printf("Error deleting device: %v\n", err) // Log the deletion error
 		return err
@@ -231,8 +438,13 @@ func DeleteDevice(db *sql.DB, id int) error {
 
 	rowsAffected, _ := result.RowsAffected()
 	log.Printf("Rows affected after deletion: %d\n", rowsAffected) // Log the number of rows affected
+	if rowsAffected > 0 {
+		if err := enqueueWebhookEvent(tx, webhookDeviceDeleted, map[string]int{"id": id}); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	return tx.Commit()
 }
 
 func handleJSONRequest(w http.ResponseWriter, r *http.Request) {
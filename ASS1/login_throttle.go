@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxLoginFailures     = 5
+	loginLockoutDuration = 15 * time.Minute
+	loginBaseBackoff     = 1 * time.Second
+	loginMaxBackoff      = 1 * time.Minute
+	// Counters with no failures for this long are forgotten.
+	loginFailureWindow = 1 * time.Hour
+	// Forgotten counters are swept out at most this often.
+	loginSweepInterval = 1 * time.Minute
+)
+
+type loginAttempt struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+type LockedAccount struct {
+	Kind        string
+	Key         string
+	Failures    int
+	LockedUntil time.Time
+}
+
+var loginAttempts = struct {
+	sync.Mutex
+	byUser    map[string]*loginAttempt
+	byIP      map[string]*loginAttempt
+	lastSweep time.Time
+}{byUser: make(map[string]*loginAttempt), byIP: make(map[string]*loginAttempt)}
+
+// loginRetryAfter reports how long the caller must wait before another login
+// attempt for this username or IP is accepted. Zero means the attempt may proceed.
+func loginRetryAfter(username, ip string, now time.Time) time.Duration {
+	loginAttempts.Lock()
+	defer loginAttempts.Unlock()
+
+	wait := attemptRetryAfter(loginAttempts.byUser[username], now)
+	if ipWait := attemptRetryAfter(loginAttempts.byIP[ip], now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+func attemptRetryAfter(a *loginAttempt, now time.Time) time.Duration {
+	if a == nil || a.Failures == 0 {
+		return 0
+	}
+	if now.Before(a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+	if next := a.LastFailure.Add(loginBackoff(a.Failures)); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// loginBackoff doubles the delay with every consecutive failure.
+func loginBackoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	backoff := loginBaseBackoff
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= loginMaxBackoff {
+			return loginMaxBackoff
+		}
+	}
+	return backoff
+}
+
+func recordLoginFailure(username, ip string, now time.Time) {
+	loginAttempts.Lock()
+	defer loginAttempts.Unlock()
+
+	if now.Sub(loginAttempts.lastSweep) >= loginSweepInterval {
+		sweepLoginAttempts(loginAttempts.byUser, now)
+		sweepLoginAttempts(loginAttempts.byIP, now)
+		loginAttempts.lastSweep = now
+	}
+	if username != "" {
+		registerFailure(loginAttempts.byUser, "username", username, now)
+	}
+	registerFailure(loginAttempts.byIP, "ip", ip, now)
+}
+
+func registerFailure(attempts map[string]*loginAttempt, kind, key string, now time.Time) {
+	a, ok := attempts[key]
+	if !ok || now.Sub(a.LastFailure) > loginFailureWindow {
+		a = &loginAttempt{}
+		attempts[key] = a
+	}
+	a.Failures++
+	a.LastFailure = now
+
+	if a.Failures >= maxLoginFailures && !now.Before(a.LockedUntil) {
+		a.LockedUntil = now.Add(loginLockoutDuration)
+		log.WithFields(logrus.Fields{
+			"event":        "account_lockout",
+			"kind":         kind,
+			"key":          key,
+			"failures":     a.Failures,
+			"locked_until": a.LockedUntil,
+		}).Warn("Login locked after repeated failures")
+	}
+}
+
+// sweepLoginAttempts removes counters that registerFailure would reset
+// anyway, so guessing from many addresses or usernames cannot grow the maps
+// without bound.
+func sweepLoginAttempts(attempts map[string]*loginAttempt, now time.Time) {
+	for key, a := range attempts {
+		if now.Sub(a.LastFailure) > loginFailureWindow && !now.Before(a.LockedUntil) {
+			delete(attempts, key)
+		}
+	}
+}
+
+// recordLoginSuccess clears the username counter. The IP counter is left alone
+// so that one valid account cannot be used to reset guessing against others.
+func recordLoginSuccess(username string) {
+	loginAttempts.Lock()
+	delete(loginAttempts.byUser, username)
+	loginAttempts.Unlock()
+}
+
+func unlockLogin(kind, key string) bool {
+	loginAttempts.Lock()
+	defer loginAttempts.Unlock()
+
+	attempts := loginAttempts.byUser
+	if kind == "ip" {
+		attempts = loginAttempts.byIP
+	}
+	if _, ok := attempts[key]; !ok {
+		return false
+	}
+	delete(attempts, key)
+	return true
+}
+
+func lockedLogins(now time.Time) []LockedAccount {
+	loginAttempts.Lock()
+	defer loginAttempts.Unlock()
+
+	var locked []LockedAccount
+	collect := func(kind string, attempts map[string]*loginAttempt) {
+		for key, a := range attempts {
+			if now.Before(a.LockedUntil) {
+				locked = append(locked, LockedAccount{Kind: kind, Key: key, Failures: a.Failures, LockedUntil: a.LockedUntil})
+			}
+		}
+	}
+	collect("username", loginAttempts.byUser)
+	collect("ip", loginAttempts.byIP)
+
+	sort.Slice(locked, func(i, j int) bool {
+		return locked[i].LockedUntil.Before(locked[j].LockedUntil)
+	})
+	return locked
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeLoginThrottled(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(wait.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many failed login attempts, please try again later", http.StatusTooManyRequests)
+}
+
+func unlockLoginHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.FormValue("kind")
+	key := r.FormValue("key")
+	if (kind != "username" && kind != "ip") || key == "" {
+		http.Error(w, "Invalid unlock request", http.StatusBadRequest)
+		return
+	}
+
+	if unlockLogin(kind, key) {
+		log.WithFields(logrus.Fields{
+			"event":    "account_unlock",
+			"kind":     kind,
+			"key":      key,
+			"admin_id": getUserIDFromRequest(r),
+		}).Info("Login lock cleared by admin")
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
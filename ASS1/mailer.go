@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ASS1/smtptest"
+
+	"gopkg.in/gomail.v2"
+)
+
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Message is an outgoing email. At least one of Text and HTML must be set;
+// with both, recipients get a multipart/alternative message.
+type Message struct {
+	From        string
+	To          []string
+	Subject     string
+	Text        string
+	HTML        string
+	Headers     map[string]string
+	Attachments []Attachment
+}
+
+// Mailer delivers email. The application sends all mail through the package
+// level mailer, chosen at startup by loadMailer.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// mailer holds mail in memory until loadMailer configures delivery.
+var mailer Mailer = &MemoryMailer{}
+
+// defaultMailFrom is used when a Message has no From address.
+var defaultMailFrom = envOrDefault("MAIL_FROM", "sagidolla04@internet.ru")
+
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// loadMailer selects the mailer from MAILER: "smtp" (the default) sends via
+// SMTP_HOST/SMTP_PORT/SMTP_USERNAME/SMTP_PASSWORD, all but the port being
+// required, "file" writes .eml files
+// to MAIL_DROP_DIR for local development, and "memory" keeps messages in
+// memory. "smtptest" also runs an in-process SMTP server on SMTPTEST_ADDR and
+// sends to it over SMTP, with a web UI to read the captured mail on
+// SMTPTEST_UI_ADDR.
+func loadMailer() error {
+	switch kind := envOrDefault("MAILER", "smtp"); kind {
+	case "smtp":
+		smtpMailer, err := newSMTPMailerFromEnv()
+		if err != nil {
+			return err
+		}
+		mailer = smtpMailer
+	case "file":
+		dir := envOrDefault("MAIL_DROP_DIR", "mail")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		mailer = &FileDropMailer{Dir: dir}
+	case "memory":
+		mailer = &MemoryMailer{}
+	case "smtptest":
+		srv, err := smtptest.Listen(envOrDefault("SMTPTEST_ADDR", "127.0.0.1:2525"))
+		if err != nil {
+			return err
+		}
+		mailer = &SMTPMailer{Host: srv.Host(), Port: srv.Port()}
+		uiAddr := envOrDefault("SMTPTEST_UI_ADDR", "127.0.0.1:8025")
+		go func() {
+			log.Info("Captured mail UI listening on http://", uiAddr)
+			log.Error("Captured mail UI stopped: ", http.ListenAndServe(uiAddr, srv.Handler()))
+		}()
+	default:
+		return fmt.Errorf("unknown MAILER %q", kind)
+	}
+	return nil
+}
+
+// buildMessage converts msg into a gomail message, which both the SMTP and
+// file-drop mailers use to produce the MIME encoding.
+func buildMessage(msg *Message) (*gomail.Message, error) {
+	if len(msg.To) == 0 {
+		return nil, fmt.Errorf("message %q has no recipients", msg.Subject)
+	}
+	from := msg.From
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", msg.To...)
+	m.SetHeader("Subject", msg.Subject)
+	for name, value := range msg.Headers {
+		m.SetHeader(name, value)
+	}
+
+	switch {
+	case msg.Text != "" && msg.HTML != "":
+		m.SetBody("text/plain", msg.Text)
+		m.AddAlternative("text/html", msg.HTML)
+	case msg.HTML != "":
+		m.SetBody("text/html", msg.HTML)
+	default:
+		m.SetBody("text/plain", msg.Text)
+	}
+
+	for _, attachment := range msg.Attachments {
+		data := attachment.Data
+		settings := []gomail.FileSetting{gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})}
+		if attachment.ContentType != "" {
+			settings = append(settings, gomail.SetHeader(map[string][]string{"Content-Type": {attachment.ContentType}}))
+		}
+		m.Attach(attachment.Filename, settings...)
+	}
+	return m, nil
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func newSMTPMailerFromEnv() (*SMTPMailer, error) {
+	port, err := strconv.Atoi(envOrDefault("SMTP_PORT", "587"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_PORT: %w", err)
+	}
+	s := &SMTPMailer{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}
+	var missing []string
+	for name, value := range map[string]string{"SMTP_HOST": s.Host, "SMTP_USERNAME": s.Username, "SMTP_PASSWORD": s.Password} {
+		if value == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("MAILER=smtp needs %s to be set", strings.Join(missing, ", "))
+	}
+	return s, nil
+}
+
+func (s *SMTPMailer) Send(msg *Message) error {
+	m, err := buildMessage(msg)
+	if err != nil {
+		return err
+	}
+	from := msg.From
+	if from == "" {
+		from = defaultMailFrom
+	}
+	if address, err := mail.ParseAddress(from); err == nil {
+		from = address.Address
+	}
+
+	d := gomail.NewDialer(s.Host, s.Port, s.Username, s.Password)
+	d.TLSConfig = &tls.Config{ServerName: s.Host}
+	conn, err := d.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Sending on the connection directly, rather than through gomail.Send,
+	// keeps the server's reply code in the error.
+	var reply *textproto.Error
+	if err := conn.Send(from, msg.To, m); err != nil {
+		if errors.As(err, &reply) && reply.Code >= 500 && reply.Code < 600 {
+			return &PermanentError{Recipients: msg.To, Code: reply.Code, Msg: reply.Msg}
+		}
+		return err
+	}
+	return nil
+}
+
+// PermanentError is a 5xx reply from the mail server: retrying the message
+// will not get it delivered.
+type PermanentError struct {
+	Recipients []string
+	Code       int
+	Msg        string
+}
+
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Msg)
+}
+
+// HardBounce reports whether the server rejected the recipient address
+// itself, as opposed to the message. With an RFC 3463 enhanced status code
+// that is 5.1.x (bad address) or 5.2.1 (mailbox disabled); servers without
+// enhanced codes use 550, 551 and 553.
+func (e *PermanentError) HardBounce() bool {
+	status, _, _ := strings.Cut(e.Msg, " ")
+	if parts := strings.Split(status, "."); len(parts) == 3 && parts[0] == "5" {
+		return parts[1] == "1" || status == "5.2.1"
+	}
+	return e.Code == 550 || e.Code == 551 || e.Code == 553
+}
+
+// FileDropMailer writes each message as an .eml file in Dir instead of
+// sending it; the files open in any mail client.
+type FileDropMailer struct {
+	Dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func (f *FileDropMailer) Send(msg *Message) error {
+	m, err := buildMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.seq++
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().Format("20060102-150405.000000"), f.seq)
+	f.mu.Unlock()
+
+	file, err := os.Create(filepath.Join(f.Dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := m.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// MemoryMailer records messages instead of sending them, so tests can assert
+// on sent mail.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(msg *Message) error {
+	if len(msg.To) == 0 {
+		return fmt.Errorf("message %q has no recipients", msg.Subject)
+	}
+	m.mu.Lock()
+	m.messages = append(m.messages, *msg)
+	m.mu.Unlock()
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far.
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	m.messages = nil
+	m.mu.Unlock()
+}
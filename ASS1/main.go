@@ -7,10 +7,7 @@ import (
 	"github.com/SebastiaanKlippert/go-wkhtmltopdf"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
-	"gopkg.in/gomail.v2"
 	"html/template"
-	"io"
 	"net/http"
 	"os"
 	"strconv"
@@ -18,7 +15,6 @@ import (
 	"time"
 )
 
-var limiter = rate.NewLimiter(1, 10)
 var log = logrus.New()
 
 var cartStorage = struct {
@@ -37,10 +33,66 @@ func main() {
 
 	log.SetOutput(logFile)
 
+	oidcProvidersFile := os.Getenv("OIDC_PROVIDERS_FILE")
+	if oidcProvidersFile == "" {
+		oidcProvidersFile = "oidc_providers.json"
+	}
+	if err := loadOIDCProviders(oidcProvidersFile); err != nil {
+		log.Error("Failed to load OIDC providers: ", err)
+		return
+	}
+
+	if err := loadMailer(); err != nil {
+		log.Error("Failed to configure mailer: ", err)
+		return
+	}
+	emailTemplates, err = loadEmailTemplates(emailTemplatesDir)
+	if err != nil {
+		log.Error("Failed to load email templates: ", err)
+		return
+	}
+	if err := loadBounceSource(); err != nil {
+		log.Error("Failed to configure bounce processing: ", err)
+		return
+	}
+	if err := loadPasswordHashConfig(); err != nil {
+		log.Error("Failed to load password hashing settings: ", err)
+		return
+	}
+	if err := loadPasswordPolicy(); err != nil {
+		log.Error("Failed to load password policy: ", err)
+		return
+	}
+
+	securityHeaders, err := loadSecurityHeadersConfig()
+	if err != nil {
+		log.Error("Failed to load security header settings: ", err)
+		return
+	}
+
+	rateLimitsFile := os.Getenv("RATE_LIMITS_FILE")
+	if rateLimitsFile == "" {
+		rateLimitsFile = "rate_limits.json"
+	}
+	rateLimiter, err := loadRateLimiter(rateLimitsFile, newMemoryRateLimitStore(10000, 10*time.Minute))
+	if err != nil {
+		log.Error("Failed to load rate limits: ", err)
+		return
+	}
+
+	startAccountDeletionWorker(time.Hour)
+	startOutboxWorkers(outboxWorkers)
+	startCampaignWorker()
+	startBounceWorker(bouncePollInterval)
+	startWebhookWorkers(webhookWorkers)
+
 	r := mux.NewRouter()
+	r.Use(securityHeadersMiddleware(securityHeaders))
+	r.Use(rateLimiter.Middleware)
+	r.Use(csrfMiddleware)
 	r.Use(methodOverrideMiddleware)
-	r.HandleFunc("/", limitHandler(mainPageHandler)).Methods("GET")
-	r.HandleFunc("/json", limitHandler(handleJSONRequest)).Methods("POST")
+	r.HandleFunc("/", mainPageHandler).Methods("GET")
+	r.HandleFunc("/json", handleJSONRequest).Methods("POST")
 	r.HandleFunc("/buy", buyHandler).Methods("POST")
 	r.HandleFunc("/buy1", buyHandler1).Methods("POST")
 	r.HandleFunc("/payment", paymentHandler).Methods("GET")
@@ -48,23 +100,77 @@ func main() {
 	r.HandleFunc("/payment-success", paymentSuccessHandler).Methods("GET")
 	r.HandleFunc("/register", registerHandler).Methods("GET", "POST")
 	r.HandleFunc("/login", loginHandler).Methods("GET", "POST")
+	r.HandleFunc("/login/oidc/{provider}", oidcLoginHandler).Methods("GET")
+	r.HandleFunc("/login/oidc/{provider}/callback", oidcCallbackHandler).Methods("GET")
 	r.HandleFunc("/confirm", confirmHandler).Methods("GET")
-	r.HandleFunc("/user", authMiddleware(userProfileHandler)).Methods("GET")
-	r.HandleFunc("/admin", authMiddleware(adminMiddleware(adminProfileHandler))).Methods("GET")
-	r.HandleFunc("/change-password", authMiddleware(changePasswordHandler)).Methods("POST")
-	r.HandleFunc("/change-email", authMiddleware(changeEmailHandler)).Methods("POST")
+	r.HandleFunc("/confirm/resend", resendConfirmationHandler).Methods("GET", "POST")
+	r.HandleFunc("/reset-password", resetPasswordHandler).Methods("GET", "POST")
+	r.HandleFunc("/user", authMiddleware(RequireSession(userProfileHandler))).Methods("GET")
+	r.HandleFunc("/admin", authMiddleware(RequirePermission(PermAdminAccess)(adminProfileHandler))).Methods("GET")
+	r.HandleFunc("/change-password", authMiddleware(RequireSession(changePasswordHandler))).Methods("POST")
+	r.HandleFunc("/change-email", authMiddleware(RequireSession(changeEmailHandler))).Methods("POST")
+	r.HandleFunc("/api-keys", authMiddleware(createAPIKeyHandler)).Methods("POST")
+	r.HandleFunc("/api-keys/revoke", authMiddleware(revokeAPIKeyHandler)).Methods("POST")
+	r.HandleFunc("/user/data-export", authMiddleware(RequireSession(dataExportHandler))).Methods("GET")
+	r.HandleFunc("/user/preferences", authMiddleware(RequireSession(communicationPreferencesHandler))).Methods("POST")
+	r.HandleFunc("/notifications", authMiddleware(RequireScope(ScopeSelf)(notificationsHandler))).Methods("GET")
+	r.HandleFunc("/notifications/read", authMiddleware(RequireScope(ScopeSelf)(markNotificationsReadHandler))).Methods("POST")
+	r.HandleFunc("/events", authMiddleware(RequireScope(ScopeSelf)(eventsHandler))).Methods("GET")
+	r.HandleFunc(unsubscribePath, unsubscribeHandler).Methods("GET", "POST")
+	r.HandleFunc("/user/delete", authMiddleware(RequireSession(requestAccountDeletionHandler))).Methods("POST")
+	r.HandleFunc("/user/delete/cancel", authMiddleware(RequireSession(cancelAccountDeletionHandler))).Methods("POST")
+	r.HandleFunc("/change-email/confirm", confirmEmailChangeHandler).Methods("GET")
+	r.HandleFunc("/change-email/revert", revertEmailChangeHandler).Methods("GET")
 	r.HandleFunc("/logout", logoutHandler).Methods("GET")
+	r.HandleFunc(cspReportPath, cspReportHandler).Methods("POST")
+	r.HandleFunc(bounceWebhookPath, bounceWebhookHandler).Methods("POST")
+	r.HandleFunc("/c/o/{token:[0-9a-f]+}.gif", campaignOpenHandler).Methods("GET")
+	r.HandleFunc("/c/c/{token:[0-9a-f]+}", campaignClickHandler).Methods("GET")
 
 	// Admin routes for device management
-	r.HandleFunc("/device", authMiddleware(adminMiddleware(createDeviceHandler))).Methods("POST")
-	r.HandleFunc("/device/{id}", authMiddleware(adminMiddleware(getDeviceHandler))).Methods("GET")
-	r.HandleFunc("/device/{id}", authMiddleware(adminMiddleware(updateDeviceHandler))).Methods("POST", "PUT")
-	r.HandleFunc("/device/{id}", authMiddleware(adminMiddleware(deleteDeviceHandler))).Methods("POST", "DELETE")
-
-	r.HandleFunc("/admin/roles", authMiddleware(adminMiddleware(createRoleHandler))).Methods("POST")
-	r.HandleFunc("/admin/roles/update", authMiddleware(adminMiddleware(updateRoleHandler))).Methods("POST")
-	r.HandleFunc("/admin/roles/delete", authMiddleware(adminMiddleware(deleteRoleHandler))).Methods("POST")
-	r.HandleFunc("/admin/send-email", authMiddleware(adminMiddleware(sendEmailHandler))).Methods("POST")
+	r.HandleFunc("/device", authMiddleware(RequirePermission(PermDeviceWrite)(createDeviceHandler))).Methods("POST")
+	r.HandleFunc("/device/{id}", authMiddleware(RequirePermission(PermDeviceWrite)(getDeviceHandler))).Methods("GET")
+	r.HandleFunc("/device/{id}/price", authMiddleware(RequirePermission(PermDeviceWrite)(setDevicePriceHandler))).Methods("POST")
+	r.HandleFunc("/device/{id}", authMiddleware(RequirePermission(PermDeviceWrite)(updateDeviceHandler))).Methods("POST", "PUT")
+	r.HandleFunc("/device/{id}", authMiddleware(RequirePermission(PermDeviceWrite)(deleteDeviceHandler))).Methods("POST", "DELETE")
+
+	r.HandleFunc("/admin/roles", authMiddleware(RequirePermission(PermRoleManage)(createRoleHandler))).Methods("POST")
+	r.HandleFunc("/admin/roles/update", authMiddleware(RequirePermission(PermRoleManage)(updateRoleHandler))).Methods("POST")
+	r.HandleFunc("/admin/roles/delete", authMiddleware(RequirePermission(PermRoleManage)(deleteRoleHandler))).Methods("POST")
+	r.HandleFunc("/admin/roles/permissions", authMiddleware(RequirePermission(PermRoleManage)(updateRolePermissionsHandler))).Methods("POST")
+	r.HandleFunc("/admin/campaigns", authMiddleware(RequirePermission(PermEmailBroadcast)(campaignsHandler))).Methods("GET")
+	r.HandleFunc("/admin/campaigns", authMiddleware(RequirePermission(PermEmailBroadcast)(createCampaignHandler))).Methods("POST")
+	r.HandleFunc("/admin/campaigns/{id:[0-9]+}", authMiddleware(RequirePermission(PermEmailBroadcast)(campaignHandler))).Methods("GET")
+	r.HandleFunc("/admin/campaigns/{id:[0-9]+}/cancel", authMiddleware(RequirePermission(PermEmailBroadcast)(cancelCampaignHandler))).Methods("POST")
+	r.HandleFunc("/admin/unlock", authMiddleware(RequirePermission(PermUserManage)(unlockLoginHandler))).Methods("POST")
+	r.HandleFunc("/admin/password-hashes", authMiddleware(RequirePermission(PermUserManage)(passwordHashReportHandler))).Methods("GET")
+	r.HandleFunc("/admin/erasures", authMiddleware(RequirePermission(PermUserManage)(adminErasuresHandler))).Methods("GET")
+	r.HandleFunc("/admin/emails", authMiddleware(RequirePermission(PermEmailBroadcast)(emailTemplatesHandler))).Methods("GET")
+	r.HandleFunc("/admin/emails/{name}", authMiddleware(RequirePermission(PermEmailBroadcast)(emailPreviewHandler))).Methods("GET")
+	r.HandleFunc("/admin/emails/{name}/html", authMiddleware(RequirePermission(PermEmailBroadcast)(emailPreviewHTMLHandler))).Methods("GET")
+	r.HandleFunc("/admin/outbox", authMiddleware(RequirePermission(PermEmailBroadcast)(adminOutboxHandler))).Methods("GET")
+	r.HandleFunc("/admin/outbox/{id:[0-9]+}/retry", authMiddleware(RequirePermission(PermEmailBroadcast)(retryOutboxMessageHandler))).Methods("POST")
+	r.HandleFunc("/admin/announcements", authMiddleware(RequirePermission(PermEmailBroadcast)(announcementHandler))).Methods("POST")
+	r.HandleFunc("/admin/orders", authMiddleware(RequirePermission(PermOrderManage)(adminOrdersHandler))).Methods("GET")
+	r.HandleFunc("/admin/orders/{id:[0-9]+}/status", authMiddleware(RequirePermission(PermOrderManage)(setOrderStatusHandler))).Methods("POST")
+	r.HandleFunc("/admin/suppressions", authMiddleware(RequirePermission(PermEmailBroadcast)(adminSuppressionsHandler))).Methods("GET")
+	r.HandleFunc("/admin/suppressions", authMiddleware(RequirePermission(PermEmailBroadcast)(addSuppressionHandler))).Methods("POST")
+	r.HandleFunc("/admin/suppressions/remove", authMiddleware(RequirePermission(PermEmailBroadcast)(removeSuppressionHandler))).Methods("POST")
+	r.HandleFunc("/admin/webhooks", authMiddleware(RequirePermission(PermWebhookManage)(webhooksHandler))).Methods("GET")
+	r.HandleFunc("/admin/webhooks", authMiddleware(RequirePermission(PermWebhookManage)(createWebhookHandler))).Methods("POST")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}", authMiddleware(RequirePermission(PermWebhookManage)(webhookHandler))).Methods("GET")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}", authMiddleware(RequirePermission(PermWebhookManage)(updateWebhookHandler))).Methods("POST")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}/delete", authMiddleware(RequirePermission(PermWebhookManage)(deleteWebhookHandler))).Methods("POST")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}/test", authMiddleware(RequirePermission(PermWebhookManage)(testWebhookHandler))).Methods("POST")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}/deliveries/{delivery:[0-9]+}/retry", authMiddleware(RequirePermission(PermWebhookManage)(retryWebhookDeliveryHandler))).Methods("POST")
+	r.HandleFunc("/admin/users", authMiddleware(RequirePermission(PermUserManage)(adminUsersHandler))).Methods("GET")
+	r.HandleFunc("/admin/users/{id}", authMiddleware(RequirePermission(PermUserManage)(adminUserHandler))).Methods("GET")
+	r.HandleFunc("/admin/users/{id}/roles", authMiddleware(RequirePermission(PermUserManage)(assignUserRoleHandler))).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/roles/revoke", authMiddleware(RequirePermission(PermUserManage)(revokeUserRoleHandler))).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/confirm", authMiddleware(RequirePermission(PermUserManage)(confirmUserHandler))).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/status", authMiddleware(RequirePermission(PermUserManage)(setUserDisabledHandler))).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/force-password-reset", authMiddleware(RequirePermission(PermUserManage)(forcePasswordResetHandler))).Methods("POST")
+	r.HandleFunc("/admin/users/{id}/email-deliverable", authMiddleware(RequirePermission(PermUserManage)(clearEmailSuppressionHandler))).Methods("POST")
 
 	log.Info("Server listening on port 8080")
 	http.ListenAndServe(":8080", r)
@@ -76,15 +182,10 @@ func mainPageHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
 		return
 	}
-	filter := r.URL.Query().Get("filter")
-	sort := r.URL.Query().Get("sort")
-	page := r.URL.Query().Get("page")
-
-	limit := 10
-	offset := 0
-
-	if p, err := strconv.Atoi(page); err == nil && p > 1 {
-		offset = (p - 1) * limit
+	query, args, errs := deviceListQuery(r.URL.Query())
+	if errs.Any() {
+		writeValidationError(w, http.StatusBadRequest, "Validation failed", errs)
+		return
 	}
 
 	log.WithFields(logrus.Fields{
@@ -93,16 +194,7 @@ func mainPageHandler(w http.ResponseWriter, r *http.Request) {
 		"path":   r.URL.Path,
 	}).Info("Handling main page request")
 
-	query := "SELECT id, type1, brand, model FROM electronic"
-	if filter != "" {
-		query += " WHERE brand LIKE '%" + filter + "%'"
-	}
-	if sort != "" {
-		query += " ORDER BY " + sort
-	}
-	query += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
-
-	devices, err = GetDevicesFromDBWithPagination(query)
+	devices, err = GetDevicesFromDBWithPagination(query, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
 		return
@@ -115,11 +207,13 @@ func mainPageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := struct {
+		PageSecurity
 		Devices    []Device
 		IsLoggedIn bool
 	}{
-		Devices:    devices,
-		IsLoggedIn: isLoggedIn,
+		PageSecurity: pageSecurity(r),
+		Devices:      devices,
+		IsLoggedIn:   isLoggedIn,
 	}
 
 	tmpl, err := template.ParseFiles("pages/index.html")
@@ -134,15 +228,6 @@ func mainPageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
-func limitHandler(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if !limiter.Allow() {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			return
-		}
-		next.ServeHTTP(w, r)
-	}
-}
 func buyHandler1(w http.ResponseWriter, r *http.Request) {
 	userID := getUserIDFromRequest(r)
 	if userID == "" {
@@ -165,24 +250,33 @@ func buyHandler1(w http.ResponseWriter, r *http.Request) {
 
 	cartStorage.Lock()
 	cartStorage.carts[userID] = append(cartStorage.carts[userID], device)
+	cart := append([]Device{}, cartStorage.carts[userID]...)
 	cartStorage.Unlock()
+	if err := broker.Publish(userID, eventCart, cart); err != nil {
+		log.Error("Failed to publish event: ", err)
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	if db, err := sql.Open(dbDriver, dsn); err == nil {
+		recordDeviceInterest(db, userID, device.Brand)
+		db.Close()
+	}
 
 	http.Redirect(w, r, "/user", http.StatusSeeOther)
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   "token",
-		Value:  "",
-		MaxAge: -1,
-	})
+	clearSessionCookie(w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func insertTransaction(db *sql.DB, customerID, status string) error {
+func insertTransaction(db *sql.DB, customerID, status string) (int64, error) {
 	query := "INSERT INTO transactions1 (customer_id, status) VALUES (?, ?)"
-	_, err := db.Exec(query, customerID, status)
-	return err
+	result, err := db.Exec(query, customerID, status)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
 }
 
 func buyHandler(w http.ResponseWriter, r *http.Request) {
@@ -200,13 +294,13 @@ func buyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	err = insertTransaction(db, customerID, "pending")
+	orderID, err := insertTransaction(db, customerID, "pending")
 	if err != nil {
 		http.Error(w, "Failed to create transaction", http.StatusInternalServerError)
 		return
 	}
 
-	http.Redirect(w, r, "/payment", http.StatusSeeOther)
+	http.Redirect(w, r, fmt.Sprintf("/payment?order_id=%d", orderID), http.StatusSeeOther)
 }
 
 func GetDeviceByID(id int) (Device, error) {
@@ -281,6 +375,11 @@ func generateReceiptPDF(data ReceiptData) ([]byte, error) {
 func processPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
+	customerID, orderID, ok := checkoutRequest(w, r)
+	if !ok {
+		return
+	}
+
 	cardNumber := r.FormValue("cardNumber")
 	expirationDate := r.FormValue("expirationDate")
 	cvv := r.FormValue("cvv")
@@ -295,7 +394,7 @@ func processPaymentHandler(w http.ResponseWriter, r *http.Request) {
 		// Simulate transaction data
 		receiptData := ReceiptData{
 			CompanyName:       "Your Company",
-			TransactionNumber: "1234567890",
+			TransactionNumber: strconv.Itoa(orderID),
 			DateTime:          time.Now().Format("2006-01-02 15:04:05"),
 			CustomerName:      name,
 			PaymentMethod:     "Credit Card",
@@ -306,23 +405,61 @@ func processPaymentHandler(w http.ResponseWriter, r *http.Request) {
 			GrandTotal: "$50.00",
 		}
 
-		pdfBytes, err := generateReceiptPDF(receiptData)
+		dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+		db, err := sql.Open(dbDriver, dsn)
 		if err != nil {
-			log.Printf("Failed to generate PDF: %v", err)
-			http.Error(w, "Failed to generate PDF", http.StatusInternalServerError)
+			log.Printf("Failed to open database connection: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		defer db.Close()
 
-		// Assuming the client email is available
+		// The order update and the receipt commit together. The payment has
+		// gone through by now, so a receipt that cannot be queued is logged
+		// rather than failing the request.
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
 
-		clientEmail := "craldiyar@gmail.com"
-		err = sendEmailWithAttachment(clientEmail, pdfBytes)
+		if !payableOrder(w, tx, orderID, customerID) {
+			return
+		}
+		change, n, err := changeOrderStatus(tx, orderID, "paid")
 		if err != nil {
-			log.Printf("Failed to send email: %v", err)
-			http.Error(w, "Failed to send email", http.StatusInternalServerError)
+			log.Printf("Failed to mark order paid: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
+		var clientEmail string
+		err = tx.QueryRow("SELECT email FROM users WHERE id = ?", customerID).Scan(&clientEmail)
+		var pdfBytes []byte
+		if err == nil {
+			pdfBytes, err = generateReceiptPDF(receiptData)
+		}
+		if err == nil {
+			var msg *Message
+			msg, err = receiptEmail(clientEmail, name, pdfBytes, requestLocales(r))
+			if err == nil {
+				err = enqueueEmail(tx, msg)
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to queue receipt email: %v", err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to record payment: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if change != nil {
+			orderStatusChanged(change, n)
+		}
+
 		http.Redirect(w, r, "/payment-success", http.StatusSeeOther)
 	} else {
 		http.Error(w, "Payment failed", http.StatusPaymentRequired)
@@ -342,49 +479,151 @@ func getEmailByID(db *sql.DB, userID int) (string, error) {
 	return email, nil
 }
 
-func sendEmailWithAttachment(to string, pdfBytes []byte) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", "sagidolla04@internet.ru")
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", "Your Receipt")
-	m.SetBody("text/plain", "Thank you for your purchase. Please find your receipt attached.")
+func receiptEmail(to, customerName string, pdfBytes []byte, locales []string) (*Message, error) {
+	msg, err := newTemplatedEmail(to, "receipt", locales, map[string]interface{}{"CustomerName": customerName})
+	if err != nil {
+		return nil, err
+	}
+	msg.Attachments = []Attachment{
+		{Filename: "receipt.pdf", ContentType: "application/pdf", Data: pdfBytes},
+	}
+	return msg, nil
+}
 
-	m.Attach("receipt.pdf", gomail.SetCopyFunc(func(w io.Writer) error {
-		_, err := w.Write(pdfBytes)
+// updateTransactionStatus moves an order to status and notifies the
+// customer. It returns sql.ErrNoRows for an unknown order.
+func updateTransactionStatus(db *sql.DB, transactionID int, status string) error {
+	tx, err := db.Begin()
+	if err != nil {
 		return err
-	}))
-
-	d := gomail.NewDialer("smtp.mail.ru", 587, "sagidolla04@internet.ru", "HBthmWAUUQ4JS7AvsK5v")
+	}
+	defer tx.Rollback()
 
-	if err := d.DialAndSend(m); err != nil {
+	change, n, err := changeOrderStatus(tx, transactionID, status)
+	if err != nil || change == nil {
 		return err
 	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	orderStatusChanged(change, n)
 	return nil
 }
 
-func updateTransactionStatus(db *sql.DB, transactionID int, status string) error {
-	query := "UPDATE transactions1 SET status = ? WHERE customer_id = ?"
-	_, err := db.Exec(query, status, transactionID)
+// changeOrderStatus moves an order to status within tx, queueing the
+// webhook event and storing the customer's notification. It returns a nil
+// change when the order already had the status; otherwise pass the change
+// and notification to orderStatusChanged once tx commits.
+func changeOrderStatus(tx *sql.Tx, transactionID int, status string) (*orderStatusChange, Notification, error) {
+	var customerID int
+	var current string
+	err := tx.QueryRow("SELECT customer_id, status FROM transactions1 WHERE id = ? FOR UPDATE", transactionID).Scan(&customerID, &current)
+	if err != nil {
+		return nil, Notification{}, err
+	}
+	if current == status {
+		return nil, Notification{}, nil
+	}
+
+	query := "UPDATE transactions1 SET status = ? WHERE id = ?"
+	_, err = tx.Exec(query, status, transactionID)
 	if err != nil {
 		log.Printf("Error executing query: %v", err)
+		return nil, Notification{}, err
+	}
+	change := &orderStatusChange{OrderID: transactionID, CustomerID: customerID, From: current, To: status}
+	if err := enqueueWebhookEvent(tx, webhookOrderStatus, change); err != nil {
+		return nil, Notification{}, err
+	}
+	title, body := orderStatusNotification(transactionID, status)
+	n, err := notifyUser(tx, customerID, Notification{Type: notificationOrderStatus, Title: title, Body: body, Link: "/user"})
+	if err != nil {
+		return nil, Notification{}, err
 	}
-	return err
+	return change, n, nil
 }
 
-func getTransactionIDFromSession(r *http.Request) int {
-	// For demonstration, returning a static transaction ID
-	// In real implementation, retrieve it from session or request context
-	return 21
+// orderStatusChanged pushes the notification for a committed status change
+// and logs it.
+func orderStatusChanged(change *orderStatusChange, n Notification) {
+	publishEvent(change.CustomerID, eventNotification, n)
+	log.WithFields(logrus.Fields{
+		"event":       "order_status_changed",
+		"order_id":    change.OrderID,
+		"customer_id": change.CustomerID,
+		"from":        change.From,
+		"to":          change.To,
+	}).Info("Order status changed")
+}
+
+// checkoutRequest returns the signed-in customer and the order_id the
+// checkout form carries, writing the error response when either is missing.
+func checkoutRequest(w http.ResponseWriter, r *http.Request) (customerID, orderID int, ok bool) {
+	customerID, err := strconv.Atoi(getUserIDFromRequest(r))
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return 0, 0, false
+	}
+	orderID, err = strconv.Atoi(r.FormValue("order_id"))
+	if err != nil || orderID <= 0 {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return customerID, orderID, true
+}
+
+// payableOrder checks that orderID is customerID's order and still awaits
+// payment, writing the error response when it is not. Pass a transaction to
+// lock the order until it is updated.
+func payableOrder(w http.ResponseWriter, q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, orderID, customerID int) bool {
+	var owner int
+	var status string
+	err := q.QueryRow("SELECT customer_id, status FROM transactions1 WHERE id = ? FOR UPDATE", orderID).Scan(&owner, &status)
+	if err == sql.ErrNoRows || (err == nil && owner != customerID) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to load order: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if status != "pending" {
+		http.Error(w, "Order is not awaiting payment", http.StatusConflict)
+		return false
+	}
+	return true
 }
 
 func paymentHandler(w http.ResponseWriter, r *http.Request) {
+	customerID, orderID, ok := checkoutRequest(w, r)
+	if !ok {
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+	if !payableOrder(w, db, orderID, customerID) {
+		return
+	}
+
 	tmpl, err := template.ParseFiles("pages/payment.html")
 	if err != nil {
 		http.Error(w, "Failed to load template", http.StatusInternalServerError)
 		return
 	}
 
-	err = tmpl.Execute(w, nil)
+	err = tmpl.Execute(w, struct {
+		PageSecurity
+		OrderID int
+	}{pageSecurity(r), orderID})
 	if err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		return
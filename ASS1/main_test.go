@@ -1,15 +1,40 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"ASS1/smtptest"
+	"ASS1/validation"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestCreateDevice(t *testing.T) {
@@ -58,3 +83,2094 @@ func TestGetDeviceHandler(t *testing.T) {
 		t.Errorf("Incorrect device. Expected: %+v, Got: %+v", expected, device)
 	}
 }
+
+func TestLoginLockout(t *testing.T) {
+	now := time.Now()
+	username, ip := "lockout-test-user", "192.0.2.10"
+	defer unlockLogin("username", username)
+	defer unlockLogin("ip", ip)
+
+	for i := 0; i < maxLoginFailures; i++ {
+		recordLoginFailure(username, ip, now)
+	}
+
+	wait := loginRetryAfter(username, "192.0.2.11", now.Add(loginMaxBackoff))
+	if wait <= 0 || wait > loginLockoutDuration {
+		t.Errorf("Expected username to be locked out, got wait %v", wait)
+	}
+
+	if !unlockLogin("username", username) {
+		t.Fatal("Expected unlock to find the locked username")
+	}
+	if wait := loginRetryAfter(username, "192.0.2.11", now.Add(loginMaxBackoff)); wait != 0 {
+		t.Errorf("Expected no wait after unlock, got %v", wait)
+	}
+	if wait := loginRetryAfter("another-user", ip, now.Add(loginMaxBackoff)); wait <= 0 {
+		t.Errorf("Expected IP to stay locked after username unlock")
+	}
+}
+
+func TestLoginFailuresAreForgotten(t *testing.T) {
+	start := time.Now()
+	defer unlockLogin("username", "sweep-test-user")
+	for i := 0; i < 3; i++ {
+		recordLoginFailure("", fmt.Sprintf("192.0.2.%d", 100+i), start)
+	}
+	recordLoginFailure("sweep-test-user", "192.0.2.110", start.Add(loginFailureWindow))
+
+	// A failure after the window sweeps out counters that have gone quiet.
+	recordLoginFailure("", "192.0.2.120", start.Add(loginFailureWindow+loginSweepInterval+time.Second))
+	loginAttempts.Lock()
+	_, stale := loginAttempts.byIP["192.0.2.100"]
+	_, recent := loginAttempts.byIP["192.0.2.110"]
+	_, user := loginAttempts.byUser["sweep-test-user"]
+	loginAttempts.Unlock()
+	defer unlockLogin("ip", "192.0.2.110")
+	defer unlockLogin("ip", "192.0.2.120")
+	if stale {
+		t.Error("Expected the expired IP counter to be swept")
+	}
+	if !recent || !user {
+		t.Error("Expected counters inside the window to be kept")
+	}
+}
+
+// testOIDCServer is a minimal local stand-in for an OpenID Connect provider.
+// It remembers the PKCE challenge and nonce sent to /authorize and only
+// redeems the issued code for the matching verifier.
+type testOIDCServer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	clientID  string
+	challenge string
+	nonce     string
+}
+
+func newTestOIDCServer(t *testing.T, clientID string) *testOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testOIDCServer{key: key, clientID: clientID}
+
+	idp := http.NewServeMux()
+	idp.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	idp.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": "test-key",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	idp.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != clientID {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		s.challenge = q.Get("code_challenge")
+		s.nonce = q.Get("nonce")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=test-code&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	idp.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "test-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != s.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, &oidcIDTokenClaims{
+			Email:         "oidc-user@example.com",
+			EmailVerified: true,
+			Nonce:         s.nonce,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    s.URL,
+				Subject:   "subject-1",
+				Audience:  jwt.ClaimStrings{clientID},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		})
+		idToken.Header["kid"] = "test-key"
+		signed, err := idToken.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+	})
+
+	s.Server = httptest.NewServer(idp)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	idp := newTestOIDCServer(t, "device-shop")
+	provider := &OIDCProvider{
+		Name:         "test-idp",
+		Issuer:       idp.URL,
+		ClientID:     "device-shop",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8080/login/oidc/test-idp/callback",
+	}
+	registerOIDCProvider(provider)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login/oidc/{provider}", oidcLoginHandler).Methods("GET")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/login/oidc/test-idp", nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Expected redirect to provider, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Follow the redirect to the stand-in provider, which answers with the callback URL.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := callback.Query().Get("state")
+	oidcPendingLogins.Lock()
+	pending, ok := oidcPendingLogins.logins[state]
+	oidcPendingLogins.Unlock()
+	if !ok {
+		t.Fatalf("No pending login recorded for state %q", state)
+	}
+
+	rawIDToken, err := provider.exchangeCode(callback.Query().Get("code"), pending.Verifier)
+	if err != nil {
+		t.Fatalf("Code exchange failed: %v", err)
+	}
+	if _, err := provider.exchangeCode(callback.Query().Get("code"), "wrong-verifier"); err == nil {
+		t.Error("Expected code exchange with the wrong PKCE verifier to fail")
+	}
+
+	claims, err := provider.verifyIDToken(rawIDToken, pending.Nonce)
+	if err != nil {
+		t.Fatalf("ID token verification failed: %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "oidc-user@example.com" || !claims.EmailVerified {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+	if _, err := provider.verifyIDToken(rawIDToken, "other-nonce"); err == nil {
+		t.Error("Expected ID token with a different nonce to be rejected")
+	}
+}
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, ok := parseAPIKey(key)
+	if !ok || parsed != prefix {
+		t.Errorf("Expected key %q to parse to prefix %q, got %q (ok=%v)", key, prefix, parsed, ok)
+	}
+	if hashAPIKey(key) == hashAPIKey(key+"x") {
+		t.Error("Expected different keys to hash differently")
+	}
+	for _, bad := range []string{"", "dk_short_secret", "xx_0123abcd_secret", "dk_0123abcd_"} {
+		if _, ok := parseAPIKey(bad); ok {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/user", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	if got := apiKeyFromRequest(req); got != key {
+		t.Errorf("Expected API key from Authorization header, got %q", got)
+	}
+}
+
+func TestRequirePermissionUsesCache(t *testing.T) {
+	const userID = 424242
+	permissionCache.Lock()
+	permissionCache.entries[userID] = cachedPermissions{
+		permissions: map[string]bool{PermDeviceWrite: true},
+		expires:     time.Now().Add(time.Minute),
+	}
+	permissionCache.Unlock()
+	defer invalidateUserPermissions(userID)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		UserID:           userID,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	for permission, want := range map[string]int{PermDeviceWrite: http.StatusOK, PermRoleManage: http.StatusForbidden} {
+		req := httptest.NewRequest("POST", "/device", nil)
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		rr := httptest.NewRecorder()
+		RequirePermission(permission)(ok)(rr, req)
+		if rr.Code != want {
+			t.Errorf("Permission %s: expected %d, got %d", permission, want, rr.Code)
+		}
+	}
+
+	// An API key is limited to its scopes even when the owner holds more.
+	req := httptest.NewRequest("POST", "/device", nil)
+	req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey, &apiKeyIdentity{UserID: userID}))
+	rr := httptest.NewRecorder()
+	RequirePermission(PermDeviceWrite)(ok)(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected unscoped API key to be forbidden, got %d", rr.Code)
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	handler := csrfMiddleware(methodOverrideMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(csrfToken(r)))
+	})))
+
+	// A first visit issues the token cookie and exposes the token to templates.
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly %s cookie, got %+v", csrfCookieName, cookies)
+	}
+	token := cookies[0].Value
+	if rr.Body.String() != token {
+		t.Errorf("Expected token %q in request context, got %q", token, rr.Body.String())
+	}
+
+	post := func(form url.Values) int {
+		req := httptest.NewRequest("POST", "/device/1", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: token})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := post(url.Values{"_method": {"delete"}}); code != http.StatusForbidden {
+		t.Errorf("Expected overridden DELETE without token to be rejected, got %d", code)
+	}
+	if code := post(url.Values{"_method": {"delete"}, csrfFieldName: {"wrong"}}); code != http.StatusForbidden {
+		t.Errorf("Expected wrong token to be rejected, got %d", code)
+	}
+	if code := post(url.Values{"_method": {"delete"}, csrfFieldName: {token}}); code != http.StatusOK {
+		t.Errorf("Expected matching token to be accepted, got %d", code)
+	}
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	config := defaultSecurityHeadersConfig()
+	config.HSTSMaxAge = 3600
+
+	var nonce string
+	handler := securityHeadersMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = pageSecurity(r).CSPNonce
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if nonce == "" {
+		t.Fatal("Expected a CSP nonce in the page security data")
+	}
+	csp := rr.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "style-src 'self' 'nonce-"+nonce+"'") || !strings.Contains(csp, "report-uri "+cspReportPath) {
+		t.Errorf("Unexpected Content-Security-Policy: %q", csp)
+	}
+	expected := map[string]string{
+		"Strict-Transport-Security": "max-age=3600",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           config.ReferrerPolicy,
+		"Permissions-Policy":        config.PermissionsPolicy,
+	}
+	for name, value := range expected {
+		if got := rr.Header().Get(name); got != value {
+			t.Errorf("Expected %s %q, got %q", name, value, got)
+		}
+	}
+
+	config.CSPReportOnly = true
+	rr = httptest.NewRecorder()
+	securityHeadersMiddleware(config)(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Header().Get("Content-Security-Policy-Report-Only") == "" || rr.Header().Get("Content-Security-Policy") != "" {
+		t.Error("Expected the policy to be sent in report-only mode")
+	}
+}
+
+func TestRateLimiterPerClient(t *testing.T) {
+	limiter, err := loadRateLimiter("does-not-exist.json", newMemoryRateLimitStore(100, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.Routes["/limited"] = RateLimitPolicy{Requests: 1, Period: "1m", Burst: 2, By: "ip", period: time.Minute}
+
+	router := mux.NewRouter()
+	router.Use(limiter.Middleware)
+	router.HandleFunc("/limited", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/limited", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := get("10.0.0.1:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i+1, rr.Code)
+		}
+	}
+	rr := get("10.0.0.1:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 after the burst, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "60" || rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected rate limit headers: %v", rr.Header())
+	}
+
+	// Another client has its own bucket.
+	if rr := get("10.0.0.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("Expected a different client to be allowed, got %d", rr.Code)
+	}
+}
+
+func TestMemoryRateLimitStoreEviction(t *testing.T) {
+	store := newMemoryRateLimitStore(2, time.Minute)
+	policy := RateLimitPolicy{Requests: 1, Period: "1h", Burst: 1}
+	if err := policy.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	store.Take("a", policy, now)
+	store.Take("b", policy, now)
+	store.Take("a", policy, now)
+	store.Take("c", policy, now) // evicts "b", the least recently used
+	if store.Len() != 2 {
+		t.Fatalf("Expected 2 buckets, got %d", store.Len())
+	}
+	if result, _ := store.Take("a", policy, now); result.Allowed {
+		t.Error("Expected bucket a to be kept and exhausted")
+	}
+	if result, _ := store.Take("b", policy, now); !result.Allowed {
+		t.Error("Expected bucket b to have been evicted")
+	}
+
+	store.Take("d", policy, now.Add(2*time.Minute))
+	if store.Len() != 1 {
+		t.Errorf("Expected idle buckets to be dropped, got %d", store.Len())
+	}
+}
+
+func TestCreateDeviceValidationErrorsAsJSON(t *testing.T) {
+	req := httptest.NewRequest("POST", "/device", strings.NewReader(`{"type1": "Phone", "brand": "", "model": "X"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	createDeviceHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", rr.Code)
+	}
+	var response ValidationResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Errors["brand"] == "" || len(response.Errors) != 1 {
+		t.Errorf("Expected only a brand error, got %v", response.Errors)
+	}
+}
+
+func TestBreachedPasswordList(t *testing.T) {
+	hash := func(password string) string {
+		sum := sha1.Sum([]byte(password))
+		return strings.ToUpper(hex.EncodeToString(sum[:]))
+	}
+
+	dir := t.TempDir()
+	corpus := filepath.Join(dir, "corpus.txt")
+	if err := os.WriteFile(corpus, []byte(hash("Password1")+":1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ranges := filepath.Join(dir, "ranges")
+	os.Mkdir(ranges, 0700)
+	breached := hash("Qwerty123")
+	if err := os.WriteFile(filepath.Join(ranges, breached[:5]+".txt"), []byte(breached[5:]+":42\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{corpus, ranges} {
+		list, err := loadBreachedPasswords(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		breachedPasswords = list
+		for password, want := range map[string]bool{
+			"Password1":           path == corpus,
+			"Qwerty123":           path == ranges,
+			"unlisted-Passw0rd!x": false,
+		} {
+			message := newPasswordRule("someone")(password)
+			if (message != "") != want {
+				t.Errorf("%s: password %q: expected breached=%v, got %q", path, password, want, message)
+			}
+		}
+	}
+	breachedPasswords = nil
+}
+
+func TestPasswordHashUpgrade(t *testing.T) {
+	saved := passwordHashing
+	defer func() { passwordHashing = saved }()
+
+	passwordHashing = PasswordHashConfig{Algorithm: hashAlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+	legacy, err := hashPassword("s3cret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, rehash, err := verifyPassword(string(legacy), "s3cret-pass"); !ok || rehash || err != nil {
+		t.Fatalf("Expected a current bcrypt hash to verify, got ok=%v rehash=%v err=%v", ok, rehash, err)
+	}
+
+	passwordHashing = PasswordHashConfig{Algorithm: hashAlgorithmArgon2id, Argon2Time: 1, Argon2Memory: 8 * 1024, Argon2Threads: 1}
+	if ok, rehash, _ := verifyPassword(string(legacy), "s3cret-pass"); !ok || !rehash {
+		t.Errorf("Expected the bcrypt hash to need a rehash after switching to argon2id, got ok=%v rehash=%v", ok, rehash)
+	}
+
+	upgraded, err := hashPassword("s3cret-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(upgraded), "$argon2id$v=19$m=8192,t=1,p=1$") {
+		t.Errorf("Unexpected argon2id hash format: %s", upgraded)
+	}
+	if ok, rehash, err := verifyPassword(string(upgraded), "s3cret-pass"); !ok || rehash || err != nil {
+		t.Errorf("Expected the argon2id hash to verify, got ok=%v rehash=%v err=%v", ok, rehash, err)
+	}
+	if ok, _, _ := verifyPassword(string(upgraded), "wrong-pass"); ok {
+		t.Error("Expected a wrong password to be rejected")
+	}
+
+	passwordHashing.Argon2Time = 2
+	if _, rehash, _ := verifyPassword(string(upgraded), "s3cret-pass"); !rehash {
+		t.Error("Expected changed argon2id parameters to require a rehash")
+	}
+	if algorithm, params := describePasswordHash(string(legacy)); algorithm != hashAlgorithmBcrypt || params != fmt.Sprintf("cost=%d", bcrypt.MinCost) {
+		t.Errorf("Unexpected description of bcrypt hash: %s %s", algorithm, params)
+	}
+}
+
+func TestUserLogEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "application.log")
+	lines := strings.Join([]string{
+		`{"event":"data_export","level":"info","msg":"Personal data exported","user_id":"7"}`,
+		`{"event":"account_erased","level":"info","msg":"Account erased","user_id":17}`,
+		`{"event":"account_lockout","failures":5,"key":"alice","kind":"username","level":"warning","locked_until":"2024-01-01T00:15:00Z","msg":"Login locked after repeated failures"}`,
+		`{"event":"account_lockout","failures":5,"key":"alice","kind":"ip","level":"warning","locked_until":"2024-01-01T00:15:00Z","msg":"Login locked after repeated failures"}`,
+		`not json`,
+	}, "\n")
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := userLogEntries(path, "7", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0]["event"] != "data_export" || entries[1]["kind"] != "username" {
+		t.Errorf("Unexpected log entries: %v", entries)
+	}
+
+	if entries, err := userLogEntries(filepath.Join(t.TempDir(), "missing.log"), "7", ""); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries for a missing log, got %v, %v", entries, err)
+	}
+}
+
+func TestMemoryMailerCapturesConfirmationEmail(t *testing.T) {
+	saved := mailer
+	defer func() { mailer = saved }()
+	captured := &MemoryMailer{}
+	mailer = captured
+	useEmailTemplates(t)
+
+	msg, err := confirmationEmail("new@example.com", "abc123", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := captured.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	msg = &messages[0]
+	if len(msg.To) != 1 || msg.To[0] != "new@example.com" || msg.Subject != "Confirm your email address" {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+	if !strings.Contains(msg.Text, "/confirm?token=abc123") {
+		t.Errorf("Expected the confirmation link in the body, got %q", msg.Text)
+	}
+}
+
+func TestFileDropMailerWritesEML(t *testing.T) {
+	saved := mailer
+	defer func() { mailer = saved }()
+	dir := t.TempDir()
+	mailer = &FileDropMailer{Dir: dir}
+	useEmailTemplates(t)
+
+	msg, err := receiptEmail("buyer@example.com", "Buyer", []byte("%PDF-1.4 receipt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one .eml file, got %v (%v)", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: buyer@example.com", "Subject: Your Receipt", `filename="receipt.pdf"`, "application/pdf"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected %q in the message:\n%s", want, data)
+		}
+	}
+}
+
+func TestSMTPMailerDeliversToSMTPTestServer(t *testing.T) {
+	saved := mailer
+	defer func() { mailer = saved }()
+	srv, err := smtptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	mailer = &SMTPMailer{Host: srv.Host(), Port: srv.Port()}
+	useEmailTemplates(t)
+
+	confirmation, err := confirmationEmail("new@example.com", "abc123", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := receiptEmail("buyer@example.com", "Buyer", []byte("%PDF-1.4 receipt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []*Message{confirmation, receipt} {
+		if err := mailer.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := srv.WaitForMessages(2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messages[0]; got.To[0] != "new@example.com" || got.Subject != "Confirm your email address" || !strings.Contains(got.Text, "/confirm?token=abc123") {
+		t.Errorf("Unexpected confirmation email: %q to %q: %q", got.Subject, got.To, got.Text)
+	}
+	got := messages[1]
+	if got.To[0] != "buyer@example.com" || len(got.Attachments) != 1 {
+		t.Fatalf("Unexpected receipt email: %q to %q with %d attachments", got.Subject, got.To, len(got.Attachments))
+	}
+	if attachment := got.Attachments[0]; attachment.Filename != "receipt.pdf" || string(attachment.Data) != "%PDF-1.4 receipt" {
+		t.Errorf("Unexpected attachment %q: %q", attachment.Filename, attachment.Data)
+	}
+}
+
+func TestSMTPMailerReportsRejectedRecipient(t *testing.T) {
+	srv, err := smtptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.RejectRecipient("gone@example.com", "550 5.1.1 No such user")
+
+	m := &SMTPMailer{Host: srv.Host(), Port: srv.Port()}
+	err = m.Send(&Message{To: []string{"gone@example.com"}, Subject: "Hello", Text: "Hi"})
+	var rejected *PermanentError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("Expected a PermanentError, got %v", err)
+	}
+	if rejected.Code != 550 || !rejected.HardBounce() || rejected.Recipients[0] != "gone@example.com" {
+		t.Errorf("Unexpected error %+v", rejected)
+	}
+}
+
+func TestPermanentErrorHardBounce(t *testing.T) {
+	tests := []struct {
+		code int
+		msg  string
+		want bool
+	}{
+		{550, "5.1.1 <gone@example.com>: Recipient address rejected", true},
+		{550, "5.2.1 Mailbox disabled", true},
+		{552, "5.2.2 Mailbox full", false},
+		{550, "5.7.1 Message rejected as spam", false},
+		{550, "No such user here", true},
+		{553, "Mailbox name not allowed", true},
+		{554, "Transaction failed", false},
+	}
+	for _, tt := range tests {
+		err := &PermanentError{Code: tt.code, Msg: tt.msg}
+		if got := err.HardBounce(); got != tt.want {
+			t.Errorf("HardBounce(%d %s) = %v, want %v", tt.code, tt.msg, got, tt.want)
+		}
+	}
+}
+
+const deliveryStatusNotification = "From: MAILER-DAEMON@example.com\r\n" +
+	"To: shop@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=b1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.com\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; gone@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; full@example.com\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.2.2\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; ok@example.com\r\n" +
+	"Action: delivered\r\n" +
+	"Status: 2.0.0\r\n" +
+	"--b1--\r\n"
+
+const abuseReport = "From: fbl@example.net\r\n" +
+	"Subject: Abuse report\r\n" +
+	"Content-Type: multipart/report; report-type=feedback-report; boundary=b2\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"This is an email abuse report.\r\n" +
+	"--b2\r\n" +
+	"Content-Type: message/feedback-report\r\n" +
+	"\r\n" +
+	"Feedback-Type: abuse\r\n" +
+	"User-Agent: ExampleFBL/1.0\r\n" +
+	"Version: 1\r\n" +
+	"Original-Rcpt-To: annoyed@example.com\r\n" +
+	"--b2--\r\n"
+
+func TestParseBounceMessage(t *testing.T) {
+	reports, err := parseBounceMessage([]byte(deliveryStatusNotification))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 reports, got %+v", reports)
+	}
+	if r := reports[0]; r.Email != "gone@example.com" || r.Type != "bounce" || !r.Permanent || !strings.Contains(r.Detail, "User unknown") {
+		t.Errorf("Unexpected report %+v", r)
+	}
+	if r := reports[1]; r.Email != "full@example.com" || r.Permanent {
+		t.Errorf("Expected a temporary bounce, got %+v", r)
+	}
+
+	reports, err = parseBounceMessage([]byte(abuseReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Email != "annoyed@example.com" || reports[0].Type != "complaint" {
+		t.Errorf("Unexpected reports %+v", reports)
+	}
+
+	if _, err := parseBounceMessage([]byte("Subject: Hello\r\n\r\nJust a message\r\n")); err == nil {
+		t.Error("Expected an error for a message that is not a report")
+	}
+}
+
+func TestFileBounceSource(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"dsn.eml":      deliveryStatusNotification,
+		"webhook.json": `[{"email": "spam@example.com", "type": "complaint"}]`,
+		"broken.json":  `{"email": "nobody", "type": "bounce"}`,
+		"notes.txt":    "ignored",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source := &FileBounceSource{Dir: dir}
+	reports, err := source.Fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emails []string
+	for _, r := range reports {
+		emails = append(emails, r.Email)
+	}
+	if fmt.Sprint(emails) != "[gone@example.com full@example.com spam@example.com]" {
+		t.Errorf("Unexpected reports for %v", emails)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed", "broken.json")); err != nil {
+		t.Errorf("Expected the invalid report to move to failed/: %v", err)
+	}
+
+	if err := source.Done(reports); err != nil {
+		t.Fatal(err)
+	}
+	reports, err = source.Fetch()
+	if err != nil || len(reports) != 0 {
+		t.Errorf("Expected no reports after Done, got %+v (%v)", reports, err)
+	}
+	for _, name := range []string{"dsn.eml", "webhook.json"} {
+		if _, err := os.Stat(filepath.Join(dir, "processed", name)); err != nil {
+			t.Errorf("Expected %s in processed/: %v", name, err)
+		}
+	}
+}
+
+func TestOrderStatusNotification(t *testing.T) {
+	for _, status := range orderStatuses {
+		title, body := orderStatusNotification(42, status)
+		if title != "Order #42: "+status || !strings.Contains(body, "#42") {
+			t.Errorf("Unexpected notification for %s: %q %q", status, title, body)
+		}
+	}
+	if _, body := orderStatusNotification(7, "on-hold"); body != "Order #7 is now on-hold." {
+		t.Errorf("Unexpected fallback body %q", body)
+	}
+	if validOrderStatus("on-hold") || !validOrderStatus("shipped") {
+		t.Error("validOrderStatus does not match orderStatuses")
+	}
+}
+
+func TestUsersWithDeviceInCart(t *testing.T) {
+	cartStorage.Lock()
+	saved := cartStorage.carts
+	cartStorage.carts = map[string][]Device{
+		"1": {{ID: 5}, {ID: 9}},
+		"2": {{ID: 9}, {ID: 9}},
+		"3": {{ID: 4}},
+	}
+	cartStorage.Unlock()
+	defer func() {
+		cartStorage.Lock()
+		cartStorage.carts = saved
+		cartStorage.Unlock()
+	}()
+
+	users := usersWithDeviceInCart(9)
+	sort.Ints(users)
+	if fmt.Sprint(users) != "[1 2]" {
+		t.Errorf("usersWithDeviceInCart(9) = %v, want [1 2]", users)
+	}
+	if users := usersWithDeviceInCart(100); len(users) != 0 {
+		t.Errorf("Expected no users, got %v", users)
+	}
+}
+
+type recordingExecer struct {
+	query string
+	args  []interface{}
+}
+
+func (e *recordingExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	e.query, e.args = query, args
+	return insertResult(1), nil
+}
+
+type insertResult int64
+
+func (r insertResult) LastInsertId() (int64, error) { return int64(r), nil }
+func (r insertResult) RowsAffected() (int64, error) { return 1, nil }
+
+func TestEnqueueEmailStoresDeliverablePayload(t *testing.T) {
+	useEmailTemplates(t)
+	exec := &recordingExecer{}
+	receipt, err := receiptEmail("buyer@example.com", "Buyer", []byte("%PDF-1.4 receipt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueueEmail(exec, receipt); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(exec.query, "INSERT INTO email_outbox") || len(exec.args) != 4 {
+		t.Fatalf("Unexpected insert: %s %v", exec.query, exec.args)
+	}
+	if exec.args[0] != "buyer@example.com" || exec.args[1] != "Your Receipt" || exec.args[3] != outboxPending {
+		t.Errorf("Unexpected columns: %v", exec.args)
+	}
+
+	var msg Message
+	if err := json.Unmarshal(exec.args[2].([]byte), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Attachments) != 1 || string(msg.Attachments[0].Data) != "%PDF-1.4 receipt" {
+		t.Errorf("Attachment did not survive the round trip: %+v", msg.Attachments)
+	}
+
+	if err := enqueueEmail(exec, &Message{Subject: "No one"}); err == nil {
+		t.Error("Expected an error for a message without recipients")
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		0:  0,
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		20: outboxMaxBackoff,
+	}
+	for attempts, want := range cases {
+		if got := outboxBackoff(attempts); got != want {
+			t.Errorf("outboxBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+	if outboxBackoff(outboxMaxAttempts-1) >= outboxMaxBackoff {
+		t.Error("Expected retries to stay under the cap before dead-lettering")
+	}
+}
+
+func useEmailTemplates(t *testing.T) {
+	t.Helper()
+	saved := emailTemplates
+	t.Cleanup(func() { emailTemplates = saved })
+	registry, err := loadEmailTemplates(emailTemplatesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailTemplates = registry
+}
+
+func TestEmailTemplatesRenderWithLocaleFallback(t *testing.T) {
+	useEmailTemplates(t)
+
+	for _, name := range emailTemplates.Names() {
+		for _, locale := range emailTemplates.Locales(name) {
+			tmpl, err := emailTemplates.Lookup(name, []string{locale})
+			if err != nil {
+				t.Fatal(err)
+			}
+			subject, htmlBody, textBody, err := tmpl.Render(emailTemplates.samples[name])
+			if err != nil || subject == "" || htmlBody == "" || textBody == "" {
+				t.Errorf("%s/%s: subject %q, %d bytes HTML, %d bytes text, err %v", name, locale, subject, len(htmlBody), len(textBody), err)
+			}
+		}
+	}
+
+	cases := []struct {
+		locales []string
+		want    string
+	}{
+		{[]string{"ru-RU", "en"}, "ru"},
+		{[]string{"de", "ru"}, "ru"},
+		{[]string{"de-AT"}, "en"},
+		{nil, "en"},
+	}
+	for _, c := range cases {
+		tmpl, err := emailTemplates.Lookup("confirm_email", c.locales)
+		if err != nil || tmpl.Locale != c.want {
+			t.Errorf("Lookup(%v) = %v, %v; want locale %s", c.locales, tmpl, err, c.want)
+		}
+	}
+
+	if _, err := emailTemplates.Lookup("no_such_template", nil); err == nil {
+		t.Error("Expected an error for an unknown template")
+	}
+}
+
+func TestCampaignEmailTracksLinksAndEscapesHTML(t *testing.T) {
+	useEmailTemplates(t)
+
+	body := "Hello <b>friends</b>,\r\n\r\nSee https://shop.example.com/sale?a=1&b=2.\nThanks"
+	msg, err := campaignEmail(7, "user@example.com", "abc123", "Spring sale", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "Spring sale" {
+		t.Errorf("Unexpected subject %q", msg.Subject)
+	}
+
+	click := "http://localhost:8080/c/c/abc123?u=" + url.QueryEscape("https://shop.example.com/sale?a=1&b=2")
+	for _, want := range []string{
+		"<p>Hello &lt;b&gt;friends&lt;/b&gt;,</p>",
+		`<a href="` + strings.ReplaceAll(click, "&", "&amp;") + `">https://shop.example.com/sale?a=1&amp;b=2</a>.<br>`,
+		`<img src="http://localhost:8080/c/o/abc123.gif"`,
+	} {
+		if !strings.Contains(msg.HTML, want) {
+			t.Errorf("Expected %q in the HTML part:\n%s", want, msg.HTML)
+		}
+	}
+	if !strings.Contains(msg.Text, "See "+click+".\nThanks") {
+		t.Errorf("Expected the tracked link in the text part:\n%s", msg.Text)
+	}
+
+	if msg.Headers["List-Unsubscribe"] != "<"+unsubscribeURL(7, emailMarketing)+">" || msg.Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Errorf("Expected one-click unsubscribe headers, got %v", msg.Headers)
+	}
+	if !strings.Contains(msg.Text, "Unsubscribe: "+unsubscribeURL(7, emailMarketing)) {
+		t.Errorf("Expected the unsubscribe link in the text part:\n%s", msg.Text)
+	}
+
+	if links := campaignLinks(body); len(links) != 1 || links[0] != "https://shop.example.com/sale?a=1&b=2" {
+		t.Errorf("campaignLinks() = %v", links)
+	}
+}
+
+func TestCampaignSegmentAudienceQuery(t *testing.T) {
+	segment := CampaignSegment{
+		RoleIDs:      []int{2, 5},
+		Confirmation: "confirmed",
+		Purchases:    "buyers",
+		Brands:       []string{"Apple"},
+	}
+	query, args := segment.audienceQuery()
+	for _, want := range []string{
+		"u.disabled = 0",
+		"p.marketing = 0",
+		"email_suppressions s WHERE s.email = u.email",
+		"u.confirmed = 1",
+		"role_id IN (?, ?)",
+		"EXISTS (SELECT 1 FROM transactions1",
+		"brand IN (?)",
+	} {
+		if !strings.Contains(query, want) {
+			t.Errorf("Expected %q in %s", want, query)
+		}
+	}
+	if fmt.Sprint(args) != "[2 5 Apple]" {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	query, args = CampaignSegment{}.audienceQuery()
+	if strings.Contains(query, "u.confirmed") || len(args) != 0 {
+		t.Errorf("Expected an unrestricted query, got %s %v", query, args)
+	}
+
+	want := "confirmed accounts with role user or #5 who have ordered interested in Apple"
+	if got := segment.Describe(map[int]string{2: "user"}); got != want {
+		t.Errorf("Describe() = %q, want %q", got, want)
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	in := `<html><head><style>p { color: red; }</style></head><body>
+		<h2>Hello &amp; welcome</h2>
+		<p>First   line<br>second line</p>
+		<ul><li>One</li><li>Two</li></ul>
+		<p><a href="http://localhost:8080/confirm?token=a&amp;b=1">Confirm</a>
+		or <a href="http://localhost:8080/x">http://localhost:8080/x</a></p>
+	</body></html>`
+	want := "Hello & welcome\n\nFirst line\nsecond line\n\n- One\n- Two\n\nConfirm (http://localhost:8080/confirm?token=a&b=1) or http://localhost:8080/x"
+	if got := htmlToText(in); got != want {
+		t.Errorf("htmlToText() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestRequestLocales(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Language", "en;q=0.5, ru-RU, de;q=0, kk;q=0.8")
+	got := strings.Join(requestLocales(req), ",")
+	if got != "ru-ru,kk,en" {
+		t.Errorf("requestLocales() = %s, want ru-ru,kk,en", got)
+	}
+}
+
+func TestUnsubscribeLinkSignature(t *testing.T) {
+	link, err := url.Parse(unsubscribeURL(42, emailProductAlerts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := link.Query()
+	if link.Path != unsubscribePath || query.Get("u") != "42" || query.Get("c") != emailProductAlerts {
+		t.Fatalf("Unexpected unsubscribe link %s", link)
+	}
+
+	// Signature checks happen before any database access.
+	for name, tamper := range map[string]func(url.Values){
+		"other user":     func(q url.Values) { q.Set("u", "43") },
+		"other category": func(q url.Values) { q.Set("c", emailMarketing) },
+		"transactional mail": func(q url.Values) {
+			q.Set("c", emailTransactional)
+			q.Set("s", unsubscribeSignature("42", emailTransactional))
+		},
+		"missing signature": func(q url.Values) { q.Del("s") },
+	} {
+		q := link.Query()
+		tamper(q)
+		req := httptest.NewRequest("POST", unsubscribePath+"?"+q.Encode(), strings.NewReader("List-Unsubscribe=One-Click"))
+		rec := httptest.NewRecorder()
+		unsubscribeHandler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", link.RequestURI(), nil)
+	rec := httptest.NewRecorder()
+	unsubscribeHandler(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Stop receiving product alerts") {
+		t.Errorf("Expected the confirmation page, got %d:\n%s", rec.Code, rec.Body.String())
+	}
+}
+
+func receiveEvent(t *testing.T, sub Subscription) Event {
+	t.Helper()
+	select {
+	case event, ok := <-sub.Events():
+		if !ok {
+			t.Fatal("Subscription closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("No event received")
+	}
+	return Event{}
+}
+
+func TestEventHubPublishAndReplay(t *testing.T) {
+	hub := newEventHub()
+	sub, err := hub.Subscribe("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := hub.Subscribe("2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.Publish("1", eventCart, []Device{{ID: 7}})
+	hub.Broadcast(eventNotification, Notification{Title: "Sale"})
+	first := receiveEvent(t, sub)
+	if first.Type != eventCart || string(first.Data) != `[{"id":7,"type1":"","brand":"","model":""}]` {
+		t.Errorf("Unexpected event %s %s", first.Type, first.Data)
+	}
+	if event := receiveEvent(t, sub); event.Type != eventNotification {
+		t.Errorf("Expected the broadcast, got %s", event.Type)
+	}
+	if event := receiveEvent(t, other); event.Type != eventNotification {
+		t.Errorf("Other user: expected only the broadcast, got %s", event.Type)
+	}
+	sub.Close()
+
+	// A reconnecting client gets what it missed, in order.
+	hub.Publish("1", eventNotification, Notification{Title: "Shipped"})
+	hub.Publish("2", eventNotification, Notification{Title: "Not yours"})
+	resumed, err := hub.Subscribe("1", first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	for _, want := range []string{"Sale", "Shipped"} {
+		var n Notification
+		json.Unmarshal(receiveEvent(t, resumed).Data, &n)
+		if n.Title != want {
+			t.Errorf("Replayed %q, want %q", n.Title, want)
+		}
+	}
+	select {
+	case event := <-resumed.Events():
+		t.Errorf("Unexpected extra event %s", event.Data)
+	default:
+	}
+}
+
+func TestEventHubResync(t *testing.T) {
+	hub := newEventHub()
+	hub.replayLimit = 2
+	sub, _ := hub.Subscribe("1", "")
+	hub.Publish("1", eventCart, nil)
+	seen := receiveEvent(t, sub).ID
+	sub.Close()
+	for i := 0; i < 3; i++ {
+		hub.Publish("1", eventCart, nil)
+	}
+
+	for name, lastEventID := range map[string]string{
+		"events dropped": seen,
+		"before restart": "0-1",
+		"malformed":      "garbage",
+	} {
+		sub, err := hub.Subscribe("1", lastEventID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event := receiveEvent(t, sub); event.Type != eventResync {
+			t.Errorf("%s: expected a resync, got %s", name, event.Type)
+		}
+		sub.Close()
+	}
+}
+
+func TestEventHubLimits(t *testing.T) {
+	hub := newEventHub()
+	hub.maxPerUser = 2
+	for i := 0; i < 2; i++ {
+		if _, err := hub.Subscribe("1", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hub.Subscribe("1", ""); !errors.Is(err, errTooManyStreams) {
+		t.Errorf("Expected errTooManyStreams, got %v", err)
+	}
+	if _, err := hub.Subscribe("2", ""); err != nil {
+		t.Errorf("Another user was refused: %v", err)
+	}
+
+	// A subscriber that stops reading is disconnected instead of blocking
+	// publishers.
+	slow, err := hub.Subscribe("3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= subscriberQueueSize; i++ {
+		hub.Publish("3", eventCart, nil)
+	}
+	for range slow.Events() {
+	}
+	slow.Close()
+	if hub.streams != 3 {
+		t.Errorf("Expected 3 open streams, got %d", hub.streams)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	previous := broker
+	hub := newEventHub()
+	broker = hub
+	defer func() { broker = previous }()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		UserID:           5,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	publishEvent(5, eventNotification, Notification{Title: "Hello\nthere"})
+	want := "retry: 5000\n\nid: " + hub.eventID(1) + "\nevent: notification\n" +
+		`data: {"id":0,"type":"","title":"Hello\nthere","body":"","read":false,"created_at":""}` + "\n\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Unexpected stream:\n%s", got)
+	}
+
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Anonymous stream: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestWriteEventSplitsLines(t *testing.T) {
+	var b strings.Builder
+	writeEvent(&b, Event{Type: eventCart, Data: []byte("a\nb")})
+	if b.String() != "event: cart\ndata: a\ndata: b\n\n" {
+		t.Errorf("Unexpected event text %q", b.String())
+	}
+}
+
+// allowLoopbackWebhooks lets sendWebhook reach httptest servers.
+func allowLoopbackWebhooks(t *testing.T) {
+	webhookAllowPrivate = true
+	t.Cleanup(func() { webhookAllowPrivate = false })
+}
+
+func TestSendWebhookSignsPayload(t *testing.T) {
+	allowLoopbackWebhooks(t)
+	body := []byte(`{"id":"abc","event":"device.created","data":{"id":7}}`)
+	var received *http.Request
+	var receivedBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	code, err := sendWebhook(server.URL, "s3cret", 42, webhookDeviceCreated, body)
+	if err != nil || code != http.StatusNoContent {
+		t.Fatalf("sendWebhook = %d, %v", code, err)
+	}
+	if string(receivedBody) != string(body) {
+		t.Errorf("Unexpected body %s", receivedBody)
+	}
+	if received.Header.Get("X-Webhook-Event") != webhookDeviceCreated || received.Header.Get("X-Webhook-Delivery") != "42" {
+		t.Errorf("Unexpected headers %v", received.Header)
+	}
+
+	// Receivers verify the signature with the shared secret.
+	var timestamp int64
+	var signature string
+	for _, part := range strings.Split(received.Header.Get("X-Webhook-Signature"), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			fmt.Sscan(value, &timestamp)
+		case "v1":
+			signature = value
+		}
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	fmt.Fprintf(mac, "%d.%s", timestamp, receivedBody)
+	if want := hex.EncodeToString(mac.Sum(nil)); signature != want || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+		t.Errorf("Signature header %q does not verify", received.Header.Get("X-Webhook-Signature"))
+	}
+}
+
+func TestSendWebhookFailures(t *testing.T) {
+	allowLoopbackWebhooks(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "ERP is down", http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	code, err := sendWebhook(failing.URL, "s", 1, webhookTest, []byte("{}"))
+	if code != http.StatusBadGateway || err == nil {
+		t.Errorf("Failing endpoint: got %d, %v", code, err)
+	} else if strings.Contains(err.Error(), "ERP is down") {
+		t.Errorf("Response body kept in error: %v", err)
+	}
+
+	redirecting := httptest.NewServer(http.RedirectHandler(failing.URL, http.StatusFound))
+	defer redirecting.Close()
+	if code, err := sendWebhook(redirecting.URL, "s", 1, webhookTest, []byte("{}")); code != http.StatusFound || err == nil {
+		t.Errorf("Redirect was followed: got %d, %v", code, err)
+	}
+}
+
+func TestSendWebhookRefusesPrivateAddresses(t *testing.T) {
+	reached := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+
+	// localhost passes a hostname check; the dialer sees the loopback address.
+	endpoint := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	for _, u := range []string{server.URL, endpoint} {
+		if code, err := sendWebhook(u, "s", 1, webhookTest, []byte("{}")); code != 0 || err == nil {
+			t.Errorf("%s: got %d, %v", u, code, err)
+		}
+	}
+	if reached {
+		t.Error("Request reached a loopback server")
+	}
+
+	for address, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if got := publicIP(net.ParseIP(address)); got != want {
+			t.Errorf("publicIP(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestWebhookInput(t *testing.T) {
+	input := func(form url.Values) (string, []string, validation.Errors) {
+		req := httptest.NewRequest("POST", "/admin/webhooks", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return webhookInput(req, true)
+	}
+
+	endpoint, events, errs := input(url.Values{
+		"url":   {" https://erp.example.com/hooks "},
+		"event": {webhookOrderStatus, webhookDeviceCreated},
+	})
+	if errs.Any() || endpoint != "https://erp.example.com/hooks" {
+		t.Fatalf("Valid input rejected: %v", errs)
+	}
+	if strings.Join(events, ",") != webhookDeviceCreated+","+webhookOrderStatus {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	for name, form := range map[string]url.Values{
+		"no events":     {"url": {"https://erp.example.com"}},
+		"unknown event": {"url": {"https://erp.example.com"}, "event": {"user.deleted"}},
+		"bad scheme":    {"url": {"file:///etc/passwd"}, "event": {webhookDeviceCreated}},
+		"no host":       {"url": {"https://"}, "event": {webhookDeviceCreated}},
+		"loopback":      {"url": {"http://127.0.0.1:8080/hook"}, "event": {webhookDeviceCreated}},
+		"localhost":     {"url": {"http://localhost/hook"}, "event": {webhookDeviceCreated}},
+		"metadata":      {"url": {"http://169.254.169.254/latest"}, "event": {webhookDeviceCreated}},
+		"private":       {"url": {"https://10.0.0.5/hook"}, "event": {webhookDeviceCreated}},
+		"ipv6 loopback": {"url": {"http://[::1]/hook"}, "event": {webhookDeviceCreated}},
+	} {
+		if _, _, errs := input(form); !errs.Any() {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestRateLimitKeyIgnoresUnverifiedAPIKeys(t *testing.T) {
+	policy := RateLimitPolicy{By: "client"}
+	request := func(key string) *http.Request {
+		req := httptest.NewRequest("GET", "/api", nil)
+		req.RemoteAddr = "10.0.0.9:1234"
+		req.Header.Set("Authorization", "Bearer "+key)
+		return req
+	}
+
+	// Fresh, well-formed keys that never authenticated share the IP bucket.
+	for i := 0; i < 3; i++ {
+		key, _, err := generateAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rateLimitKey(request(key), policy); got != "ip:10.0.0.9" {
+			t.Errorf("Unverified key limited as %q", got)
+		}
+	}
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rememberVerifiedAPIKey(key, prefix)
+	if got := rateLimitKey(request(key), policy); got != "key:"+prefix {
+		t.Errorf("Verified key limited as %q", got)
+	}
+	// Another secret with the same prefix is not the verified key.
+	if got := rateLimitKey(request(apiKeyPrefix+prefix+"_forged"), policy); got != "ip:10.0.0.9" {
+		t.Errorf("Forged key with a verified prefix limited as %q", got)
+	}
+}
+
+func TestCheckRoleDelegable(t *testing.T) {
+	const userID = 987654
+	permissionCache.Lock()
+	permissionCache.entries[userID] = cachedPermissions{
+		permissions: map[string]bool{PermUserManage: true, PermAdminAccess: true},
+		expires:     time.Now().Add(time.Minute),
+	}
+	permissionCache.Unlock()
+	defer invalidateUserPermissions(userID)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		UserID:           userID,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/admin/users/1/roles", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+	if err := checkRoleDelegable(req, []string{PermAdminAccess}); err != nil {
+		t.Errorf("Role within the user's own permissions refused: %v", err)
+	}
+	if err := checkRoleDelegable(req, nil); err != nil {
+		t.Errorf("Role without permissions refused: %v", err)
+	}
+	var forbidden forbiddenError
+	if err := checkRoleDelegable(req, []string{PermAdminAccess, PermRoleManage}); !errors.As(err, &forbidden) {
+		t.Errorf("Expected a forbiddenError for a role with role:manage, got %v", err)
+	}
+
+	anonymous := httptest.NewRequest("POST", "/admin/users/1/roles", nil)
+	if err := checkRoleDelegable(anonymous, []string{PermAdminAccess}); err == nil {
+		t.Error("Anonymous request allowed to delegate a role")
+	}
+}
+
+// openTestDB connects to the application database, skipping the test when
+// it cannot be reached.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s?timeout=5s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		t.Skip("Database unavailable: ", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createTestUser inserts a confirmed user and removes it when the test ends.
+func createTestUser(t *testing.T, db *sql.DB) (int, string) {
+	t.Helper()
+	suffix, err := generateToken(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "test-" + suffix
+	result, err := db.Exec("INSERT INTO users (username, email, password, token, confirmed) VALUES (?, ?, '', '', 1)", username, username+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM users WHERE id = ?", id) })
+	return int(id), username
+}
+
+func TestAPIKeyOfDisabledUserIsRejected(t *testing.T) {
+	db := openTestDB(t)
+	userID, _ := createTestUser(t, db)
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes) VALUES (?, 'test', ?, ?, '')", userID, prefix, hashAPIKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM api_keys WHERE user_id = ?", userID)
+
+	if _, err := authenticateAPIKey(key); err != nil {
+		t.Fatalf("Key of an active user rejected: %v", err)
+	}
+	if _, err := db.Exec("UPDATE users SET disabled = 1 WHERE id = ?", userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIKey(key); err != errInvalidAPIKey {
+		t.Errorf("Key of a disabled user: expected errInvalidAPIKey, got %v", err)
+	}
+}
+
+func TestUserLogEntriesIncludeLockouts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "application.log")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// Write the lockout the way the application logs it.
+	output, formatter := log.Out, log.Formatter
+	log.SetOutput(file)
+	log.SetFormatter(&logrus.JSONFormatter{})
+	defer func() {
+		log.SetOutput(output)
+		log.SetFormatter(formatter)
+	}()
+	now := time.Now()
+	for i := 0; i < maxLoginFailures; i++ {
+		recordLoginFailure("export-lockout-user", "192.0.2.80", now)
+	}
+	log.SetOutput(output)
+
+	entries, err := userLogEntries(path, "0", "export-lockout-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0]["event"] != "account_lockout" {
+		t.Errorf("Expected the username lockout in the export, got %v", entries)
+	}
+}
+
+func TestLoadMailerRequiresSMTPSettings(t *testing.T) {
+	saved := mailer
+	defer func() { mailer = saved }()
+
+	t.Setenv("MAILER", "smtp")
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_USERNAME", "")
+	t.Setenv("SMTP_PASSWORD", "")
+	err := loadMailer()
+	if err == nil || !strings.Contains(err.Error(), "SMTP_PASSWORD, SMTP_USERNAME") {
+		t.Errorf("Expected missing SMTP settings to be reported, got %v", err)
+	}
+
+	t.Setenv("SMTP_USERNAME", "shop")
+	t.Setenv("SMTP_PASSWORD", "secret")
+	if err := loadMailer(); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := mailer.(*SMTPMailer); !ok || s.Host != "smtp.example.com" || s.Port != 587 {
+		t.Errorf("Unexpected mailer %#v", mailer)
+	}
+}
+
+func TestEraseAccountScrubsOutbox(t *testing.T) {
+	db := openTestDB(t)
+	userID, username := createTestUser(t, db)
+
+	msg := &Message{To: []string{"other@example.com", username + "@example.com"}, Subject: "Your Receipt", Text: "Order for " + username}
+	id, err := enqueueEmailID(db, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM email_outbox WHERE id = ?", id) })
+
+	if err := eraseAccount(db, 0, userID); err != nil {
+		t.Fatal(err)
+	}
+	var recipients, payload, status string
+	if err := db.QueryRow("SELECT recipients, payload, status FROM email_outbox WHERE id = ?", id).Scan(&recipients, &payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if recipients != "" || payload != "" || status != outboxErased {
+		t.Errorf("Outbox row not scrubbed: recipients %q, payload %q, status %q", recipients, payload, status)
+	}
+}
+
+func TestCheckoutRequiresOrderID(t *testing.T) {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		UserID:           7,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cookie bool
+		form   string
+		want   int
+	}{
+		{"signed out", false, "order_id=3", http.StatusSeeOther},
+		{"missing order", true, "name=Buyer", http.StatusBadRequest},
+		{"malformed order", true, "order_id=abc", http.StatusBadRequest},
+		{"negative order", true, "order_id=-1", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		for path, handler := range map[string]http.HandlerFunc{"/payment": paymentHandler, "/process-payment": processPaymentHandler} {
+			method := http.MethodGet
+			if path == "/process-payment" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, path+"?"+tt.form, nil)
+			if tt.cookie {
+				req.AddCookie(&http.Cookie{Name: "token", Value: token})
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s: got status %d, want %d", tt.name, path, rec.Code, tt.want)
+			}
+		}
+	}
+}
+
+func TestPayableOrder(t *testing.T) {
+	db := openTestDB(t)
+	userID, _ := createTestUser(t, db)
+	otherID, _ := createTestUser(t, db)
+
+	orderID, err := insertTransaction(db, strconv.Itoa(userID), "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM transactions1 WHERE id = ?", orderID) })
+
+	check := func(customerID int) int {
+		rec := httptest.NewRecorder()
+		if payableOrder(rec, db, int(orderID), customerID) {
+			return http.StatusOK
+		}
+		return rec.Code
+	}
+	if got := check(userID); got != http.StatusOK {
+		t.Errorf("Own pending order: got %d", got)
+	}
+	if got := check(otherID); got != http.StatusNotFound {
+		t.Errorf("Someone else's order: got %d, want 404", got)
+	}
+	if _, err := db.Exec("UPDATE transactions1 SET status = 'paid' WHERE id = ?", orderID); err != nil {
+		t.Fatal(err)
+	}
+	if got := check(userID); got != http.StatusConflict {
+		t.Errorf("Paid order: got %d, want 409", got)
+	}
+}
+
+func TestOutboxDeliversToSMTPTestServer(t *testing.T) {
+	db := openTestDB(t)
+	saved := mailer
+	defer func() { mailer = saved }()
+	srv, err := smtptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.RejectRecipient("gone@example.com", "550 5.1.1 No such user")
+	mailer = &SMTPMailer{Host: srv.Host(), Port: srv.Port()}
+	useEmailTemplates(t)
+
+	receipt, err := receiptEmail("buyer@example.com", "Buyer", []byte("%PDF-1.4 receipt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentID, err := enqueueEmailID(db, receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejectedID, err := enqueueEmailID(db, &Message{To: []string{"gone@example.com"}, Subject: "Hello", Text: "Hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM email_outbox WHERE id IN (?, ?)", sentID, rejectedID)
+		db.Exec("DELETE FROM email_suppressions WHERE email = 'gone@example.com'")
+	})
+
+	// Other due messages in the shared outbox may be delivered first.
+	status := func(id int64) string {
+		var s string
+		if err := db.QueryRow("SELECT status FROM email_outbox WHERE id = ?", id).Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	for i := 0; i < 50 && (status(sentID) == outboxPending || status(rejectedID) == outboxPending); i++ {
+		if delivered, err := deliverNextOutboxMessage(); err != nil {
+			t.Fatal(err)
+		} else if !delivered {
+			break
+		}
+	}
+	if got := status(sentID); got != outboxSent {
+		t.Errorf("Receipt has status %q, want %q", got, outboxSent)
+	}
+	if got := status(rejectedID); got != outboxDead {
+		t.Errorf("Rejected message has status %q, want %q", got, outboxDead)
+	}
+
+	var received *smtptest.Message
+	for _, msg := range srv.Messages() {
+		if len(msg.To) == 1 && msg.To[0] == "buyer@example.com" {
+			received = msg
+		}
+	}
+	if received == nil || received.Subject != "Your Receipt" || len(received.Attachments) != 1 {
+		t.Fatalf("Receipt not delivered: %+v", received)
+	}
+	if attachment := received.Attachments[0]; attachment.Filename != "receipt.pdf" || string(attachment.Data) != "%PDF-1.4 receipt" {
+		t.Errorf("Unexpected attachment %q: %q", attachment.Filename, attachment.Data)
+	}
+}
+
+func TestAllowResendLimitsAndForgetsKeys(t *testing.T) {
+	now := time.Now()
+	key := "email:resend-test@example.com"
+	for i := 0; i < resendBurst; i++ {
+		if !allowResend(key, now) {
+			t.Fatalf("Resend %d refused", i+1)
+		}
+	}
+	if allowResend(key, now) {
+		t.Error("Resend beyond the burst allowed")
+	}
+
+	later := now.Add(resendIdleTimeout + resendSweepInterval)
+	allowResend("ip:192.0.2.50", later)
+	resendLimiters.Lock()
+	_, kept := resendLimiters.limiters[key]
+	delete(resendLimiters.limiters, "ip:192.0.2.50")
+	resendLimiters.Unlock()
+	if kept {
+		t.Error("Idle resend limiter was not evicted")
+	}
+}
+
+func TestConfirmRejectsTokenWithoutExpiry(t *testing.T) {
+	db := openTestDB(t)
+	userID, _ := createTestUser(t, db)
+	token, err := generateToken(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE users SET confirmed = 0, token = ?, token_expires_at = NULL WHERE id = ?", token, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	confirmHandler(rec, httptest.NewRequest("GET", "/confirm?token="+token, nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "expired") {
+		t.Errorf("Got %d %q, want the expired link error", rec.Code, rec.Body.String())
+	}
+	var confirmed bool
+	if err := db.QueryRow("SELECT confirmed FROM users WHERE id = ?", userID).Scan(&confirmed); err != nil {
+		t.Fatal(err)
+	}
+	if confirmed {
+		t.Error("Token without an expiry confirmed the account")
+	}
+}
+
+func TestApplyEmailChangeRechecksUniqueness(t *testing.T) {
+	db := openTestDB(t)
+	userID, username := createTestUser(t, db)
+	_, otherName := createTestUser(t, db)
+
+	change := func(newEmail string) string {
+		token, err := generateToken(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revert, err := generateToken(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO email_changes (user_id, old_email, new_email, token, revert_token, expires_at, revert_expires_at)
+			VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL 1 HOUR), DATE_ADD(NOW(), INTERVAL 1 DAY))`,
+			userID, username+"@example.com", newEmail, token, revert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM email_changes WHERE user_id = ?", userID) })
+
+	// The other account took the address after the change was requested.
+	if err := applyEmailChange(db, change(otherName+"@example.com")); err != errEmailInUse {
+		t.Errorf("Taken address: got %v, want errEmailInUse", err)
+	}
+	var email string
+	if err := db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		t.Fatal(err)
+	}
+	if email != username+"@example.com" {
+		t.Errorf("Email changed to %q", email)
+	}
+
+	token := change(username + "-new@example.com")
+	if err := applyEmailChange(db, token); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEmailChange(db, token); err != sql.ErrNoRows {
+		t.Errorf("Reused token: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestConfirmEmailChangeRequiresToken(t *testing.T) {
+	rec := httptest.NewRecorder()
+	confirmEmailChangeHandler(rec, httptest.NewRequest("GET", "/email/confirm", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, want 400", rec.Code)
+	}
+}
+
+func TestAccountRoutesRejectAPIKeys(t *testing.T) {
+	identity := &apiKeyIdentity{KeyID: 1, UserID: 5, Scopes: []string{PermDeviceWrite}}
+	for path, handler := range map[string]http.HandlerFunc{
+		"/change-email":     changeEmailHandler,
+		"/change-password":  changePasswordHandler,
+		"/user/data-export": dataExportHandler,
+		"/user/delete":      requestAccountDeletionHandler,
+	} {
+		form := url.Values{"email": {"attacker@example.com"}}
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey, identity))
+		rec := httptest.NewRecorder()
+		RequireSession(handler)(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want 403", path, rec.Code)
+		}
+	}
+}
+
+func TestScopedAPIKeyCannotChangeEmail(t *testing.T) {
+	db := openTestDB(t)
+	userID, username := createTestUser(t, db)
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes) VALUES (?, 'test', ?, ?, ?)", userID, prefix, hashAPIKey(key), PermDeviceWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM api_keys WHERE user_id = ?", userID)
+
+	form := url.Values{"email": {username + "-stolen@example.com"}}
+	req := httptest.NewRequest("POST", "/change-email", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	authMiddleware(RequireSession(changeEmailHandler))(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Got status %d, want 403", rec.Code)
+	}
+	var pending int
+	if err := db.QueryRow("SELECT COUNT(*) FROM email_changes WHERE user_id = ?", userID).Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Error("Email change was requested with an API key")
+	}
+}
+
+func TestRequireScopeSelf(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	for name, tt := range map[string]struct {
+		identity *apiKeyIdentity
+		want     int
+	}{
+		"session":          {nil, http.StatusOK},
+		"self key":         {&apiKeyIdentity{UserID: 5, Scopes: []string{ScopeSelf}}, http.StatusOK},
+		"permission key":   {&apiKeyIdentity{UserID: 5, Scopes: []string{PermDeviceWrite}}, http.StatusForbidden},
+		"key with nothing": {&apiKeyIdentity{UserID: 5}, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "/notifications", nil)
+		if tt.identity != nil {
+			req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey, tt.identity))
+		}
+		rec := httptest.NewRecorder()
+		RequireScope(ScopeSelf)(ok)(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", name, rec.Code, tt.want)
+		}
+	}
+
+	// A self key still cannot act on permissions or the account itself.
+	req := httptest.NewRequest("POST", "/change-email", nil)
+	req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey, &apiKeyIdentity{UserID: 5, Scopes: []string{ScopeSelf}}))
+	rec := httptest.NewRecorder()
+	RequireSession(ok)(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Self key on an account route: got status %d, want 403", rec.Code)
+	}
+}
+
+func TestCheckRolePermissionChange(t *testing.T) {
+	const userID = 987655
+	permissionCache.Lock()
+	permissionCache.entries[userID] = cachedPermissions{
+		permissions: map[string]bool{PermRoleManage: true, PermAdminAccess: true, PermDeviceWrite: true},
+		expires:     time.Now().Add(time.Minute),
+	}
+	permissionCache.Unlock()
+	defer invalidateUserPermissions(userID)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		UserID:           userID,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/admin/roles/permissions", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+
+	editor := Role{ID: 7, Name: "editor"}
+	admin := Role{ID: 1, Name: "admin", IsSystem: true}
+	allowed := []struct {
+		role               Role
+		current, requested []string
+	}{
+		{editor, nil, []string{PermDeviceWrite}},
+		{editor, []string{PermDeviceWrite}, nil},
+		// Permissions left as they are need not be held.
+		{editor, []string{PermUserManage}, []string{PermUserManage, PermDeviceWrite}},
+		{admin, []string{PermAdminAccess, PermRoleManage, PermDeviceWrite}, []string{PermAdminAccess, PermRoleManage}},
+	}
+	for _, tt := range allowed {
+		if err := checkRolePermissionChange(req, tt.role, tt.current, tt.requested); err != nil {
+			t.Errorf("%s %v -> %v refused: %v", tt.role.Name, tt.current, tt.requested, err)
+		}
+	}
+
+	refused := []struct {
+		role               Role
+		current, requested []string
+	}{
+		{editor, nil, []string{PermUserManage}},
+		{editor, []string{PermUserManage}, nil},
+		{admin, []string{PermAdminAccess, PermRoleManage}, []string{PermAdminAccess}},
+		{admin, []string{PermAdminAccess, PermRoleManage}, nil},
+	}
+	for _, tt := range refused {
+		var forbidden forbiddenError
+		if err := checkRolePermissionChange(req, tt.role, tt.current, tt.requested); !errors.As(err, &forbidden) {
+			t.Errorf("%s %v -> %v: expected a forbiddenError, got %v", tt.role.Name, tt.current, tt.requested, err)
+		}
+	}
+}
+
+func TestAdminUserActionsRespectPrivilege(t *testing.T) {
+	const adminID, superID, plainID = 987656, 987657, 987658
+	permissionCache.Lock()
+	for id, permissions := range map[int]map[string]bool{
+		adminID: {PermUserManage: true, PermAdminAccess: true},
+		superID: {PermUserManage: true, PermAdminAccess: true, PermRoleManage: true},
+		plainID: {},
+	} {
+		permissionCache.entries[id] = cachedPermissions{permissions: permissions, expires: time.Now().Add(time.Minute)}
+	}
+	permissionCache.Unlock()
+	defer invalidatePermissionCache()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		UserID:           adminID,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(target int, form url.Values) *http.Request {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/admin/users/%d", target), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		return mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(target)})
+	}
+
+	if err := checkUserManageable(request(plainID, nil), plainID); err != nil {
+		t.Errorf("Less privileged user refused: %v", err)
+	}
+	if err := checkUserManageable(request(adminID, nil), adminID); err != nil {
+		t.Errorf("Own account refused: %v", err)
+	}
+	var forbidden forbiddenError
+	if err := checkUserManageable(request(superID, nil), superID); !errors.As(err, &forbidden) {
+		t.Errorf("Expected a forbiddenError for a more privileged user, got %v", err)
+	}
+
+	// The handlers stop before touching the database.
+	for name, handler := range map[string]http.HandlerFunc{
+		"disable":        setUserDisabledHandler,
+		"force reset":    forcePasswordResetHandler,
+		"confirm":        confirmUserHandler,
+		"clear suppress": clearEmailSuppressionHandler,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, request(superID, url.Values{"disabled": {"1"}}))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s on a more privileged user: got status %d, want 403", name, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	setUserDisabledHandler(rec, request(adminID, url.Values{"disabled": {"1"}}))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "own account") {
+		t.Errorf("Self-disable: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCompleteLoginEnforcesAccountStatus(t *testing.T) {
+	db := openTestDB(t)
+	userID, username := createTestUser(t, db)
+
+	for column, want := range map[string]string{"password_reset_required": errPasswordResetRequired.Error(), "disabled": errAccountDisabled.Error()} {
+		if _, err := db.Exec("UPDATE users SET disabled = 0, password_reset_required = 0, "+column+" = 1 WHERE id = ?", userID); err != nil {
+			t.Fatal(err)
+		}
+		// Provider sign-ins reach completeLogin without the password checks.
+		rec := httptest.NewRecorder()
+		completeLogin(rec, httptest.NewRequest("GET", "/login/oidc/test/callback", nil), userID, username)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s: got %d %q", column, rec.Code, rec.Body.String())
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Errorf("%s: session cookie issued", column)
+		}
+	}
+}
+
+func TestOIDCUsernamePassesValidation(t *testing.T) {
+	for email, want := range map[string]string{
+		"jane.doe@example.com":                              "jane.doe-a1b2c3",
+		"o'brien+shop@example.com":                          "obrienshop-a1b2c3",
+		"josé@example.com":                                  "jos-a1b2c3",
+		"\"!!\"@example.com":                                "user-a1b2c3",
+		"a-very-long-local-part-for-a-username@example.com": "a-very-long-local-part-fo-a1b2c3",
+	} {
+		got := oidcUsername(email, "a1b2c3")
+		if got != want {
+			t.Errorf("oidcUsername(%q) = %q, want %q", email, got, want)
+		}
+		if msg := validation.Username(got); msg != "" {
+			t.Errorf("oidcUsername(%q) = %q fails validation: %s", email, got, msg)
+		}
+	}
+}
+
+func TestDeviceListQuery(t *testing.T) {
+	query, args, errs := deviceListQuery(url.Values{"filter": {"50%_off' OR '1'='1"}, "sort": {"Brand DESC"}, "page": {"3"}})
+	if errs.Any() {
+		t.Fatalf("Valid parameters rejected: %v", errs)
+	}
+	want := `SELECT id, type1, brand, model FROM electronic WHERE brand LIKE ? ESCAPE '\\' ORDER BY brand desc LIMIT ? OFFSET ?`
+	if query != want {
+		t.Errorf("Unexpected query %q", query)
+	}
+	if len(args) != 3 || args[0] != `%50\%\_off' OR '1'='1%` || args[1] != devicesPerPage || args[2] != 2*devicesPerPage {
+		t.Errorf("Unexpected arguments %v", args)
+	}
+
+	for name, params := range map[string]url.Values{
+		"injected sort":  {"sort": {"brand; DROP TABLE users"}},
+		"unknown column": {"sort": {"password"}},
+		"bad direction":  {"sort": {"brand sideways"}},
+		"long filter":    {"filter": {strings.Repeat("a", 51)}},
+		"bad page":       {"page": {"two"}},
+		"negative page":  {"page": {"-1"}},
+	} {
+		if query, _, errs := deviceListQuery(params); !errs.Any() {
+			t.Errorf("%s: accepted as %q", name, query)
+		}
+	}
+}
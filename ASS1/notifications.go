@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Notifications are shown to users in the app: on the profile page and
+// through the /notifications JSON endpoint. They are created in the same
+// transaction as the change they describe and pushed to open pages once it
+// commits.
+const (
+	notificationOrderStatus  = "order_status"
+	notificationPriceDrop    = "price_drop"
+	notificationAnnouncement = "announcement"
+)
+
+const (
+	notificationsPageSize = 20
+	maxNotificationsLimit = 100
+	maxAnnouncementLength = 1000
+)
+
+type Notification struct {
+	ID        int    `json:"id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Link      string `json:"link,omitempty"`
+	Read      bool   `json:"read"`
+	CreatedAt string `json:"created_at"`
+}
+
+// notifyUser stores n for the user and returns it with its ID and creation
+// time filled in, ready to publish.
+func notifyUser(exec sqlExecer, userID int, n Notification) (Notification, error) {
+	n.CreatedAt = time.Now().Format("2006-01-02 15:04:05")
+	result, err := exec.Exec("INSERT INTO notifications (user_id, type, title, body, link, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, n.Type, n.Title, n.Body, n.Link, n.CreatedAt)
+	if err != nil {
+		return n, err
+	}
+	id, err := result.LastInsertId()
+	n.ID = int(id)
+	return n, err
+}
+
+// unreadNotifications counts the user's unread notifications.
+func unreadNotifications(db *sql.DB, userID string) (int, error) {
+	var unread int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&unread)
+	return unread, err
+}
+
+// getNotifications returns the user's latest notifications, newest first,
+// and how many are unread in total.
+func getNotifications(db *sql.DB, userID string, limit int, unreadOnly bool) ([]Notification, int, error) {
+	unread, err := unreadNotifications(db, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := "SELECT id, type, title, body, link, read_at IS NOT NULL, created_at FROM notifications WHERE user_id = ?"
+	if unreadOnly {
+		query += " AND read_at IS NULL"
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	rows, err := db.Query(query, userID, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var link sql.NullString
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Body, &link, &n.Read, &n.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		n.Link = link.String
+		notifications = append(notifications, n)
+	}
+	return notifications, unread, rows.Err()
+}
+
+// markNotificationsRead marks the given notifications read, or all of the
+// user's notifications when ids is empty.
+func markNotificationsRead(db *sql.DB, userID string, ids []int) error {
+	query := "UPDATE notifications SET read_at = NOW() WHERE user_id = ? AND read_at IS NULL"
+	args := []interface{}{userID}
+	if len(ids) > 0 {
+		query += " AND id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+// notificationsHandler returns the user's notifications as JSON. ?unread=1
+// leaves out read ones; ?limit= caps the list at up to
+// maxNotificationsLimit.
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := notificationsPageSize
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxNotificationsLimit {
+		limit = maxNotificationsLimit
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	notifications, unread, err := getNotifications(db, userID, limit, r.URL.Query().Get("unread") == "1")
+	if err != nil {
+		log.Error("Failed to fetch notifications: ", err)
+		http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Unread        int            `json:"unread"`
+		Notifications []Notification `json:"notifications"`
+	}{unread, notifications})
+}
+
+// markNotificationsReadHandler marks the notifications in the id form
+// values read, or all of them when there are none. JSON clients get the new
+// unread count; browsers go back to the profile page. The user's other open
+// pages are told the new count too.
+func markNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	r.ParseForm()
+	var ids []int
+	for _, value := range r.Form["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if err := markNotificationsRead(db, userID, ids); err != nil {
+		log.Error("Failed to mark notifications read: ", err)
+		http.Error(w, "Failed to update notifications", http.StatusInternalServerError)
+		return
+	}
+
+	unread, err := unreadNotifications(db, userID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	status := notificationsReadEvent{IDs: ids, Unread: unread}
+	if err := broker.Publish(userID, eventNotificationRead, status); err != nil {
+		log.Error("Failed to publish event: ", err)
+	}
+
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/user", http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Unread int `json:"unread"`
+	}{unread})
+}
+
+// notificationsReadEvent is pushed when notifications are marked read; no
+// IDs means all of them.
+type notificationsReadEvent struct {
+	IDs    []int `json:"ids,omitempty"`
+	Unread int   `json:"unread"`
+}
+
+// announcementHandler sends an admin announcement to every active user.
+func announcementHandler(w http.ResponseWriter, r *http.Request) {
+	title := strings.TrimSpace(r.FormValue("title"))
+	body := strings.TrimSpace(r.FormValue("body"))
+	if title == "" || len(title) > 255 || len(body) > maxAnnouncementLength {
+		http.Error(w, "An announcement needs a title of up to 255 characters and a message of up to 1000", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	n := Notification{Type: notificationAnnouncement, Title: title, Body: body, CreatedAt: time.Now().Format("2006-01-02 15:04:05")}
+	result, err := db.Exec(`INSERT INTO notifications (user_id, type, title, body, link, created_at)
+		SELECT id, ?, ?, ?, NULL, ? FROM users WHERE disabled = 0`, n.Type, n.Title, n.Body, n.CreatedAt)
+	if err != nil {
+		log.Error("Failed to send announcement: ", err)
+		http.Error(w, "Failed to send announcement", http.StatusInternalServerError)
+		return
+	}
+	recipients, _ := result.RowsAffected()
+	log.WithFields(logrus.Fields{
+		"event":      "announcement_sent",
+		"admin_id":   getUserIDFromRequest(r),
+		"recipients": recipients,
+	}).Info("Announcement sent: ", title)
+	// Each user's copy has its own ID, so open pages get the announcement
+	// without one.
+	if err := broker.Broadcast(eventNotification, n); err != nil {
+		log.Error("Failed to publish event: ", err)
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
+// usersWithDeviceInCart returns the users whose cart holds the device.
+func usersWithDeviceInCart(deviceID int) []int {
+	cartStorage.RLock()
+	defer cartStorage.RUnlock()
+
+	var users []int
+	for userID, cart := range cartStorage.carts {
+		for _, device := range cart {
+			if device.ID == deviceID {
+				if id, err := strconv.Atoi(userID); err == nil {
+					users = append(users, id)
+				}
+				break
+			}
+		}
+	}
+	return users
+}
+
+// notifyPriceDrop tells users with the device in their cart about a lower
+// price, unless they opted out of product alerts. It returns the stored
+// notifications by user, to publish once tx commits.
+func notifyPriceDrop(tx *sql.Tx, device Device, oldPrice, newPrice float64) (map[int]Notification, error) {
+	candidates := usersWithDeviceInCart(device.ID)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(candidates))
+	for i, id := range candidates {
+		args[i] = id
+	}
+	rows, err := tx.Query("SELECT u.id FROM users u WHERE u.disabled = 0 AND u.id IN (?"+strings.Repeat(", ?", len(candidates)-1)+") AND "+
+		optOutCondition(emailProductAlerts), args...)
+	if err != nil {
+		return nil, err
+	}
+	var recipients []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		recipients = append(recipients, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	n := Notification{
+		Type:  notificationPriceDrop,
+		Title: fmt.Sprintf("Price drop: %s %s", device.Brand, device.Model),
+		Body:  fmt.Sprintf("The %s %s in your cart is now %.2f, down from %.2f.", device.Brand, device.Model, newPrice, oldPrice),
+		Link:  "/user",
+	}
+	notified := make(map[int]Notification, len(recipients))
+	for _, id := range recipients {
+		stored, err := notifyUser(tx, id, n)
+		if err != nil {
+			return nil, err
+		}
+		notified[id] = stored
+	}
+	return notified, nil
+}
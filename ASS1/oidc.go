@@ -0,0 +1,603 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"ASS1/validation"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+)
+
+// OIDCProvider is one OpenID Connect identity provider users can sign in with.
+// Providers are configured per deployment in the file named by OIDC_PROVIDERS_FILE.
+type OIDCProvider struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcIDTokenClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Nonce         string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+type oidcPendingLogin struct {
+	Provider string
+	Nonce    string
+	Verifier string
+	Expires  time.Time
+}
+
+const oidcLoginTTL = 10 * time.Minute
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var oidcProviders = struct {
+	sync.RWMutex
+	providers map[string]*OIDCProvider
+}{providers: make(map[string]*OIDCProvider)}
+
+var oidcPendingLogins = struct {
+	sync.Mutex
+	logins map[string]oidcPendingLogin
+}{logins: make(map[string]oidcPendingLogin)}
+
+// loadOIDCProviders registers the providers listed in a JSON file. A missing
+// file simply means the deployment has no external sign-in configured.
+func loadOIDCProviders(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var providers []*OIDCProvider
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, p := range providers {
+		if p.Name == "" || p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return fmt.Errorf("parse %s: provider %q is missing name, issuer, client_id or redirect_url", path, p.Name)
+		}
+		registerOIDCProvider(p)
+	}
+	return nil
+}
+
+func registerOIDCProvider(p *OIDCProvider) {
+	if p.DisplayName == "" {
+		p.DisplayName = p.Name
+	}
+	if len(p.Scopes) == 0 {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	oidcProviders.Lock()
+	oidcProviders.providers[p.Name] = p
+	oidcProviders.Unlock()
+}
+
+func getOIDCProvider(name string) (*OIDCProvider, bool) {
+	oidcProviders.RLock()
+	defer oidcProviders.RUnlock()
+	p, ok := oidcProviders.providers[name]
+	return p, ok
+}
+
+func listOIDCProviders() []*OIDCProvider {
+	oidcProviders.RLock()
+	defer oidcProviders.RUnlock()
+
+	providers := make([]*OIDCProvider, 0, len(oidcProviders.providers))
+	for _, p := range oidcProviders.providers {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	resp, err := oidcHTTPClient.Get(strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery for %s returned %s", p.Name, resp.Status)
+	}
+
+	var d oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery for %s returned issuer %q", p.Name, d.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *OIDCProvider) authCodeURL(state, nonce, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// exchangeCode redeems an authorization code and returns the raw ID token.
+func (p *OIDCProvider) exchangeCode(code, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token response from %s: %w", p.Name, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token request to %s failed: %s %s %s", p.Name, resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token response from %s has no id_token", p.Name)
+	}
+	return body.IDToken, nil
+}
+
+func (p *OIDCProvider) verifyIDToken(rawIDToken, nonce string) (*oidcIDTokenClaims, error) {
+	claims := &oidcIDTokenClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256"}))
+	_, err := parser.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, errors.New("id token has an unexpected issuer")
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, errors.New("id token was not issued for this client")
+	}
+	if !claims.VerifyExpiresAt(time.Now(), true) {
+		return nil, errors.New("id token has expired")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token has no subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+	return claims, nil
+}
+
+// signingKey returns the provider key with the given ID, refetching the key set
+// once when the ID is unknown so that provider key rotation is picked up.
+func (p *OIDCProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := fetchJWKS(d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	// A key set with a single key may omit key IDs entirely.
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no signing key %q for %s", kid, p.Name)
+}
+
+func fetchJWKS(jwksURI string) (map[string]*rsa.PublicKey, error) {
+	resp, err := oidcHTTPClient.Get(jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks request returned %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := getOIDCProvider(mux.Vars(r)["provider"])
+	if !ok {
+		http.Error(w, "Unknown sign-in provider", http.StatusNotFound)
+		return
+	}
+
+	state, err := generateToken(16)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := generateToken(16)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	verifier, err := generateToken(32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.authCodeURL(state, nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC discovery for %s failed: %v\n", provider.Name, err)
+		http.Error(w, "Sign-in provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now()
+	oidcPendingLogins.Lock()
+	for s, pending := range oidcPendingLogins.logins {
+		if now.After(pending.Expires) {
+			delete(oidcPendingLogins.logins, s)
+		}
+	}
+	oidcPendingLogins.logins[state] = oidcPendingLogin{
+		Provider: provider.Name,
+		Nonce:    nonce,
+		Verifier: verifier,
+		Expires:  now.Add(oidcLoginTTL),
+	}
+	oidcPendingLogins.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc_state",
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := getOIDCProvider(mux.Vars(r)["provider"])
+	if !ok {
+		http.Error(w, "Unknown sign-in provider", http.StatusNotFound)
+		return
+	}
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		log.Printf("OIDC provider %s returned error: %s\n", provider.Name, errCode)
+		http.Error(w, "Sign-in was cancelled or failed", http.StatusUnauthorized)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie("oidc_state")
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "Invalid sign-in state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "oidc_state", Value: "", Path: "/login/oidc", MaxAge: -1})
+
+	oidcPendingLogins.Lock()
+	pending, ok := oidcPendingLogins.logins[state]
+	delete(oidcPendingLogins.logins, state)
+	oidcPendingLogins.Unlock()
+	if !ok || pending.Provider != provider.Name || time.Now().After(pending.Expires) {
+		http.Error(w, "Invalid sign-in state", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := provider.exchangeCode(r.URL.Query().Get("code"), pending.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange with %s failed: %v\n", provider.Name, err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := provider.verifyIDToken(rawIDToken, pending.Nonce)
+	if err != nil {
+		log.Printf("OIDC id token from %s rejected: %v\n", provider.Name, err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	userID, username, err := linkOIDCIdentity(db, provider.Name, claims)
+	if err != nil {
+		if err == errOIDCEmailNotVerified || err == errAccountDisabled {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.Printf("Failed to link OIDC identity from %s: %v\n", provider.Name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	completeLogin(w, r, userID, username)
+}
+
+var errOIDCEmailNotVerified = errors.New("Your email address is not verified with this provider")
+
+// linkOIDCIdentity resolves the local user for a provider identity. Known
+// identities sign in directly; otherwise the identity is linked to the
+// confirmed user with the same verified email, or a new confirmed user is
+// created.
+//
+// An unconfirmed user with the email is never linked: whoever registered it
+// chose its password without proving they own the address, so linking would
+// hand them the provider user's account. That registration is released
+// instead; it is disabled, its password and tokens are cleared, and the
+// address goes to the new user.
+func linkOIDCIdentity(db *sql.DB, provider string, claims *oidcIDTokenClaims) (int, string, error) {
+	var userID int
+	var username string
+	var disabled bool
+	err := db.QueryRow("SELECT u.id, u.username, u.disabled FROM user_identities i JOIN users u ON u.id = i.user_id WHERE i.provider = ? AND i.subject = ?", provider, claims.Subject).Scan(&userID, &username, &disabled)
+	if err == nil {
+		if disabled {
+			return 0, "", errAccountDisabled
+		}
+		return userID, username, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return 0, "", errOIDCEmailNotVerified
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var confirmed bool
+	err = tx.QueryRow("SELECT id, username, confirmed, disabled FROM users WHERE email = ? FOR UPDATE", claims.Email).Scan(&userID, &username, &confirmed, &disabled)
+	if err == nil && !confirmed {
+		if err := releaseUnconfirmedUser(tx, userID); err != nil {
+			return 0, "", err
+		}
+		err = sql.ErrNoRows
+	}
+	switch {
+	case err == nil && disabled:
+		return 0, "", errAccountDisabled
+	case err == sql.ErrNoRows:
+		userID, username, err = createOIDCUser(tx, claims.Email)
+		if err != nil {
+			return 0, "", err
+		}
+	case err != nil:
+		return 0, "", err
+	}
+
+	_, err = tx.Exec("INSERT INTO user_identities (user_id, provider, subject, email) VALUES (?, ?, ?, ?)", userID, provider, claims.Subject, claims.Email)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	return userID, username, nil
+}
+
+// releaseUnconfirmedUser frees an unconfirmed user's email address for
+// someone who has proven they own it, and makes the account unusable.
+func releaseUnconfirmedUser(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(`UPDATE users SET email = CONCAT('released-', id, '@invalid'), password = '', token = '', token_expires_at = NULL,
+		disabled = 1 WHERE id = ? AND confirmed = 0`, userID)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"password_resets", "email_changes", "api_keys"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("delete from %s: %w", table, err)
+		}
+	}
+	log.Printf("Released the email of unconfirmed user %d to a provider sign-in\n", userID)
+	return nil
+}
+
+// oidcUsername derives a username from the email's local part that passes
+// the same rules as the registration form. Characters the form would reject
+// are dropped and the result is shortened to leave room for the suffix.
+func oidcUsername(email, suffix string) string {
+	local := email
+	if at := strings.Index(email, "@"); at > 0 {
+		local = email[:at]
+	}
+	cleaned := strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-') {
+			return r
+		}
+		return -1
+	}, local)
+	if max := validation.UsernameMaxLength - len(suffix) - 1; len(cleaned) > max {
+		cleaned = cleaned[:max]
+	}
+	username := cleaned + "-" + suffix
+	if cleaned == "" || validation.Username(username) != "" {
+		username = "user-" + suffix
+	}
+	return username
+}
+
+func createOIDCUser(tx *sql.Tx, email string) (int, string, error) {
+	suffix, err := generateToken(3)
+	if err != nil {
+		return 0, "", err
+	}
+	username := oidcUsername(email, suffix)
+
+	// The account has no usable password until the user sets one.
+	unusable, err := generateToken(32)
+	if err != nil {
+		return 0, "", err
+	}
+	hashedPassword, err := hashPassword(unusable)
+	if err != nil {
+		return 0, "", err
+	}
+
+	result, err := tx.Exec("INSERT INTO users (username, email, password, token, confirmed) VALUES (?, ?, ?, '', 1)", username, email, string(hashedPassword))
+	if err != nil {
+		return 0, "", err
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	if err := assignDefaultRole(tx, userID); err != nil {
+		return 0, "", err
+	}
+	return int(userID), username, nil
+}
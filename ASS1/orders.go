@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// orderStatuses lists the statuses an order in transactions1 can have, in
+// the order they usually happen.
+var orderStatuses = []string{"pending", "paid", "shipped", "delivered", "cancelled", "refunded"}
+
+var orderStatusMessages = map[string]string{
+	"pending":   "We have received order #%d and are waiting for payment.",
+	"paid":      "Payment for order #%d was received. We are preparing it for shipping.",
+	"shipped":   "Order #%d is on its way.",
+	"delivered": "Order #%d has been delivered. Enjoy!",
+	"cancelled": "Order #%d was cancelled.",
+	"refunded":  "Order #%d was refunded.",
+}
+
+// orderStatusNotification returns the title and body of the notification
+// sent when an order moves to status.
+func orderStatusNotification(orderID int, status string) (string, string) {
+	title := fmt.Sprintf("Order #%d: %s", orderID, status)
+	message, ok := orderStatusMessages[status]
+	if !ok {
+		return title, fmt.Sprintf("Order #%d is now %s.", orderID, status)
+	}
+	return title, fmt.Sprintf(message, orderID)
+}
+
+func validOrderStatus(status string) bool {
+	for _, s := range orderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type Order struct {
+	ID         int
+	CustomerID int
+	Customer   string
+	Status     string
+}
+
+func adminOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT t.id, t.customer_id, COALESCE(u.username, ''), t.status
+		FROM transactions1 t LEFT JOIN users u ON u.id = t.customer_id
+		ORDER BY t.id DESC LIMIT 100`)
+	if err != nil {
+		log.Println("Failed to fetch orders: ", err)
+		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := rows.Scan(&o.ID, &o.CustomerID, &o.Customer, &o.Status); err != nil {
+			log.Println("Failed to scan order: ", err)
+			http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Orders    []Order
+		Statuses  []string
+		CanRefund bool
+	}{
+		PageSecurity: pageSecurity(r),
+		Orders:       orders,
+		Statuses:     orderStatuses,
+		CanRefund:    hasPermission(r, PermOrderRefund),
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_orders.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// setOrderStatusHandler changes an order's status from the admin orders
+// page. Refunds additionally need the order:refund permission.
+func setOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	status := r.FormValue("status")
+	if !validOrderStatus(status) {
+		http.Error(w, "Invalid order status", http.StatusBadRequest)
+		return
+	}
+	if status == "refunded" && !hasPermission(r, PermOrderRefund) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if err := updateTransactionStatus(db, orderID, status); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/orders", http.StatusSeeOther)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Outgoing email is written to the email_outbox table in the same
+// transaction as the change that triggers it, and delivered by background
+// workers. A failed delivery is retried with exponential backoff until
+// outboxMaxAttempts, after which the message is dead-lettered for an admin
+// to inspect and retry. A message the mail server rejects outright is
+// dead-lettered at once, and messages whose recipients are all on the
+// suppression list are not sent. Once outboxRetention has passed, the
+// addresses and content of delivered messages are scrubbed; the rows stay so
+// campaign delivery counts remain correct.
+const (
+	outboxWorkers      = 2
+	outboxMaxAttempts  = 8
+	outboxBaseBackoff  = 30 * time.Second
+	outboxMaxBackoff   = 6 * time.Hour
+	outboxClaimTimeout = 5 * time.Minute
+	outboxPollInterval = 5 * time.Second
+	outboxRetention    = 30 * 24 * time.Hour
+	outboxPruneEvery   = time.Hour
+)
+
+const (
+	outboxPending    = "pending"
+	outboxSent       = "sent"
+	outboxDead       = "dead"
+	outboxSuppressed = "suppressed"
+	// outboxErased marks messages scrubbed because their recipient's
+	// account was erased before they were sent.
+	outboxErased = "erased"
+)
+
+// outboxScrub is the SET clause clearing a message's addresses and content.
+const outboxScrub = "recipients = '', subject = '', payload = '', claim_token = NULL, locked_until = NULL"
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// enqueueEmail stores msg for delivery. Pass the transaction making the
+// related change so the email is sent if and only if that change commits.
+func enqueueEmail(exec sqlExecer, msg *Message) error {
+	_, err := enqueueEmailID(exec, msg)
+	return err
+}
+
+// enqueueEmailID is enqueueEmail for callers that track delivery of the
+// message; it returns the outbox row ID.
+func enqueueEmailID(exec sqlExecer, msg *Message) (int64, error) {
+	if len(msg.To) == 0 {
+		return 0, fmt.Errorf("message %q has no recipients", msg.Subject)
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	result, err := exec.Exec("INSERT INTO email_outbox (recipients, subject, payload, status, next_attempt_at) VALUES (?, ?, ?, ?, NOW())",
+		strings.Join(msg.To, ", "), msg.Subject, payload, outboxPending)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// outboxBackoff returns the delay before the next delivery attempt after the
+// given number of failed attempts.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	delay := outboxBaseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+	return delay
+}
+
+// startOutboxWorkers starts n workers delivering queued email. Workers claim
+// one message at a time with a lease, so several application instances can
+// share the outbox. Another goroutine runs pruneOutbox periodically.
+func startOutboxWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				delivered, err := deliverNextOutboxMessage()
+				if err != nil {
+					log.Error("Outbox worker failed: ", err)
+				}
+				if !delivered {
+					time.Sleep(outboxPollInterval)
+				}
+			}
+		}()
+	}
+	go func() {
+		for {
+			if err := pruneOutbox(); err != nil {
+				log.Error("Failed to prune outbox: ", err)
+			}
+			time.Sleep(outboxPruneEvery)
+		}
+	}()
+}
+
+// pruneOutbox scrubs messages delivered more than outboxRetention ago.
+func pruneOutbox() error {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE email_outbox SET "+outboxScrub+" WHERE status IN (?, ?) AND payload <> '' AND created_at < DATE_SUB(NOW(), INTERVAL ? SECOND)",
+		outboxSent, outboxSuppressed, int(outboxRetention.Seconds()))
+	return err
+}
+
+// eraseOutboxRecipient scrubs every message addressed to email. Messages
+// not yet delivered are marked outboxErased so they are never sent.
+func eraseOutboxRecipient(exec sqlExecer, email string) error {
+	_, err := exec.Exec("UPDATE email_outbox SET "+outboxScrub+", status = IF(status = ?, status, ?) WHERE FIND_IN_SET(?, REPLACE(recipients, ', ', ','))",
+		outboxSent, outboxErased, email)
+	return err
+}
+
+// deliverNextOutboxMessage claims and delivers one due message. It reports
+// false when nothing was due.
+func deliverNextOutboxMessage() (bool, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	claim, err := generateToken(16)
+	if err != nil {
+		return false, err
+	}
+	result, err := db.Exec(`UPDATE email_outbox SET claim_token = ?, locked_until = DATE_ADD(NOW(), INTERVAL ? SECOND)
+		WHERE status = ? AND next_attempt_at <= NOW() AND (locked_until IS NULL OR locked_until < NOW())
+		ORDER BY id LIMIT 1`, claim, int(outboxClaimTimeout.Seconds()), outboxPending)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	var id, attempts int
+	var payload string
+	if err := db.QueryRow("SELECT id, attempts, payload FROM email_outbox WHERE claim_token = ?", claim).Scan(&id, &attempts, &payload); err != nil {
+		return false, err
+	}
+
+	var msg Message
+	sendErr := json.Unmarshal([]byte(payload), &msg)
+	if sendErr == nil {
+		msg.To, sendErr = unsuppressedRecipients(db, msg.To)
+	}
+	if sendErr == nil && len(msg.To) == 0 {
+		_, err := db.Exec("UPDATE email_outbox SET status = ?, last_error = ?, claim_token = NULL, locked_until = NULL WHERE id = ?",
+			outboxSuppressed, "All recipients are on the suppression list", id)
+		return true, err
+	}
+	if sendErr == nil {
+		sendErr = mailer.Send(&msg)
+	}
+	return true, recordOutboxAttempt(db, id, attempts+1, sendErr)
+}
+
+func recordOutboxAttempt(db *sql.DB, id, attempts int, sendErr error) error {
+	if sendErr == nil {
+		_, err := db.Exec("UPDATE email_outbox SET status = ?, attempts = ?, sent_at = NOW(), last_error = NULL, claim_token = NULL, locked_until = NULL WHERE id = ?",
+			outboxSent, attempts, id)
+		return err
+	}
+
+	fields := logrus.Fields{"event": "email_delivery_failed", "outbox_id": id, "attempts": attempts}
+	var rejected *PermanentError
+	permanent := errors.As(sendErr, &rejected)
+	if permanent && rejected.HardBounce() && len(rejected.Recipients) == 1 {
+		// With several recipients the reply does not say which was refused.
+		if err := suppressEmail(db, rejected.Recipients[0], suppressionHardBounce, "smtp", rejected.Error()); err != nil {
+			log.Error("Failed to suppress bounced address: ", err)
+		}
+	}
+	if permanent || attempts >= outboxMaxAttempts {
+		log.WithFields(fields).Error("Email dead-lettered: ", sendErr)
+		_, err := db.Exec("UPDATE email_outbox SET status = ?, attempts = ?, last_error = ?, claim_token = NULL, locked_until = NULL WHERE id = ?",
+			outboxDead, attempts, sendErr.Error(), id)
+		return err
+	}
+
+	log.WithFields(fields).Warn("Email delivery failed, will retry: ", sendErr)
+	_, err := db.Exec(`UPDATE email_outbox SET attempts = ?, last_error = ?, next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND),
+		claim_token = NULL, locked_until = NULL WHERE id = ?`,
+		attempts, sendErr.Error(), int(outboxBackoff(attempts).Seconds()), id)
+	return err
+}
+
+type OutboxMessage struct {
+	ID            int
+	Recipients    string
+	Subject       string
+	Status        string
+	Attempts      int
+	LastError     string
+	NextAttemptAt string
+	CreatedAt     string
+	SentAt        string
+}
+
+// adminOutboxHandler lists dead-lettered and queued messages; ?status=sent
+// shows recent deliveries instead.
+func adminOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != outboxSent && status != outboxPending && status != outboxSuppressed {
+		status = outboxDead
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	counts := map[string]int{}
+	countRows, err := db.Query("SELECT status, COUNT(*) FROM email_outbox GROUP BY status")
+	if err != nil {
+		log.Println("Failed to count outbox messages: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for countRows.Next() {
+		var s string
+		var n int
+		if err := countRows.Scan(&s, &n); err != nil {
+			countRows.Close()
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		counts[s] = n
+	}
+	countRows.Close()
+
+	rows, err := db.Query(`SELECT id, recipients, subject, status, attempts, last_error, next_attempt_at, created_at, sent_at
+		FROM email_outbox WHERE status = ? ORDER BY id DESC LIMIT 100`, status)
+	if err != nil {
+		log.Println("Failed to fetch outbox messages: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var messages []OutboxMessage
+	for rows.Next() {
+		var m OutboxMessage
+		var lastError, sentAt sql.NullString
+		if err := rows.Scan(&m.ID, &m.Recipients, &m.Subject, &m.Status, &m.Attempts, &lastError, &m.NextAttemptAt, &m.CreatedAt, &sentAt); err != nil {
+			log.Println("Failed to scan outbox message: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		m.LastError = lastError.String
+		m.SentAt = sentAt.String
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Status      string
+		Counts      map[string]int
+		Messages    []OutboxMessage
+		MaxAttempts int
+	}{
+		PageSecurity: pageSecurity(r),
+		Status:       status,
+		Counts:       counts,
+		Messages:     messages,
+		MaxAttempts:  outboxMaxAttempts,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_outbox.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// retryOutboxMessageHandler requeues a dead-lettered or suppressed message
+// with a fresh set of attempts.
+func retryOutboxMessageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("UPDATE email_outbox SET status = ?, attempts = 0, next_attempt_at = NOW() WHERE id = ? AND status IN (?, ?) AND payload <> ''",
+		outboxPending, id, outboxDead, outboxSuppressed)
+	if err != nil {
+		log.Println("Failed to retry outbox message: ", err)
+		http.Error(w, "Failed to retry message", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Only failed messages can be retried", http.StatusBadRequest)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":     "email_retry",
+		"outbox_id": id,
+		"admin_id":  getUserIDFromRequest(r),
+	}).Info("Dead-lettered email requeued")
+	http.Redirect(w, r, "/admin/outbox", http.StatusSeeOther)
+}
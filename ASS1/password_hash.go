@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	hashAlgorithmBcrypt   = "bcrypt"
+	hashAlgorithmArgon2id = "argon2id"
+)
+
+// PasswordHashConfig selects how new password hashes are created. Every
+// stored hash carries its own parameters (bcrypt's "$2a$<cost>$" prefix or
+// an argon2id PHC string), so hashes made under older settings keep
+// verifying and are upgraded the next time their owner signs in.
+type PasswordHashConfig struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var passwordHashing = PasswordHashConfig{
+	Algorithm:     hashAlgorithmBcrypt,
+	BcryptCost:    12,
+	Argon2Time:    3,
+	Argon2Memory:  64 * 1024,
+	Argon2Threads: 2,
+}
+
+// loadPasswordHashConfig applies PASSWORD_HASH_ALGORITHM, BCRYPT_COST,
+// ARGON2_TIME, ARGON2_MEMORY_KIB and ARGON2_THREADS on top of the defaults.
+func loadPasswordHashConfig() error {
+	if value := os.Getenv("PASSWORD_HASH_ALGORITHM"); value != "" {
+		if value != hashAlgorithmBcrypt && value != hashAlgorithmArgon2id {
+			return fmt.Errorf("unknown PASSWORD_HASH_ALGORITHM %q", value)
+		}
+		passwordHashing.Algorithm = value
+	}
+	for name, setting := range map[string]struct {
+		target   interface{}
+		min, max int
+	}{
+		"BCRYPT_COST":       {&passwordHashing.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost},
+		"ARGON2_TIME":       {&passwordHashing.Argon2Time, 1, 100},
+		"ARGON2_MEMORY_KIB": {&passwordHashing.Argon2Memory, 8 * 1024, 4 * 1024 * 1024},
+		"ARGON2_THREADS":    {&passwordHashing.Argon2Threads, 1, 255},
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < setting.min || n > setting.max {
+			return fmt.Errorf("invalid %s %q: must be between %d and %d", name, value, setting.min, setting.max)
+		}
+		switch target := setting.target.(type) {
+		case *int:
+			*target = n
+		case *uint32:
+			*target = uint32(n)
+		case *uint8:
+			*target = uint8(n)
+		}
+	}
+	return nil
+}
+
+// hashPassword hashes a new password with the configured algorithm.
+func hashPassword(password string) ([]byte, error) {
+	if passwordHashing.Algorithm == hashAlgorithmArgon2id {
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		params := argon2Params{
+			memory:  passwordHashing.Argon2Memory,
+			time:    passwordHashing.Argon2Time,
+			threads: passwordHashing.Argon2Threads,
+		}
+		key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, argon2KeyLength)
+		return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			params.memory, params.time, params.threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), passwordHashing.BcryptCost)
+}
+
+var errUnknownHashFormat = errors.New("unknown password hash format")
+
+// verifyPassword checks password against a stored hash of any supported
+// format. needsRehash is set when the password matched but the hash was made
+// with a different algorithm or parameters than currently configured.
+func verifyPassword(hash, password string) (ok bool, needsRehash bool, err error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, false, err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false, nil
+		}
+		return true, !passwordHashCurrent(hash), nil
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, !passwordHashCurrent(hash), nil
+}
+
+// passwordHashCurrent reports whether hash matches the configured algorithm
+// and parameters.
+func passwordHashCurrent(hash string) bool {
+	algorithm, params := describePasswordHash(hash)
+	if algorithm != passwordHashing.Algorithm {
+		return false
+	}
+	return params == describeCurrentHashParams()
+}
+
+func describeCurrentHashParams() string {
+	if passwordHashing.Algorithm == hashAlgorithmArgon2id {
+		return argon2Params{
+			memory:  passwordHashing.Argon2Memory,
+			time:    passwordHashing.Argon2Time,
+			threads: passwordHashing.Argon2Threads,
+		}.String()
+	}
+	return "cost=" + strconv.Itoa(passwordHashing.BcryptCost)
+}
+
+// describePasswordHash returns the algorithm and parameters of a stored hash,
+// e.g. ("bcrypt", "cost=10"); unrecognised hashes are reported as "unknown".
+func describePasswordHash(hash string) (algorithm, params string) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, _, _, err := parseArgon2Hash(hash)
+		if err != nil {
+			return "unknown", ""
+		}
+		return hashAlgorithmArgon2id, p.String()
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return "unknown", ""
+	}
+	return hashAlgorithmBcrypt, "cost=" + strconv.Itoa(cost)
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func (p argon2Params) String() string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", p.memory, p.time, p.threads)
+}
+
+// parseArgon2Hash decodes "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>".
+func parseArgon2Hash(hash string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != hashAlgorithmArgon2id {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	return params, salt, key, nil
+}
+
+// rehashPassword upgrades a user's stored hash after a successful login.
+// Failures are only logged; the old hash keeps working.
+func rehashPassword(db *sql.DB, userID int, password string) {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		log.Error("Failed to rehash password: ", err)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET password = ? WHERE id = ?", hashed, userID); err != nil {
+		log.Error("Failed to store upgraded password hash: ", err)
+		return
+	}
+	log.WithField("user_id", userID).Info("Upgraded password hash to current parameters")
+}
+
+type PasswordHashSummary struct {
+	Algorithm string
+	Params    string
+	Accounts  int
+	Current   bool
+}
+
+// passwordHashReportHandler shows how many accounts use each hash algorithm
+// and parameter set, so admins can see how many still need upgrading.
+func passwordHashReportHandler(w http.ResponseWriter, r *http.Request) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT password FROM users")
+	if err != nil {
+		log.Println("Failed to fetch password hashes: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	counts := make(map[[2]string]int)
+	total, legacy := 0, 0
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			log.Println("Failed to scan password hash: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		algorithm, params := describePasswordHash(hash)
+		counts[[2]string{algorithm, params}]++
+		total++
+		if !passwordHashCurrent(hash) {
+			legacy++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Password hash rows error: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	summaries := make([]PasswordHashSummary, 0, len(counts))
+	for key, n := range counts {
+		summaries = append(summaries, PasswordHashSummary{
+			Algorithm: key[0],
+			Params:    key[1],
+			Accounts:  n,
+			Current:   key[0] == passwordHashing.Algorithm && key[1] == describeCurrentHashParams(),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Accounts > summaries[j].Accounts })
+
+	data := struct {
+		PageSecurity
+		Algorithm string
+		Params    string
+		Total     int
+		Legacy    int
+		Summaries []PasswordHashSummary
+	}{
+		PageSecurity: pageSecurity(r),
+		Algorithm:    passwordHashing.Algorithm,
+		Params:       describeCurrentHashParams(),
+		Total:        total,
+		Legacy:       legacy,
+		Summaries:    summaries,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_password_hashes.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"ASS1/validation"
+)
+
+// Password settings used by registration, password change and reset. They
+// are replaced by loadPasswordPolicy at startup.
+var (
+	passwordPolicy      = validation.DefaultPasswordPolicy
+	passwordHistorySize = 5
+	breachedPasswords   *BreachedPasswordList
+)
+
+// loadPasswordPolicy applies PASSWORD_MIN_LENGTH, PASSWORD_REQUIRE_UPPER,
+// PASSWORD_REQUIRE_LOWER, PASSWORD_REQUIRE_DIGIT, PASSWORD_REQUIRE_SYMBOL,
+// PASSWORD_HISTORY and BREACHED_PASSWORDS_PATH on top of the defaults.
+func loadPasswordPolicy() error {
+	if value := os.Getenv("PASSWORD_MIN_LENGTH"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", value)
+		}
+		passwordPolicy.MinLength = n
+	}
+	for name, field := range map[string]*bool{
+		"PASSWORD_REQUIRE_UPPER":  &passwordPolicy.RequireUpper,
+		"PASSWORD_REQUIRE_LOWER":  &passwordPolicy.RequireLower,
+		"PASSWORD_REQUIRE_DIGIT":  &passwordPolicy.RequireDigit,
+		"PASSWORD_REQUIRE_SYMBOL": &passwordPolicy.RequireSymbol,
+	} {
+		if value, ok := os.LookupEnv(name); ok {
+			*field = value == "1"
+		}
+	}
+	if value := os.Getenv("PASSWORD_HISTORY"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid PASSWORD_HISTORY %q", value)
+		}
+		passwordHistorySize = n
+	}
+	if path := os.Getenv("BREACHED_PASSWORDS_PATH"); path != "" {
+		list, err := loadBreachedPasswords(path)
+		if err != nil {
+			return err
+		}
+		breachedPasswords = list
+	}
+	return nil
+}
+
+// BreachedPasswordList answers whether a password appears in a local copy of
+// a breach corpus. Passwords are looked up the way the k-anonymity range API
+// works: the SHA-1 hash is split into a 5 character prefix, which selects a
+// range, and a 35 character suffix searched within it. The corpus is either
+// a directory of range files named <PREFIX>.txt holding "SUFFIX:COUNT" lines,
+// or a single file of full "HASH:COUNT" lines that is loaded into memory.
+type BreachedPasswordList struct {
+	dir    string
+	ranges map[string]map[string]bool
+}
+
+func loadBreachedPasswords(path string) (*BreachedPasswordList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &BreachedPasswordList{dir: path}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &BreachedPasswordList{ranges: make(map[string]map[string]bool)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash := strings.ToUpper(strings.TrimSpace(strings.SplitN(scanner.Text(), ":", 2)[0]))
+		if len(hash) != sha1.Size*2 {
+			continue
+		}
+		prefix, suffix := hash[:5], hash[5:]
+		if list.ranges[prefix] == nil {
+			list.ranges[prefix] = make(map[string]bool)
+		}
+		list.ranges[prefix][suffix] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return list, nil
+}
+
+func (l *BreachedPasswordList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	if l.ranges != nil {
+		return l.ranges[prefix][suffix], nil
+	}
+
+	file, err := os.Open(filepath.Join(l.dir, prefix+".txt"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.EqualFold(strings.TrimSpace(strings.SplitN(scanner.Text(), ":", 2)[0]), suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// newPasswordRule checks a new password against the policy and the breached
+// password list. Reuse of old passwords is checked separately with
+// passwordRecentlyUsed because it needs the account's history.
+func newPasswordRule(username string) validation.Rule {
+	policyRule := passwordPolicy.Rule(username)
+	return func(value string) string {
+		if message := policyRule(value); message != "" || value == "" {
+			return message
+		}
+		if breachedPasswords != nil {
+			breached, err := breachedPasswords.Contains(value)
+			if err != nil {
+				// An unreadable corpus must not stop people from setting passwords.
+				log.Error("Failed to check breached passwords: ", err)
+			} else if breached {
+				return "This password has appeared in a data breach; please choose another"
+			}
+		}
+		return ""
+	}
+}
+
+// passwordRecentlyUsed reports whether password matches the user's current
+// password or one of the last passwordHistorySize passwords.
+func passwordRecentlyUsed(userID string, password string) (bool, error) {
+	if passwordHistorySize == 0 {
+		return false, nil
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT password FROM users WHERE id = ?
+		UNION ALL
+		(SELECT password_hash FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?)`,
+		userID, userID, passwordHistorySize)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return false, err
+		}
+		if ok, _, err := verifyPassword(hash, password); err == nil && ok {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// recordPasswordHistory remembers a newly set password hash and forgets all
+// but the most recent passwordHistorySize entries.
+func recordPasswordHistory(tx *sql.Tx, userID int64, hashedPassword []byte) error {
+	if _, err := tx.Exec("INSERT INTO password_history (user_id, password_hash) VALUES (?, ?)", userID, hashedPassword); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM password_history WHERE user_id = ? AND id NOT IN (
+		SELECT id FROM (SELECT id FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?) recent)`,
+		userID, userID, passwordHistorySize)
+	return err
+}
+
+func getUsername(userID string) (string, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var username string
+	err = db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	return username, err
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Permissions checked by the application. Roles are granted permissions in
+// the role_permissions table; the names here must match the permissions table.
+const (
+	PermAdminAccess    = "admin:access"
+	PermDeviceWrite    = "device:write"
+	PermOrderRefund    = "order:refund"
+	PermOrderManage    = "order:manage"
+	PermEmailBroadcast = "email:broadcast"
+	PermRoleManage     = "role:manage"
+	PermUserManage     = "user:manage"
+	PermWebhookManage  = "webhook:manage"
+)
+
+// ScopeSelf is an API key scope rather than a permission: it lets the key
+// read the account's own notifications and event stream. Every user may
+// grant it, so keys are useful without any permissions.
+const ScopeSelf = "self"
+
+type Permission struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+const permissionCacheTTL = time.Minute
+
+type cachedPermissions struct {
+	permissions map[string]bool
+	expires     time.Time
+}
+
+var permissionCache = struct {
+	sync.RWMutex
+	entries map[int]cachedPermissions
+}{entries: make(map[int]cachedPermissions)}
+
+// userPermissions returns the union of permissions granted by all of a user's
+// roles; disabled users have none. Results are cached briefly; role changes
+// invalidate the cache.
+func userPermissions(userID int) (map[string]bool, error) {
+	permissionCache.RLock()
+	entry, ok := permissionCache.entries[userID]
+	permissionCache.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.permissions, nil
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT DISTINCT p.name FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		JOIN user_roles ur ON ur.role_id = rp.role_id
+		JOIN users u ON u.id = ur.user_id
+		WHERE ur.user_id = ? AND u.disabled = 0`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		permissions[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	permissionCache.Lock()
+	permissionCache.entries[userID] = cachedPermissions{permissions: permissions, expires: time.Now().Add(permissionCacheTTL)}
+	permissionCache.Unlock()
+	return permissions, nil
+}
+
+func invalidateUserPermissions(userID int) {
+	permissionCache.Lock()
+	delete(permissionCache.entries, userID)
+	permissionCache.Unlock()
+}
+
+func invalidatePermissionCache() {
+	permissionCache.Lock()
+	permissionCache.entries = make(map[int]cachedPermissions)
+	permissionCache.Unlock()
+}
+
+func sortedPermissionNames(permissions map[string]bool) []string {
+	names := make([]string, 0, len(permissions))
+	for name := range permissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasPermission reports whether the request's user holds the permission.
+// Requests made with an API key are further limited to the key's scopes.
+func hasPermission(r *http.Request, permission string) bool {
+	userID, err := strconv.Atoi(getUserIDFromRequest(r))
+	if err != nil {
+		return false
+	}
+
+	permissions, err := userPermissions(userID)
+	if err != nil {
+		log.Error("Failed to load user permissions: ", err)
+		return false
+	}
+	if !permissions[permission] {
+		return false
+	}
+
+	if identity := apiKeyIdentityFromContext(r); identity != nil && !containsString(identity.Scopes, permission) {
+		return false
+	}
+	return true
+}
+
+// RequirePermission wraps a handler so that it only runs for users holding
+// the given permission.
+func RequirePermission(permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			userID := getUserIDFromRequest(r)
+			if userID == "" {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+
+			if !hasPermission(r, permission) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// RequireScope wraps a route so that API keys must carry scope to use it.
+// Signed-in sessions are let through.
+func RequireScope(scope string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if identity := apiKeyIdentityFromContext(r); identity != nil && !containsString(identity.Scopes, scope) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// RequireSession wraps an account route so that it only runs for a signed-in
+// session. API key scopes are permissions, which say nothing about the
+// account itself, so a key cannot be used to change, export or delete it.
+func RequireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKeyIdentityFromContext(r) != nil {
+			http.Error(w, "This action requires signing in; API keys cannot be used", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func getPermissions(db *sql.DB) ([]Permission, error) {
+	rows, err := db.Query("SELECT id, name, description FROM permissions ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions []Permission
+	for rows.Next() {
+		var p Permission
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, rows.Err()
+}
+
+// getRolePermissions maps role IDs to the names of the permissions they grant.
+func getRolePermissions(db *sql.DB) (map[int]map[string]bool, error) {
+	rows, err := db.Query("SELECT rp.role_id, p.name FROM role_permissions rp JOIN permissions p ON p.id = rp.permission_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rolePermissions := make(map[int]map[string]bool)
+	for rows.Next() {
+		var roleID int
+		var name string
+		if err := rows.Scan(&roleID, &name); err != nil {
+			return nil, err
+		}
+		if rolePermissions[roleID] == nil {
+			rolePermissions[roleID] = make(map[string]bool)
+		}
+		rolePermissions[roleID][name] = true
+	}
+	return rolePermissions, rows.Err()
+}
+
+// systemRolePermissions cannot be removed from system roles: without them no
+// one might be left able to open the admin panel or fix the roles.
+var systemRolePermissions = []string{PermAdminAccess, PermRoleManage}
+
+// checkRolePermissionChange returns a forbiddenError if replacing the role's
+// current permissions with requested would grant or remove a permission the
+// acting user does not hold, or strip a system role of one of
+// systemRolePermissions.
+func checkRolePermissionChange(r *http.Request, role Role, current, requested []string) error {
+	changed := make(map[string]bool)
+	for _, name := range current {
+		if !containsString(requested, name) {
+			if role.IsSystem && containsString(systemRolePermissions, name) {
+				return forbiddenError(fmt.Sprintf("%s cannot be removed from the system role %q", name, role.Name))
+			}
+			changed[name] = true
+		}
+	}
+	for _, name := range requested {
+		if !containsString(current, name) {
+			changed[name] = true
+		}
+	}
+	for _, name := range sortedPermissionNames(changed) {
+		if !hasPermission(r, name) {
+			return forbiddenError(fmt.Sprintf("You cannot grant or remove the %s permission, which you do not have", name))
+		}
+	}
+	return nil
+}
+
+func updateRolePermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	roleID, err := strconv.Atoi(r.FormValue("role_id"))
+	if err != nil {
+		log.Println("Invalid role ID: ", err)
+		http.Error(w, "Invalid role ID", http.StatusBadRequest)
+		return
+	}
+	r.ParseForm()
+	names := r.Form["permissions"]
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	role, err := getRole(db, roleID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Role not found", http.StatusNotFound)
+			return
+		}
+		log.Println("Failed to fetch role: ", err)
+		http.Error(w, "Failed to update role permissions", http.StatusInternalServerError)
+		return
+	}
+	current, err := rolePermissionNames(db, roleID)
+	if err != nil {
+		log.Println("Failed to fetch role permissions: ", err)
+		http.Error(w, "Failed to update role permissions", http.StatusInternalServerError)
+		return
+	}
+	if err := checkRolePermissionChange(r, role, current, names); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM role_permissions WHERE role_id = ?", roleID); err != nil {
+		log.Println("Failed to clear role permissions: ", err)
+		http.Error(w, "Failed to update role permissions", http.StatusInternalServerError)
+		return
+	}
+	for _, name := range names {
+		result, err := tx.Exec("INSERT INTO role_permissions (role_id, permission_id) SELECT ?, id FROM permissions WHERE name = ?", roleID, name)
+		if err != nil {
+			log.Println("Failed to grant permission: ", err)
+			http.Error(w, "Failed to update role permissions", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Unknown permission: "+name, http.StatusBadRequest)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update role permissions", http.StatusInternalServerError)
+		return
+	}
+
+	invalidatePermissionCache()
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Email categories. Transactional email (confirmations, password resets,
+// receipts, account notices) is always sent; users can opt out of the others.
+const (
+	emailTransactional = "transactional"
+	emailMarketing     = "marketing"
+	emailProductAlerts = "product_alerts"
+)
+
+// optionalEmailColumns maps the categories users can opt out of to their
+// column in communication_preferences.
+var optionalEmailColumns = map[string]string{
+	emailMarketing:     "marketing",
+	emailProductAlerts: "product_alerts",
+}
+
+const unsubscribePath = "/unsubscribe"
+
+// unsubscribeKey signs unsubscribe links so they work without signing in
+// but cannot be forged for other users.
+var unsubscribeKey = []byte(envOrDefault("UNSUBSCRIBE_SECRET", string(jwtKey)))
+
+// CommunicationPreferences records which optional email a user accepts.
+// Users without a row get everything, as before preferences existed.
+type CommunicationPreferences struct {
+	Marketing     bool
+	ProductAlerts bool
+}
+
+func getCommunicationPreferences(db *sql.DB, userID string) (CommunicationPreferences, error) {
+	prefs := CommunicationPreferences{Marketing: true, ProductAlerts: true}
+	err := db.QueryRow("SELECT marketing, product_alerts FROM communication_preferences WHERE user_id = ?", userID).Scan(&prefs.Marketing, &prefs.ProductAlerts)
+	if err == sql.ErrNoRows {
+		return prefs, nil
+	}
+	return prefs, err
+}
+
+func saveCommunicationPreferences(db *sql.DB, userID string, prefs CommunicationPreferences) error {
+	_, err := db.Exec(`INSERT INTO communication_preferences (user_id, marketing, product_alerts, updated_at) VALUES (?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE marketing = VALUES(marketing), product_alerts = VALUES(product_alerts), updated_at = NOW()`,
+		userID, prefs.Marketing, prefs.ProductAlerts)
+	return err
+}
+
+// optOutCondition is a WHERE clause fragment excluding users, aliased u, who
+// opted out of category.
+func optOutCondition(category string) string {
+	return "NOT EXISTS (SELECT 1 FROM communication_preferences p WHERE p.user_id = u.id AND p." + optionalEmailColumns[category] + " = 0)"
+}
+
+func unsubscribeSignature(userID, category string) string {
+	mac := hmac.New(sha256.New, unsubscribeKey)
+	mac.Write([]byte(userID + ":" + category))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func unsubscribeURL(userID int, category string) string {
+	id := strconv.Itoa(userID)
+	query := url.Values{"u": {id}, "c": {category}, "s": {unsubscribeSignature(id, category)}}
+	return "http://localhost:8080" + unsubscribePath + "?" + query.Encode()
+}
+
+// withUnsubscribe adds List-Unsubscribe headers to an optional email. Mail
+// clients that support RFC 8058 offer a one-click unsubscribe button, which
+// POSTs to the link.
+func withUnsubscribe(msg *Message, userID int, category string) *Message {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string)
+	}
+	msg.Headers["List-Unsubscribe"] = "<" + unsubscribeURL(userID, category) + ">"
+	msg.Headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	return msg
+}
+
+// unsubscribeHandler serves the links in optional email. GET shows a
+// confirmation button, so link scanners that follow every URL do not
+// unsubscribe anyone; POST, from that button or a mail client's one-click
+// unsubscribe, records the opt-out. The signature in the link authenticates
+// the request, so the path is exempt from CSRF checks.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID, category, signature := query.Get("u"), query.Get("c"), query.Get("s")
+	if optionalEmailColumns[category] == "" || !hmac.Equal([]byte(signature), []byte(unsubscribeSignature(userID, category))) {
+		http.Error(w, "Invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+
+	done := false
+	if r.Method == http.MethodPost {
+		dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+		db, err := sql.Open(dbDriver, dsn)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+
+		column := optionalEmailColumns[category]
+		_, err = db.Exec(`INSERT INTO communication_preferences (user_id, `+column+`, updated_at) VALUES (?, 0, NOW())
+			ON DUPLICATE KEY UPDATE `+column+` = 0, updated_at = NOW()`, userID)
+		if err != nil {
+			log.Error("Failed to record unsubscribe: ", err)
+			http.Error(w, "Failed to unsubscribe, please try again later", http.StatusInternalServerError)
+			return
+		}
+		log.WithFields(logrus.Fields{
+			"event":    "email_unsubscribe",
+			"user_id":  userID,
+			"category": category,
+		}).Info("User unsubscribed")
+		done = true
+	}
+
+	data := struct {
+		PageSecurity
+		Category string
+		Action   string
+		Done     bool
+	}{
+		PageSecurity: pageSecurity(r),
+		Category:     category,
+		Action:       unsubscribePath + "?" + r.URL.RawQuery,
+		Done:         done,
+	}
+
+	tmpl, err := template.ParseFiles("pages/unsubscribe.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// communicationPreferencesHandler saves the preferences form on the profile
+// page.
+func communicationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	prefs := CommunicationPreferences{
+		Marketing:     r.FormValue("marketing") == "1",
+		ProductAlerts: r.FormValue("product_alerts") == "1",
+	}
+	if err := saveCommunicationPreferences(db, userID, prefs); err != nil {
+		log.Error("Failed to save communication preferences: ", err)
+		http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"event":          "communication_preferences_updated",
+		"user_id":        userID,
+		"marketing":      prefs.Marketing,
+		"product_alerts": prefs.ProductAlerts,
+	}).Info("Communication preferences updated")
+
+	http.Redirect(w, r, "/user", http.StatusSeeOther)
+}
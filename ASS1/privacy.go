@@ -0,0 +1,488 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// accountDeletionGracePeriod is how long a deletion request can be cancelled
+// before the account is erased.
+const accountDeletionGracePeriod = 14 * 24 * time.Hour
+
+const applicationLogFile = "application.log"
+
+// exportSection is one part of a personal data export: a name used as the
+// JSON key and ZIP entry, and the query selecting the user's rows. Columns
+// holding secrets (password and key hashes, one-time tokens) are left out.
+type exportSection struct {
+	Name  string
+	Query string
+}
+
+var exportSections = []exportSection{
+	{"account", "SELECT id, username, email, confirmed, disabled, password_reset_required FROM users WHERE id = ?"},
+	{"roles", "SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = ?"},
+	{"orders", "SELECT * FROM transactions1 WHERE customer_id = ?"},
+	{"email_changes", "SELECT old_email, new_email, status, created_at, applied_at FROM email_changes WHERE user_id = ?"},
+	{"linked_identities", "SELECT provider, subject, email, created_at FROM user_identities WHERE user_id = ?"},
+	{"api_keys", "SELECT name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at FROM api_keys WHERE user_id = ?"},
+	{"account_deletions", "SELECT requested_at, scheduled_for, cancelled_at, completed_at FROM account_deletions WHERE user_id = ?"},
+	{"communication_preferences", "SELECT marketing, product_alerts, updated_at FROM communication_preferences WHERE user_id = ?"},
+	{"device_interest", "SELECT brand, interactions, last_seen_at FROM device_interest WHERE user_id = ?"},
+	{"email_suppressions", "SELECT s.reason, s.source, s.detail, s.created_at FROM email_suppressions s JOIN users u ON u.email = s.email WHERE u.id = ?"},
+	{"notifications", "SELECT type, title, body, read_at, created_at FROM notifications WHERE user_id = ?"},
+	{"campaign_emails", "SELECT c.subject, cr.email, cr.queued_at, cr.opened_at, cr.clicked_at, cr.click_count FROM campaign_recipients cr JOIN campaigns c ON c.id = cr.campaign_id WHERE cr.user_id = ?"},
+}
+
+// queryRowsAsMaps returns rows as column name to value maps so sections can
+// be exported without a struct per table.
+func queryRowsAsMaps(db *sql.DB, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// collectPersonalData gathers everything stored about a user: database rows,
+// the in-memory cart and application log entries that mention them.
+func collectPersonalData(userID string) (map[string]interface{}, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	data := map[string]interface{}{
+		"exported_at": time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, section := range exportSections {
+		rows, err := queryRowsAsMaps(db, section.Query, userID)
+		if err != nil {
+			return nil, fmt.Errorf("export %s: %w", section.Name, err)
+		}
+		data[section.Name] = rows
+	}
+
+	cartStorage.RLock()
+	data["cart"] = append([]Device{}, cartStorage.carts[userID]...)
+	cartStorage.RUnlock()
+
+	username := ""
+	if accounts, ok := data["account"].([]map[string]interface{}); ok && len(accounts) == 1 {
+		username, _ = accounts[0]["username"].(string)
+	}
+	entries, err := userLogEntries(applicationLogFile, userID, username)
+	if err != nil {
+		return nil, fmt.Errorf("export logs: %w", err)
+	}
+	data["log_entries"] = entries
+	return data, nil
+}
+
+// userLogEntries returns the JSON log lines that refer to the user by ID, or
+// by username for login throttling events.
+func userLogEntries(path, userID, username string) ([]map[string]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []map[string]interface{}{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []map[string]interface{}{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if fmt.Sprint(entry["user_id"]) == userID ||
+			(username != "" && entry["kind"] == "username" && entry["key"] == username) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// dataExportHandler serves GET /user/data-export as a ZIP archive with one
+// JSON file per section, or as a single JSON document with ?format=json.
+func dataExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	data, err := collectPersonalData(userID)
+	if err != nil {
+		log.Error("Failed to collect personal data: ", err)
+		http.Error(w, "Failed to export your data", http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(logrus.Fields{"event": "data_export", "user_id": userID}).Info("Personal data exported")
+
+	filename := "my-data-" + time.Now().Format("20060102")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	if err := writeDataExportZip(w, data); err != nil {
+		log.Error("Failed to write data export archive: ", err)
+	}
+}
+
+func writeDataExportZip(w http.ResponseWriter, data map[string]interface{}) error {
+	archive := zip.NewWriter(w)
+	for name, value := range data {
+		entry, err := archive.Create(name + ".json")
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(entry)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(value); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// getPendingAccountDeletion returns when the user's account is scheduled to
+// be erased, or "" if no deletion is pending.
+func getPendingAccountDeletion(userID string) (string, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var scheduledFor string
+	err = db.QueryRow("SELECT scheduled_for FROM account_deletions WHERE user_id = ? AND cancelled_at IS NULL AND completed_at IS NULL", userID).Scan(&scheduledFor)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return scheduledFor, err
+}
+
+// requestAccountDeletionHandler schedules the signed-in user's account for
+// erasure after the grace period. The user confirms by typing their username.
+func requestAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var username, email string
+	if err := db.QueryRow("SELECT username, email FROM users WHERE id = ?", userID).Scan(&username, &email); err != nil {
+		log.Error("Failed to retrieve user: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("confirm") != username {
+		http.Error(w, "Type your username to confirm account deletion", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// A previous, cancelled request is replaced rather than duplicated.
+	_, err = tx.Exec(`INSERT INTO account_deletions (user_id, requested_at, scheduled_for) VALUES (?, NOW(), DATE_ADD(NOW(), INTERVAL ? SECOND))
+		ON DUPLICATE KEY UPDATE requested_at = IF(cancelled_at IS NULL, requested_at, NOW()),
+			scheduled_for = IF(cancelled_at IS NULL, scheduled_for, VALUES(scheduled_for)),
+			cancelled_at = NULL`,
+		userID, int(accountDeletionGracePeriod.Seconds()))
+	if err != nil {
+		log.Error("Failed to schedule account deletion: ", err)
+		http.Error(w, "Failed to schedule account deletion", http.StatusInternalServerError)
+		return
+	}
+
+	msg, err := newTemplatedEmail(email, "account_deletion", requestLocales(r), map[string]interface{}{
+		"Username": username,
+		"Days":     int(accountDeletionGracePeriod / (24 * time.Hour)),
+	})
+	if err == nil {
+		err = enqueueEmail(tx, msg)
+	}
+	if err != nil {
+		log.Error("Failed to queue account deletion notice: ", err)
+		http.Error(w, "Failed to schedule account deletion", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("Failed to commit account deletion request: ", err)
+		http.Error(w, "Failed to schedule account deletion", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(logrus.Fields{"event": "account_deletion_requested", "user_id": userID}).Info("Account deletion requested")
+
+	http.Redirect(w, r, "/user", http.StatusSeeOther)
+}
+
+func cancelAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("UPDATE account_deletions SET cancelled_at = NOW() WHERE user_id = ? AND cancelled_at IS NULL AND completed_at IS NULL", userID); err != nil {
+		log.Error("Failed to cancel account deletion: ", err)
+		http.Error(w, "Failed to cancel account deletion", http.StatusInternalServerError)
+		return
+	}
+	log.WithFields(logrus.Fields{"event": "account_deletion_cancelled", "user_id": userID}).Info("Account deletion cancelled")
+
+	http.Redirect(w, r, "/user", http.StatusSeeOther)
+}
+
+// startAccountDeletionWorker erases accounts whose grace period has ended,
+// checking once per interval.
+func startAccountDeletionWorker(interval time.Duration) {
+	go func() {
+		for {
+			if err := processDueAccountDeletions(); err != nil {
+				log.Error("Failed to process account deletions: ", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func processDueAccountDeletions() error {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, user_id FROM account_deletions WHERE cancelled_at IS NULL AND completed_at IS NULL AND scheduled_for <= NOW()")
+	if err != nil {
+		return err
+	}
+	type dueDeletion struct{ id, userID int }
+	var due []dueDeletion
+	for rows.Next() {
+		var d dueDeletion
+		if err := rows.Scan(&d.id, &d.userID); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		if err := eraseAccount(db, d.id, d.userID); err != nil {
+			log.Error("Failed to erase account ", d.userID, ": ", err)
+			continue
+		}
+		log.WithFields(logrus.Fields{"event": "account_erased", "user_id": d.userID}).Info("Account erased")
+	}
+	return nil
+}
+
+// eraseAccount deletes a user's personal data. Orders in transactions1 must
+// be kept for accounting, so the users row they reference is anonymized and
+// disabled instead of deleted; nothing left in it identifies the person.
+func eraseAccount(db *sql.DB, deletionID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"user_roles", "email_changes", "user_identities", "api_keys", "password_resets", "password_history", "device_interest", "campaign_recipients", "communication_preferences", "notifications"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID); err != nil {
+			return fmt.Errorf("delete from %s: %w", table, err)
+		}
+	}
+	// Suppressions and queued email are keyed by address, so they go before
+	// it is anonymized.
+	var email string
+	if err := tx.QueryRow("SELECT email FROM users WHERE id = ? FOR UPDATE", userID).Scan(&email); err != nil {
+		return fmt.Errorf("load user: %w", err)
+	}
+	if err := eraseOutboxRecipient(tx, email); err != nil {
+		return fmt.Errorf("scrub email_outbox: %w", err)
+	}
+	if _, err := tx.Exec("DELETE s FROM email_suppressions s JOIN users u ON u.email = s.email WHERE u.id = ?", userID); err != nil {
+		return fmt.Errorf("delete from email_suppressions: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE users SET username = CONCAT('deleted-', id), email = CONCAT('deleted-', id, '@invalid'),
+		password = '', token = '', token_expires_at = NULL, confirmed = 0, disabled = 1, password_reset_required = 0
+		WHERE id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("anonymize user: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE account_deletions SET completed_at = NOW() WHERE id = ?", deletionID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	cartStorage.Lock()
+	delete(cartStorage.carts, strconv.Itoa(userID))
+	cartStorage.Unlock()
+	invalidateUserPermissions(userID)
+	return nil
+}
+
+type AccountDeletion struct {
+	UserID       int
+	Username     string
+	Email        string
+	RequestedAt  string
+	ScheduledFor string
+	CompletedAt  string
+}
+
+// adminErasuresHandler lists pending deletion requests and the most recent
+// completed ones.
+func adminErasuresHandler(w http.ResponseWriter, r *http.Request) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	query := func(where string) ([]AccountDeletion, error) {
+		rows, err := db.Query(`SELECT d.user_id, u.username, u.email, d.requested_at, d.scheduled_for, d.completed_at
+			FROM account_deletions d JOIN users u ON u.id = d.user_id
+			WHERE ` + where)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var deletions []AccountDeletion
+		for rows.Next() {
+			var d AccountDeletion
+			var completedAt sql.NullString
+			if err := rows.Scan(&d.UserID, &d.Username, &d.Email, &d.RequestedAt, &d.ScheduledFor, &completedAt); err != nil {
+				return nil, err
+			}
+			d.CompletedAt = completedAt.String
+			deletions = append(deletions, d)
+		}
+		return deletions, rows.Err()
+	}
+
+	pending, err := query("d.cancelled_at IS NULL AND d.completed_at IS NULL ORDER BY d.scheduled_for")
+	if err != nil {
+		log.Println("Failed to fetch pending deletions: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	completed, err := query("d.completed_at IS NOT NULL ORDER BY d.completed_at DESC LIMIT 20")
+	if err != nil {
+		log.Println("Failed to fetch completed deletions: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Pending   []AccountDeletion
+		Completed []AccountDeletion
+	}{
+		PageSecurity: pageSecurity(r),
+		Pending:      pending,
+		Completed:    completed,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_erasures.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
-	"crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/go-gomail/gomail"
-	"golang.org/x/crypto/bcrypt"
+	"ASS1/validation"
+
+	"github.com/sirupsen/logrus"
 )
 
 func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
@@ -20,12 +24,38 @@ func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
-		if !validateCurrentPassword(userID, currentPassword) {
-			http.Error(w, "Invalid current password", http.StatusBadRequest)
+
+		username, err := getUsername(userID)
+		if err != nil {
+			log.Error("Failed to retrieve username: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		errs := validation.Validate(
+			validation.Field("current-password", currentPassword, validation.Required),
+			validation.Field("new-password", newPassword, validation.Required, newPasswordRule(username)),
+		)
+		if !errs.Any() && !validateCurrentPassword(userID, currentPassword) {
+			errs.Add("current-password", "Invalid current password")
+		}
+		if !errs.Any() {
+			reused, err := passwordRecentlyUsed(userID, newPassword)
+			if err != nil {
+				log.Error("Failed to check password history: ", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if reused {
+				errs.Add("new-password", "Choose a password you have not used recently")
+			}
+		}
+		if errs.Any() {
+			rejectInput(w, r, errs, renderUserProfile)
 			return
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+		hashedPassword, err := hashPassword(newPassword)
 		if err != nil {
 			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
 			return
@@ -59,8 +89,12 @@ func validateCurrentPassword(userID string, currentPassword string) bool {
 		return false
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(currentPassword))
+	ok, _, err := verifyPassword(hashedPassword, currentPassword)
 	if err != nil {
+		log.Error("Failed to verify password: ", err)
+		return false
+	}
+	if !ok {
 		log.Println("Invalid password")
 		return false
 	}
@@ -78,27 +112,58 @@ func updatePasswordInDatabase(userID string, hashedPassword []byte) error {
 	}
 	defer db.Close()
 
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := "UPDATE users SET password = ? WHERE id = ?"
-	_, err = db.Exec(query, hashedPassword, userID)
+	_, err = tx.Exec(query, hashedPassword, id)
 	if err != nil {
 		log.Error("Failed to update password in database: ", err)
 		return err
 	}
+	if err := recordPasswordHistory(tx, id, hashedPassword); err != nil {
+		log.Error("Failed to record password history: ", err)
+		return err
+	}
 
-	return nil
+	return tx.Commit()
 }
 
+const (
+	emailChangeTTL       = 24 * time.Hour
+	emailChangeRevertTTL = 7 * 24 * time.Hour
+)
+
 func changeEmailHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		newEmail := r.FormValue("new-email")
+		newEmail := strings.TrimSpace(r.FormValue("new-email"))
 
 		userID := getUserIDFromRequest(r)
 		if userID == "" {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
-		if err := updateEmailInDatabase(userID, newEmail); err != nil {
-			http.Error(w, "Failed to update email", http.StatusInternalServerError)
+
+		errs := validation.Validate(validation.Field("new-email", newEmail, validation.Required, validation.Email))
+		if errs.Any() {
+			rejectInput(w, r, errs, renderUserProfile)
+			return
+		}
+
+		if err := requestEmailChange(userID, newEmail, requestLocales(r)); err != nil {
+			if err == errEmailInUse || err == errEmailUnchanged {
+				rejectInput(w, r, validation.Errors{"new-email": err.Error()}, renderUserProfile)
+				return
+			}
+			http.Error(w, "Failed to request email change", http.StatusInternalServerError)
 			return
 		}
 
@@ -108,8 +173,14 @@ func changeEmailHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 }
 
-func updateEmailInDatabase(userID string, newEmail string) error {
+var (
+	errEmailInUse     = errors.New("Email address is already in use")
+	errEmailUnchanged = errors.New("New email address matches the current one")
+)
 
+// requestEmailChange records a pending change and notifies both addresses.
+// users.email is not touched until the new address is confirmed.
+func requestEmailChange(userID string, newEmail string, locales []string) error {
 	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
 	db, err := sql.Open(dbDriver, dsn)
 	if err != nil {
@@ -118,76 +189,221 @@ func updateEmailInDatabase(userID string, newEmail string) error {
 	}
 	defer db.Close()
 
-	query := "UPDATE users SET email = ? WHERE id = ?"
-	_, err = db.Exec(query, newEmail, userID)
+	var oldEmail string
+	err = db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&oldEmail)
 	if err != nil {
-		log.Error("Failed to update email in database: ", err)
+		log.Error("Failed to retrieve current email: ", err)
 		return err
 	}
+	if strings.EqualFold(oldEmail, newEmail) {
+		return errEmailUnchanged
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? AND id <> ?", newEmail, userID).Scan(&count)
+	if err != nil {
+		log.Error("Failed to check email uniqueness: ", err)
+		return err
+	}
+	if count > 0 {
+		return errEmailInUse
+	}
 
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+	revertToken, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the latest request stays valid.
+	_, err = tx.Exec("UPDATE email_changes SET status = 'superseded' WHERE user_id = ? AND status = 'pending'", userID)
+	if err != nil {
+		log.Error("Failed to supersede pending email changes: ", err)
+		return err
+	}
+
+	query := `INSERT INTO email_changes (user_id, old_email, new_email, token, revert_token, expires_at, revert_expires_at)
+		VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND), DATE_ADD(NOW(), INTERVAL ? SECOND))`
+	_, err = tx.Exec(query, userID, oldEmail, newEmail, token, revertToken, int(emailChangeTTL.Seconds()), int(emailChangeRevertTTL.Seconds()))
+	if err != nil {
+		log.Error("Failed to record email change: ", err)
+		return err
+	}
+
+	confirmation, err := newTemplatedEmail(newEmail, "email_change_confirm", locales, map[string]interface{}{
+		"Link":     "http://localhost:8080/change-email/confirm?token=" + token,
+		"NewEmail": newEmail,
+	})
+	if err == nil {
+		err = enqueueEmail(tx, confirmation)
+	}
+	if err != nil {
+		log.Error("Failed to queue email change confirmation: ", err)
+		return err
+	}
+
+	notice, err := newTemplatedEmail(oldEmail, "email_change_notice", locales, map[string]interface{}{
+		"Link":     "http://localhost:8080/change-email/revert?token=" + revertToken,
+		"NewEmail": newEmail,
+	})
+	if err == nil {
+		err = enqueueEmail(tx, notice)
+	}
+	if err != nil {
+		log.Error("Failed to queue email change notice: ", err)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error("Failed to commit email change: ", err)
+		return err
+	}
 	return nil
 }
 
-func sendEmailHandler(w http.ResponseWriter, r *http.Request) {
-	discount := r.FormValue("discount")
+func confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
 
-	userEmails, err := getAllUserEmails()
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
 	if err != nil {
-		log.Println("Failed to fetch user emails: ", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	defer db.Close()
 
-	for _, email := range userEmails {
-		err := sendEmail(email, discount)
-		if err != nil {
-			log.Println("Failed to send email to ", email, ": ", err)
-		}
+	switch err := applyEmailChange(db, token); err {
+	case nil:
+		fmt.Fprintln(w, "Your email address has been updated.")
+	case sql.ErrNoRows:
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+	case errEmailInUse:
+		http.Error(w, "That email address is already in use.", http.StatusConflict)
+	default:
+		http.Error(w, "Failed to update email", http.StatusInternalServerError)
 	}
-
-	http.Redirect(w, r, "/admin", http.StatusSeeOther)
 }
 
-func sendEmail(email, discount string) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", "sagidolla04@internet.ru") //
-	m.SetHeader("To", email)
-	m.SetHeader("Subject", "Special Discount Offer")
-	m.SetBody("text/html", fmt.Sprintf("Dear user,<br><br>We are pleased to offer you a special discount: %s.<br><br>Best regards,<br>Device Shop", discount))
+// applyEmailChange applies the pending change confirmed by token. The
+// address was free when the change was requested, but another account may
+// have taken it since, so it is checked again with the rows locked. It
+// returns sql.ErrNoRows for an unknown or expired token and errEmailInUse
+// when the address is taken.
+func applyEmailChange(db *sql.DB, token string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var changeID, userID int
+	var newEmail string
+	err = tx.QueryRow("SELECT id, user_id, new_email FROM email_changes WHERE token = ? AND status = 'pending' AND expires_at > NOW() FOR UPDATE", token).Scan(&changeID, &userID, &newEmail)
+	if err != nil {
+		return err
+	}
 
-	d := gomail.NewDialer("smtp.mail.ru", 587, "esagidolla04@internet.ru", "HBthmWAUUQ4JS7AvsK5v")
-	d.TLSConfig = &tls.Config{ServerName: "smtp.mail.ru"}
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? AND id <> ? FOR UPDATE", newEmail, userID).Scan(&count); err != nil {
+		log.Error("Failed to check email uniqueness: ", err)
+		return err
+	}
+	if count > 0 {
+		return errEmailInUse
+	}
 
-	if err := d.DialAndSend(m); err != nil {
+	if _, err := tx.Exec("UPDATE users SET email = ? WHERE id = ?", newEmail, userID); err != nil {
+		log.Error("Failed to update email in database: ", err)
 		return err
 	}
-	return nil
+	if _, err := tx.Exec("UPDATE email_changes SET status = 'applied', applied_at = NOW() WHERE id = ?", changeID); err != nil {
+		log.Error("Failed to mark email change as applied: ", err)
+		return err
+	}
+	return tx.Commit()
 }
-func getAllUserEmails() ([]string, error) {
+
+func revertEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
 	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
 	db, err := sql.Open(dbDriver, dsn)
 	if err != nil {
-		return nil, err
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT email FROM users")
+	var changeID, userID int
+	var oldEmail, newEmail, status string
+	err = db.QueryRow("SELECT id, user_id, old_email, new_email, status FROM email_changes WHERE revert_token = ? AND status IN ('pending', 'applied') AND revert_expires_at > NOW()", token).Scan(&changeID, &userID, &oldEmail, &newEmail, &status)
 	if err != nil {
-		return nil, err
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
 	}
-	defer rows.Close()
 
-	var userEmails []string
-	for rows.Next() {
-		var email string
-		if err := rows.Scan(&email); err != nil {
-			return nil, err
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if status == "applied" {
+		_, err = tx.Exec("UPDATE users SET email = ? WHERE id = ? AND email = ?", oldEmail, userID, newEmail)
+		if err != nil {
+			log.Error("Failed to restore email in database: ", err)
+			http.Error(w, "Failed to revert email change", http.StatusInternalServerError)
+			return
 		}
-		userEmails = append(userEmails, email)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	if _, err := tx.Exec("UPDATE email_changes SET status = 'reverted' WHERE id = ?", changeID); err != nil {
+		log.Error("Failed to mark email change as reverted: ", err)
+		http.Error(w, "Failed to revert email change", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to revert email change", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":   "email_change_reverted",
+		"user_id": userID,
+	}).Warn("Email change reverted from the old address")
+
+	fmt.Fprintln(w, "The email change has been cancelled. Your account keeps the address "+oldEmail+". We recommend changing your password.")
+}
+
+func getPendingEmailChange(userID string) (string, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return "", err
 	}
+	defer db.Close()
 
-	return userEmails, nil
+	var newEmail string
+	err = db.QueryRow("SELECT new_email FROM email_changes WHERE user_id = ? AND status = 'pending' AND expires_at > NOW() ORDER BY id DESC LIMIT 1", userID).Scan(&newEmail)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return newEmail, err
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// RateLimitPolicy is a token bucket: Burst requests may be made at once and
+// the bucket refills at Requests per Period.
+type RateLimitPolicy struct {
+	Requests int    `json:"requests"`
+	Period   string `json:"period"`
+	Burst    int    `json:"burst"`
+	// By selects the bucket key: "client" (the default) uses the API key,
+	// then the signed-in user, then the IP address; "ip" always uses the IP.
+	By string `json:"by"`
+
+	period time.Duration
+}
+
+func (p *RateLimitPolicy) normalize() error {
+	period, err := time.ParseDuration(p.Period)
+	if err != nil {
+		return fmt.Errorf("invalid period %q", p.Period)
+	}
+	if p.Requests <= 0 || period <= 0 {
+		return fmt.Errorf("requests and period must be positive")
+	}
+	if p.Burst <= 0 {
+		p.Burst = p.Requests
+	}
+	switch p.By {
+	case "":
+		p.By = "client"
+	case "client", "ip":
+	default:
+		return fmt.Errorf("unknown key %q", p.By)
+	}
+	p.period = period
+	return nil
+}
+
+// refillRate returns the number of tokens added per second.
+func (p RateLimitPolicy) refillRate() float64 {
+	return float64(p.Requests) / p.period.Seconds()
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request would be allowed; zero
+	// when Allowed is true.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore holds the token buckets. The in-memory store is used by
+// default; instances behind a load balancer can share limits by providing an
+// implementation backed by a shared database or cache.
+type RateLimitStore interface {
+	Take(key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error)
+}
+
+type rateLimitBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// memoryRateLimitStore keeps at most capacity buckets, evicting the least
+// recently used one when full. Buckets idle for longer than idleTTL are
+// dropped as they reach the end of the list; with idleTTL at least as long as
+// the slowest bucket takes to refill, forgetting them changes no client's limit.
+type memoryRateLimitStore struct {
+	mu       sync.Mutex
+	capacity int
+	idleTTL  time.Duration
+	order    *list.List
+	buckets  map[string]*list.Element
+}
+
+func newMemoryRateLimitStore(capacity int, idleTTL time.Duration) *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		capacity: capacity,
+		idleTTL:  idleTTL,
+		order:    list.New(),
+		buckets:  make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryRateLimitStore) Take(key string, policy RateLimitPolicy, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evictIdle(now)
+
+	var bucket *rateLimitBucket
+	if elem, ok := s.buckets[key]; ok {
+		bucket = elem.Value.(*rateLimitBucket)
+		s.order.MoveToFront(elem)
+	} else {
+		if s.order.Len() >= s.capacity {
+			s.remove(s.order.Back())
+		}
+		bucket = &rateLimitBucket{key: key, tokens: float64(policy.Burst), last: now}
+		s.buckets[key] = s.order.PushFront(bucket)
+	}
+
+	rate := policy.refillRate()
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(float64(policy.Burst), bucket.tokens+elapsed*rate)
+	}
+	bucket.last = now
+
+	result := RateLimitResult{Limit: policy.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - bucket.tokens) / rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = secondsToDuration((float64(policy.Burst) - bucket.tokens) / rate)
+	return result, nil
+}
+
+func (s *memoryRateLimitStore) evictIdle(now time.Time) {
+	for elem := s.order.Back(); elem != nil; elem = s.order.Back() {
+		if now.Sub(elem.Value.(*rateLimitBucket).last) < s.idleTTL {
+			return
+		}
+		s.remove(elem)
+	}
+}
+
+func (s *memoryRateLimitStore) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.buckets, elem.Value.(*rateLimitBucket).key)
+}
+
+func (s *memoryRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// RateLimiter applies a policy per route (keyed by the mux path template)
+// and falls back to Default for routes without one.
+type RateLimiter struct {
+	Store   RateLimitStore
+	Default RateLimitPolicy
+	Routes  map[string]RateLimitPolicy
+}
+
+func defaultRateLimits() (RateLimitPolicy, map[string]RateLimitPolicy) {
+	defaults := RateLimitPolicy{Requests: 120, Period: "1m", Burst: 60}
+	routes := map[string]RateLimitPolicy{
+		"/":                {Requests: 1, Period: "1s", Burst: 10},
+		"/json":            {Requests: 1, Period: "1s", Burst: 10},
+		"/login":           {Requests: 20, Period: "1m", Burst: 10, By: "ip"},
+		"/register":        {Requests: 10, Period: "1m", Burst: 5, By: "ip"},
+		"/csp-report":      {Requests: 30, Period: "1m", By: "ip"},
+		"/api-keys":        {Requests: 10, Period: "1m"},
+		"/process-payment": {Requests: 10, Period: "1m"},
+	}
+	return defaults, routes
+}
+
+// loadRateLimiter builds the limiter from the built-in policies, overridden by
+// the optional JSON file at path:
+//
+//	{"default": {"requests": 120, "period": "1m"},
+//	 "routes": {"/login": {"requests": 5, "period": "1m", "by": "ip"}}}
+func loadRateLimiter(path string, store RateLimitStore) (*RateLimiter, error) {
+	limiter := &RateLimiter{Store: store}
+	limiter.Default, limiter.Routes = defaultRateLimits()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var config struct {
+			Default *RateLimitPolicy           `json:"default"`
+			Routes  map[string]RateLimitPolicy `json:"routes"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if config.Default != nil {
+			limiter.Default = *config.Default
+		}
+		for route, policy := range config.Routes {
+			limiter.Routes[route] = policy
+		}
+	}
+
+	if err := limiter.Default.normalize(); err != nil {
+		return nil, fmt.Errorf("default rate limit: %w", err)
+	}
+	for route, policy := range limiter.Routes {
+		if err := policy.normalize(); err != nil {
+			return nil, fmt.Errorf("rate limit for %s: %w", route, err)
+		}
+		limiter.Routes[route] = policy
+	}
+	return limiter, nil
+}
+
+func (l *RateLimiter) policyFor(r *http.Request) (string, RateLimitPolicy) {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			if policy, ok := l.Routes[template]; ok {
+				return template, policy
+			}
+		}
+	}
+	return "default", l.Default
+}
+
+// Middleware must be installed with Router.Use so the matched route is known.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, policy := l.policyFor(r)
+		key := name + "|" + rateLimitKey(r, policy)
+
+		result, err := l.Store.Take(key, policy, time.Now())
+		if err != nil {
+			// Fail open: an unavailable shared store must not take the site down.
+			log.Error("Rate limit store failed: ", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", policy.Requests, ceilSeconds(policy.period), policy.Burst))
+
+		if !result.Allowed {
+			log.WithFields(logrus.Fields{
+				"event": "rate_limited",
+				"route": name,
+				"key":   key,
+			}).Warn("Request rate limited")
+			header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimitKey identifies the client. It runs before authMiddleware, so an
+// API key only gets its own bucket once it has authenticated; until then,
+// and for made-up keys, requests count against the client's IP.
+func rateLimitKey(r *http.Request, policy RateLimitPolicy) string {
+	if policy.By == "client" {
+		if key := apiKeyFromRequest(r); key != "" {
+			if prefix, ok := verifiedAPIKeyPrefix(key); ok {
+				return "key:" + prefix
+			}
+			return "ip:" + clientIP(r)
+		}
+		if userID := sessionUserID(r); userID != 0 {
+			return "user:" + strconv.Itoa(userID)
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// sessionUserID returns the user ID from a valid session cookie, or 0.
+func sessionUserID(r *http.Request) int {
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		return 0
+	}
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(cookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		return jwtKey, nil
+	})
+	if err != nil || !token.Valid {
+		return 0
+	}
+	return claims.UserID
+}
@@ -5,11 +5,15 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"html/template"
 	"net/http"
-	"net/smtp"
+	"strings"
+	"sync"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"ASS1/validation"
+
+	"golang.org/x/time/rate"
 )
 
 type User struct {
@@ -20,8 +24,23 @@ type User struct {
 	Token     string    `json:"token"`
 	Confirmed bool      `json:"confirmed"`
 	CreatedAt time.Time `json:"created_at"`
+
+	Disabled              bool `json:"disabled"`
+	PasswordResetRequired bool `json:"password_reset_required"`
 }
 
+const confirmationTokenTTL = 24 * time.Hour
+
+// Confirmation resends are limited per key to one every resendInterval with
+// a burst of resendBurst. A limiter unused for resendIdleTimeout is full
+// again, so it is dropped rather than kept forever.
+const (
+	resendInterval      = 5 * time.Minute
+	resendBurst         = 3
+	resendIdleTimeout   = resendInterval * resendBurst
+	resendSweepInterval = time.Minute
+)
+
 const (
 	dbDriver = "mysql"
 	dbUser   = "sql12709748"
@@ -31,20 +50,25 @@ const (
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		http.ServeFile(w, r, "pages/register.html")
+		renderRegisterForm(w, r, http.StatusOK, User{}, nil)
 		return
 	} else if r.Method == "POST" {
 		var user User
-		user.Username = r.FormValue("username")
-		user.Email = r.FormValue("email")
+		user.Username = strings.TrimSpace(r.FormValue("username"))
+		user.Email = strings.TrimSpace(r.FormValue("email"))
 		password := r.FormValue("password")
 
-		if user.Username == "" || user.Email == "" || password == "" {
-			http.Error(w, "Missing required fields", http.StatusBadRequest)
+		errs := validation.Validate(
+			validation.Field("username", user.Username, validation.Required, validation.Username),
+			validation.Field("email", user.Email, validation.Required, validation.Email),
+			validation.Field("password", password, validation.Required, newPasswordRule(user.Username)),
+		)
+		if errs.Any() {
+			renderRegisterForm(w, r, http.StatusBadRequest, user, errs)
 			return
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hashedPassword, err := hashPassword(password)
 		if err != nil {
 			log.Println("Error generating hashed password:", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -68,8 +92,20 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer db.Close()
 
-		query := "INSERT INTO users (username, email, password, token, confirmed) VALUES (?, ?, ?, ?, 0)"
-		result, err := db.Exec(query, user.Username, user.Email, user.Password, user.Token)
+		tx, err := db.Begin()
+		if err != nil {
+			log.Println("Error starting transaction:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		query := "INSERT INTO users (username, email, password, token, token_expires_at, confirmed) VALUES (?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND), 0)"
+		result, err := tx.Exec(query, user.Username, user.Email, user.Password, user.Token, int(confirmationTokenTTL.Seconds()))
+		if isDuplicateKeyError(err) {
+			renderRegisterForm(w, r, http.StatusBadRequest, user, validation.Errors{"username": "Username or email address is already registered"})
+			return
+		}
 		if err != nil {
 			log.Println("Error executing insert query:", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -77,17 +113,32 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		userID, err := result.LastInsertId()
 		if err != nil {
-
+			log.Println("Error reading new user ID:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
-		defaultRoleID := 2
-		query = "INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)"
-		_, err = db.Exec(query, userID, defaultRoleID)
-		if err != nil {
+		if err := assignDefaultRole(tx, userID); err != nil {
+			log.Println("Error assigning default role:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := recordPasswordHistory(tx, userID, hashedPassword); err != nil {
+			log.Println("Error recording password history:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		msg, err := confirmationEmail(user.Email, user.Token, requestLocales(r))
+		if err == nil {
+			err = enqueueEmail(tx, msg)
 		}
-		err = sendConfirmationEmail(user.Email, user.Token)
 		if err != nil {
-			log.Println("Error sending confirmation email:", err)
-			http.Error(w, "Failed to send confirmation email", http.StatusInternalServerError)
+			log.Println("Error queueing confirmation email:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Println("Error committing registration:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
@@ -98,6 +149,46 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 }
 
+const defaultRoleName = "user"
+
+// assignDefaultRole gives a newly created user the default role, looked up by
+// name so it does not depend on the role's ID in a particular database.
+func assignDefaultRole(tx *sql.Tx, userID int64) error {
+	var roleID int
+	if err := tx.QueryRow("SELECT id FROM roles WHERE name = ?", defaultRoleName).Scan(&roleID); err != nil {
+		return fmt.Errorf("look up default role %q: %w", defaultRoleName, err)
+	}
+	_, err := tx.Exec("INSERT INTO user_roles (user_id, role_id) VALUES (?, ?)", userID, roleID)
+	return err
+}
+
+// renderRegisterForm shows the registration form, refilled with the submitted
+// values (never the password) and any field errors.
+func renderRegisterForm(w http.ResponseWriter, r *http.Request, status int, user User, errs validation.Errors) {
+	tmpl, err := template.ParseFiles("pages/register.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Username string
+		Email    string
+		Errors   validation.Errors
+	}{
+		PageSecurity: pageSecurity(r),
+		Username:     user.Username,
+		Email:        user.Email,
+		Errors:       errs,
+	}
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println("Failed to render template:", err)
+	}
+}
+
 func generateToken(length int) (string, error) {
 	bytes := make([]byte, length)
 	if _, err := rand.Read(bytes); err != nil {
@@ -106,26 +197,18 @@ func generateToken(length int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-func sendConfirmationEmail(email, token string) error {
-	from := "sagidolla04@internet.ru"
-	password := "HBthmWAUUQ4JS7AvsK5v"
-	to := email
-	smtpHost := "smtp.mail.ru"
-	smtpPort := "587"
-
-	msg := "From: " + from + "\n" +
-		"To: " + to + "\n" +
-		"Subject: Confirm your email address\n\n" +
-		"Please click the link to confirm your email address: " +
-		"http://localhost:8080/confirm?token=" + token
-
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, []string{to}, []byte(msg))
-	return err
+func confirmationEmail(email, token string, locales []string) (*Message, error) {
+	return newTemplatedEmail(email, "confirm_email", locales, map[string]interface{}{
+		"Link": "http://localhost:8080/confirm?token=" + token,
+	})
 }
 
 func confirmHandler(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
 
 	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
 	db, err := sql.Open(dbDriver, dsn)
@@ -136,13 +219,20 @@ func confirmHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	var userID int
-	err = db.QueryRow("SELECT id FROM users WHERE token = ?", token).Scan(&userID)
+	var expired bool
+	// Tokens issued before expiry was tracked have no expiry and are treated
+	// as expired; the user can request a new link.
+	err = db.QueryRow("SELECT id, token_expires_at IS NULL OR token_expires_at < NOW() FROM users WHERE token = ? AND confirmed = 0", token).Scan(&userID, &expired)
 	if err != nil {
 		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
 		return
 	}
+	if expired {
+		http.Error(w, "This confirmation link has expired. Please request a new one at /confirm/resend.", http.StatusBadRequest)
+		return
+	}
 
-	_, err = db.Exec("UPDATE users SET confirmed = 1 WHERE id = ?", userID)
+	_, err = db.Exec("UPDATE users SET confirmed = 1, token = '', token_expires_at = NULL WHERE id = ?", userID)
 	if err != nil {
 		http.Error(w, "Failed to confirm email", http.StatusInternalServerError)
 		return
@@ -150,3 +240,127 @@ func confirmHandler(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, "/login?confirmation=success", http.StatusSeeOther)
 }
+
+type resendLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+var resendLimiters = struct {
+	sync.Mutex
+	limiters  map[string]*resendLimiter
+	lastSweep time.Time
+}{limiters: make(map[string]*resendLimiter)}
+
+// allowResend rate limits confirmation resends per key, so the endpoint
+// cannot be used to flood an inbox.
+func allowResend(key string, now time.Time) bool {
+	resendLimiters.Lock()
+	defer resendLimiters.Unlock()
+
+	if now.Sub(resendLimiters.lastSweep) >= resendSweepInterval {
+		for k, l := range resendLimiters.limiters {
+			if now.Sub(l.lastUsed) >= resendIdleTimeout {
+				delete(resendLimiters.limiters, k)
+			}
+		}
+		resendLimiters.lastSweep = now
+	}
+
+	l, ok := resendLimiters.limiters[key]
+	if !ok {
+		l = &resendLimiter{limiter: rate.NewLimiter(rate.Every(resendInterval), resendBurst)}
+		resendLimiters.limiters[key] = l
+	}
+	l.lastUsed = now
+	return l.limiter.AllowN(now, 1)
+}
+
+func resendConfirmationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		tmpl, err := template.ParseFiles("pages/resend_confirmation.html")
+		if err != nil {
+			http.Error(w, "Failed to load template", http.StatusInternalServerError)
+			return
+		}
+
+		err = tmpl.Execute(w, pageSecurity(r))
+		if err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if !allowResend("ip:"+clientIP(r), now) || !allowResend("email:"+email, now) {
+		http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// Always answer the same way so the endpoint does not reveal which emails are registered.
+	const done = "If an unconfirmed account exists for that address, a new confirmation link has been sent."
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Error opening database connection:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var userID int
+	err = db.QueryRow("SELECT id FROM users WHERE email = ? AND confirmed = 0", email).Scan(&userID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Error looking up unconfirmed user:", err)
+		}
+		fmt.Fprintln(w, done)
+		return
+	}
+
+	token, err := generateToken(32)
+	if err != nil {
+		log.Println("Error generating token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Error starting transaction:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET token = ?, token_expires_at = DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE id = ?", token, int(confirmationTokenTTL.Seconds()), userID)
+	if err != nil {
+		log.Println("Error updating confirmation token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	msg, err := confirmationEmail(email, token, requestLocales(r))
+	if err == nil {
+		err = enqueueEmail(tx, msg)
+	}
+	if err != nil {
+		log.Println("Error queueing confirmation email:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error committing confirmation token:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, done)
+}
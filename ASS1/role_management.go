@@ -2,16 +2,26 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+
+	"ASS1/validation"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
 )
 
 type Role struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	IsSystem bool   `json:"is_system"`
 }
 
 func methodOverrideMiddleware(next http.Handler) http.Handler {
@@ -25,8 +35,70 @@ func methodOverrideMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+type ValidationResponse struct {
+	Status  string            `json:"status"`
+	Message string            `json:"message"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+func writeValidationError(w http.ResponseWriter, status int, message string, errors map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ValidationResponse{
+		Status:  strconv.Itoa(status),
+		Message: message,
+		Errors:  errors,
+	})
+}
+
+// wantsJSON reports whether errors should be returned as JSON rather than
+// rendered into an HTML form: API key clients and JSON requests get JSON.
+func wantsJSON(r *http.Request) bool {
+	if apiKeyIdentityFromContext(r) != nil || apiKeyFromRequest(r) != "" {
+		return true
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaType == "application/json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// rejectInput answers a request whose input failed validation: JSON clients
+// get the field errors as a ValidationResponse, browsers get the form again
+// from render with the errors shown next to the fields.
+func rejectInput(w http.ResponseWriter, r *http.Request, errs validation.Errors, render func(http.ResponseWriter, *http.Request, int, validation.Errors)) {
+	if wantsJSON(r) {
+		writeValidationError(w, http.StatusBadRequest, "Validation failed", errs)
+		return
+	}
+	render(w, r, http.StatusBadRequest, errs)
+}
+
+// validateRoleName checks that a role name is present and not taken by
+// another role. excludeID is the role being renamed, or 0 when creating.
+func validateRoleName(db *sql.DB, name string, excludeID int) (map[string]string, error) {
+	if name == "" {
+		return map[string]string{"name": "Role name is required"}, nil
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM roles WHERE name = ? AND id <> ?", name, excludeID).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return map[string]string{"name": fmt.Sprintf("A role named %q already exists", name)}, nil
+	}
+	return nil, nil
+}
+
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
 func createRoleHandler(w http.ResponseWriter, r *http.Request) {
-	name := r.FormValue("name")
+	name := strings.TrimSpace(r.FormValue("name"))
 
 	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
 	db, err := sql.Open(dbDriver, dsn)
@@ -37,9 +109,24 @@ func createRoleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
+	fieldErrors, err := validateRoleName(db, name, 0)
+	if err != nil {
+		log.Println("Failed to validate role: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if fieldErrors != nil {
+		writeValidationError(w, http.StatusBadRequest, "Invalid role", fieldErrors)
+		return
+	}
+
 	query := "INSERT INTO roles (name) VALUES (?)"
 	_, err = db.Exec(query, name)
 	if err != nil {
+		if isDuplicateKeyError(err) {
+			writeValidationError(w, http.StatusBadRequest, "Invalid role", map[string]string{"name": fmt.Sprintf("A role named %q already exists", name)})
+			return
+		}
 		log.Println("Failed to create role: ", err)
 		http.Error(w, "Failed to create role", http.StatusInternalServerError)
 		return
@@ -48,6 +135,12 @@ func createRoleHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin", http.StatusSeeOther)
 }
 
+func getRole(db *sql.DB, id int) (Role, error) {
+	var role Role
+	err := db.QueryRow("SELECT id, name, is_system FROM roles WHERE id = ?", id).Scan(&role.ID, &role.Name, &role.IsSystem)
+	return role, err
+}
+
 func updateRoleHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
@@ -56,7 +149,7 @@ func updateRoleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	name := r.FormValue("name")
+	name := strings.TrimSpace(r.FormValue("name"))
 
 	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
 	db, err := sql.Open(dbDriver, dsn)
@@ -67,9 +160,39 @@ func updateRoleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	query := "UPDATE roles SET name = ? WHERE id = ?"
+	role, err := getRole(db, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Role not found", http.StatusNotFound)
+			return
+		}
+		log.Println("Failed to fetch role: ", err)
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+	if role.IsSystem {
+		writeValidationError(w, http.StatusForbidden, "System roles cannot be renamed", map[string]string{"id": fmt.Sprintf("%q is a system role", role.Name)})
+		return
+	}
+
+	fieldErrors, err := validateRoleName(db, name, id)
+	if err != nil {
+		log.Println("Failed to validate role: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if fieldErrors != nil {
+		writeValidationError(w, http.StatusBadRequest, "Invalid role", fieldErrors)
+		return
+	}
+
+	query := "UPDATE roles SET name = ? WHERE id = ? AND is_system = 0"
 	_, err = db.Exec(query, name, id)
 	if err != nil {
+		if isDuplicateKeyError(err) {
+			writeValidationError(w, http.StatusBadRequest, "Invalid role", map[string]string{"name": fmt.Sprintf("A role named %q already exists", name)})
+			return
+		}
 		log.Println("Failed to update role: ", err)
 		http.Error(w, "Failed to update role", http.StatusInternalServerError)
 		return
@@ -78,6 +201,9 @@ func updateRoleHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/admin", http.StatusSeeOther)
 }
 
+// deleteRoleHandler refuses to delete system roles. A role that is still
+// assigned to users is only deleted, together with its assignments, after the
+// admin confirms on a page showing how many users would lose it.
 func deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
@@ -95,61 +221,95 @@ func deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	query := "DELETE FROM roles WHERE id = ?"
-	_, err = db.Exec(query, id)
+	role, err := getRole(db, id)
 	if err != nil {
-		log.Println("Failed to delete role: ", err)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Role not found", http.StatusNotFound)
+			return
+		}
+		log.Println("Failed to fetch role: ", err)
 		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
 		return
 	}
+	if role.IsSystem {
+		writeValidationError(w, http.StatusForbidden, "System roles cannot be deleted", map[string]string{"id": fmt.Sprintf("%q is a system role", role.Name)})
+		return
+	}
 
-	http.Redirect(w, r, "/admin", http.StatusSeeOther)
-}
+	var assigned int
+	err = db.QueryRow("SELECT COUNT(*) FROM user_roles WHERE role_id = ?", id).Scan(&assigned)
+	if err != nil {
+		log.Println("Failed to count role assignments: ", err)
+		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+		return
+	}
 
-func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserIDFromRequest(r)
-		if userID == "" {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
+	if assigned > 0 && r.FormValue("confirm") != "cascade" {
+		data := struct {
+			PageSecurity
+			Role     Role
+			Assigned int
+		}{
+			PageSecurity: pageSecurity(r),
+			Role:         role,
+			Assigned:     assigned,
 		}
 
-		if !isAdmin(r) {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		tmpl, err := template.ParseFiles("pages/confirm_role_delete.html")
+		if err != nil {
+			log.Println("Failed to parse template: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		next.ServeHTTP(w, r)
-	}
-}
-
-const AdminRoleID = 1
 
-func isAdmin(r *http.Request) bool {
-	userID := getUserIDFromRequest(r)
-	if userID == "" {
-		log.Error("User ID not found in request")
-		return false
+		w.WriteHeader(http.StatusConflict)
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			log.Println("Failed to execute template: ", err)
+		}
+		return
 	}
 
-	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
-	db, err := sql.Open(dbDriver, dsn)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Error("Failed to open database connection: ", err)
-		return false
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
-	defer db.Close()
+	defer tx.Rollback()
 
-	var count int
-	err = db.QueryRow("SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role_id = ?", userID, AdminRoleID).Scan(&count)
-	if err != nil {
-		log.Error("Failed to check user roles: ", err)
-		return false
+	for _, query := range []string{
+		"DELETE FROM user_roles WHERE role_id = ?",
+		"DELETE FROM role_permissions WHERE role_id = ?",
+		"DELETE FROM roles WHERE id = ? AND is_system = 0",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			log.Println("Failed to delete role: ", err)
+			http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+			return
+		}
 	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Failed to delete role: ", err)
+		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+		return
+	}
+	invalidatePermissionCache()
+
+	log.WithFields(logrus.Fields{
+		"event":       "role_deleted",
+		"role":        role.Name,
+		"assignments": assigned,
+		"admin_id":    getUserIDFromRequest(r),
+	}).Info("Role deleted")
 
-	return count > 0
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
 }
 
 func getUserIDFromRequest(r *http.Request) string {
+	if identity := apiKeyIdentityFromContext(r); identity != nil {
+		return strconv.Itoa(identity.UserID)
+	}
+
 	cookie, err := r.Cookie("token")
 	if err != nil {
 		log.Error("Token not found in cookie: ", err)
@@ -0,0 +1,293 @@
+-- Schema changes applied on top of the original users, roles, user_roles,
+-- electronic and transactions1 tables. Run the statements in order.
+
+-- Confirmation links expire; the token is cleared once it has been used.
+ALTER TABLE users ADD COLUMN token_expires_at DATETIME NULL;
+
+-- Email changes wait for confirmation from the new address; the old address
+-- receives a revert link.
+CREATE TABLE email_changes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    old_email VARCHAR(255) NOT NULL,
+    new_email VARCHAR(255) NOT NULL,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    revert_token VARCHAR(64) NOT NULL UNIQUE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    expires_at DATETIME NOT NULL,
+    revert_expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    applied_at DATETIME NULL,
+    INDEX (user_id, status)
+);
+
+-- External OpenID Connect identities linked to local users.
+CREATE TABLE user_identities (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    provider VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, subject),
+    INDEX (user_id)
+);
+
+-- Personal API keys. Only the SHA-256 of the key is stored; prefix locates the row.
+CREATE TABLE api_keys (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    prefix CHAR(8) NOT NULL UNIQUE,
+    key_hash CHAR(64) NOT NULL,
+    scopes VARCHAR(1000) NOT NULL,
+    expires_at DATETIME NULL,
+    last_used_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX (user_id)
+);
+
+-- Permission-based access control. Roles grant permissions; a user's
+-- effective permissions are the union over all their roles.
+CREATE TABLE permissions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE,
+    description VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+    role_id INT NOT NULL,
+    permission_id INT NOT NULL,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+INSERT INTO permissions (name, description) VALUES
+    ('admin:access', 'Open the admin panel'),
+    ('device:write', 'Create, update and delete devices'),
+    ('order:refund', 'Refund orders'),
+    ('email:broadcast', 'Send emails to all users'),
+    ('role:manage', 'Manage roles and their permissions'),
+    ('user:manage', 'Manage user accounts and login locks');
+
+-- The original admin role (id 1) keeps full access.
+INSERT INTO role_permissions (role_id, permission_id) SELECT 1, id FROM permissions;
+
+-- Account management by admins: disabled accounts cannot sign in, and a
+-- forced reset blocks password login until the emailed link is used.
+ALTER TABLE users ADD COLUMN disabled TINYINT(1) NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN password_reset_required TINYINT(1) NOT NULL DEFAULT 0;
+
+CREATE TABLE password_resets (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX (user_id)
+);
+
+-- System roles cannot be renamed or deleted. Role names are unique.
+ALTER TABLE roles ADD COLUMN is_system TINYINT(1) NOT NULL DEFAULT 0;
+ALTER TABLE roles ADD UNIQUE INDEX roles_name_unique (name);
+UPDATE roles SET is_system = 1 WHERE id = 1 OR name IN ('admin', 'user');
+
+-- Recent password hashes per user; new passwords may not match any of them.
+CREATE TABLE password_history (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX (user_id)
+);
+
+-- Password hashes are self-describing (bcrypt "$2a$<cost>$..." or argon2id PHC
+-- strings) and argon2id hashes are longer than bcrypt's 60 characters.
+ALTER TABLE users MODIFY password VARCHAR(255) NOT NULL;
+
+-- Self-service account deletion. Accounts are erased once scheduled_for has
+-- passed unless the request was cancelled; orders are kept and the users row
+-- they reference is anonymized.
+CREATE TABLE account_deletions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL UNIQUE,
+    requested_at DATETIME NOT NULL,
+    scheduled_for DATETIME NOT NULL,
+    cancelled_at DATETIME NULL,
+    completed_at DATETIME NULL,
+    INDEX (scheduled_for)
+);
+
+-- Transactional email outbox. Rows are inserted in the same transaction as
+-- the change that triggers the email and delivered by background workers;
+-- payload is the JSON-encoded message. Messages that keep failing end up
+-- with status 'dead' until an admin retries them.
+CREATE TABLE email_outbox (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    recipients VARCHAR(1024) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until DATETIME NULL,
+    claim_token VARCHAR(64) NULL,
+    last_error TEXT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    sent_at DATETIME NULL,
+    INDEX (status, next_attempt_at),
+    INDEX (claim_token)
+);
+
+-- Marketing campaigns. segment is the JSON-encoded audience filter; the
+-- audience is copied to campaign_recipients when the campaign starts and
+-- moved to email_outbox in throttled batches. token identifies the recipient
+-- in open and click tracking links.
+CREATE TABLE campaigns (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    segment TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'scheduled',
+    scheduled_at DATETIME NOT NULL,
+    started_at DATETIME NULL,
+    finished_at DATETIME NULL,
+    created_by INT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX (status, scheduled_at)
+);
+
+CREATE TABLE campaign_recipients (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    campaign_id INT NOT NULL,
+    user_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    outbox_id INT NULL,
+    queued_at DATETIME NULL,
+    opened_at DATETIME NULL,
+    clicked_at DATETIME NULL,
+    click_count INT NOT NULL DEFAULT 0,
+    UNIQUE KEY (campaign_id, user_id),
+    INDEX (campaign_id, status),
+    INDEX (user_id)
+);
+
+-- Brands a user has shown interest in by adding their devices to the cart,
+-- used by campaign segments.
+CREATE TABLE device_interest (
+    user_id INT NOT NULL,
+    brand VARCHAR(50) NOT NULL,
+    interactions INT NOT NULL DEFAULT 0,
+    last_seen_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, brand),
+    INDEX (brand)
+);
+
+-- Optional email categories a user accepts. Transactional email is always
+-- sent; users without a row receive everything.
+CREATE TABLE communication_preferences (
+    user_id INT PRIMARY KEY,
+    marketing TINYINT(1) NOT NULL DEFAULT 1,
+    product_alerts TINYINT(1) NOT NULL DEFAULT 1,
+    updated_at DATETIME NOT NULL
+);
+
+-- Addresses email is no longer sent to: hard bounces from SMTP delivery,
+-- bounce and complaint reports, and manual entries. Emails are stored in
+-- lower case.
+CREATE TABLE email_suppressions (
+    email VARCHAR(255) PRIMARY KEY,
+    reason VARCHAR(16) NOT NULL,
+    source VARCHAR(64) NOT NULL,
+    detail TEXT NULL,
+    created_at DATETIME NOT NULL
+);
+
+-- Device prices, kept apart from the original electronic table. Lowering a
+-- price notifies users with the device in their cart.
+CREATE TABLE device_prices (
+    device_id INT PRIMARY KEY,
+    price DECIMAL(10, 2) NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+-- In-app notifications: order status changes, price drops and admin
+-- announcements. read_at is set once the user has seen them.
+CREATE TABLE notifications (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    link VARCHAR(255) NULL,
+    read_at DATETIME NULL,
+    created_at DATETIME NOT NULL,
+    INDEX (user_id, read_at)
+);
+
+-- Outgoing webhooks. events is a comma-separated list of the event names
+-- the endpoint subscribes to; secret signs every request to it.
+CREATE TABLE webhooks (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    events VARCHAR(255) NOT NULL,
+    active TINYINT(1) NOT NULL DEFAULT 1,
+    created_at DATETIME NOT NULL
+);
+
+-- One row per event and subscribed webhook, queued and retried like
+-- email_outbox. Rows are kept as the webhook's delivery log.
+CREATE TABLE webhook_deliveries (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    webhook_id INT NOT NULL,
+    event VARCHAR(64) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    response_status INT NULL,
+    last_error TEXT NULL,
+    next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until DATETIME NULL,
+    claim_token VARCHAR(64) NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at DATETIME NULL,
+    INDEX (webhook_id, id),
+    INDEX (status, next_attempt_at),
+    INDEX (claim_token)
+);
+
+INSERT INTO permissions (name, description) VALUES ('webhook:manage', 'Manage outgoing webhooks');
+INSERT INTO role_permissions (role_id, permission_id) SELECT 1, id FROM permissions WHERE name = 'webhook:manage';
+
+-- Viewing orders and changing their status in /admin/orders.
+INSERT INTO permissions (name, description) VALUES ('order:manage', 'View orders and change their status');
+INSERT INTO role_permissions (role_id, permission_id) SELECT 1, id FROM permissions WHERE name = 'order:manage';
+
+-- Email addresses are unique, which registration, email changes and
+-- provider sign-ins rely on. Resolve existing duplicates before running
+-- this; list them with
+--   SELECT email, GROUP_CONCAT(id) FROM users GROUP BY email HAVING COUNT(*) > 1;
+-- and change or remove all but the account the address belongs to.
+ALTER TABLE users ADD UNIQUE INDEX users_email_unique (email);
+
+-- API key scopes used to be role names; they are now permission names plus
+-- 'self', the scope for acting as the key's own account. Keys scoped to
+-- roles get 'self' and the permissions those roles grant; keys whose roles
+-- grant nothing (such as 'user') get 'self' alone.
+UPDATE api_keys k
+JOIN (
+    SELECT k2.id, GROUP_CONCAT(DISTINCT p.name ORDER BY p.name) AS permissions
+    FROM api_keys k2
+    JOIN roles r ON FIND_IN_SET(r.name, k2.scopes) > 0
+    JOIN role_permissions rp ON rp.role_id = r.id
+    JOIN permissions p ON p.id = rp.permission_id
+    WHERE k2.scopes NOT LIKE '%:%' AND k2.scopes <> 'self'
+    GROUP BY k2.id
+) migrated ON migrated.id = k.id
+SET k.scopes = CONCAT('self,', migrated.permissions);
+UPDATE api_keys SET scopes = 'self' WHERE scopes NOT LIKE '%:%' AND scopes <> 'self';
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const cspNonceContextKey contextKey = "csp_nonce"
+
+const (
+	cspReportPath    = "/csp-report"
+	maxCSPReportSize = 64 << 10
+)
+
+// SecurityHeadersConfig controls the headers added to every response by
+// securityHeadersMiddleware.
+type SecurityHeadersConfig struct {
+	// CSPReportOnly sends Content-Security-Policy-Report-Only instead of
+	// enforcing the policy, so violations are only reported.
+	CSPReportOnly bool
+	// CSPReportURI receives violation reports; empty disables reporting.
+	CSPReportURI string
+	// HSTSMaxAge is the Strict-Transport-Security max-age in seconds; zero
+	// omits the header. Only enable it when the site is served over HTTPS.
+	HSTSMaxAge            int
+	HSTSIncludeSubdomains bool
+	FrameOptions          string
+	ReferrerPolicy        string
+	PermissionsPolicy     string
+}
+
+func defaultSecurityHeadersConfig() SecurityHeadersConfig {
+	config := SecurityHeadersConfig{
+		CSPReportURI:      cspReportPath,
+		FrameOptions:      "DENY",
+		ReferrerPolicy:    "strict-origin-when-cross-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+	}
+	if secureCookies {
+		config.HSTSMaxAge = 365 * 24 * 60 * 60
+	}
+	return config
+}
+
+// loadSecurityHeadersConfig starts from the defaults and applies overrides
+// from CSP_REPORT_ONLY, CSP_REPORT_URI, HSTS_MAX_AGE, HSTS_INCLUDE_SUBDOMAINS,
+// FRAME_OPTIONS, REFERRER_POLICY and PERMISSIONS_POLICY.
+func loadSecurityHeadersConfig() (SecurityHeadersConfig, error) {
+	config := defaultSecurityHeadersConfig()
+	config.CSPReportOnly = os.Getenv("CSP_REPORT_ONLY") == "1"
+	config.HSTSIncludeSubdomains = os.Getenv("HSTS_INCLUDE_SUBDOMAINS") == "1"
+	if value, ok := os.LookupEnv("CSP_REPORT_URI"); ok {
+		config.CSPReportURI = value
+	}
+	if value := os.Getenv("HSTS_MAX_AGE"); value != "" {
+		maxAge, err := strconv.Atoi(value)
+		if err != nil || maxAge < 0 {
+			return config, fmt.Errorf("invalid HSTS_MAX_AGE %q", value)
+		}
+		config.HSTSMaxAge = maxAge
+	}
+	if value, ok := os.LookupEnv("FRAME_OPTIONS"); ok {
+		config.FrameOptions = value
+	}
+	if value, ok := os.LookupEnv("REFERRER_POLICY"); ok {
+		config.ReferrerPolicy = value
+	}
+	if value, ok := os.LookupEnv("PERMISSIONS_POLICY"); ok {
+		config.PermissionsPolicy = value
+	}
+	return config, nil
+}
+
+// contentSecurityPolicy builds the policy for one response. Inline <style>
+// and <script> blocks in pages/*.html carry nonce="{{.CSPNonce}}"; inline
+// style attributes and event handlers are not allowed.
+func (c SecurityHeadersConfig) contentSecurityPolicy(nonce string) string {
+	directives := []string{
+		"default-src 'self'",
+		"script-src 'self' 'nonce-" + nonce + "'",
+		"style-src 'self' 'nonce-" + nonce + "'",
+		"img-src 'self' data:",
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+	}
+	if c.CSPReportURI != "" {
+		directives = append(directives, "report-uri "+c.CSPReportURI)
+	}
+	return strings.Join(directives, "; ")
+}
+
+func securityHeadersMiddleware(config SecurityHeadersConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nonce, err := generateToken(16)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), cspNonceContextKey, nonce))
+
+			header := w.Header()
+			cspHeader := "Content-Security-Policy"
+			if config.CSPReportOnly {
+				cspHeader = "Content-Security-Policy-Report-Only"
+			}
+			header.Set(cspHeader, config.contentSecurityPolicy(nonce))
+			header.Set("X-Content-Type-Options", "nosniff")
+			if config.FrameOptions != "" {
+				header.Set("X-Frame-Options", config.FrameOptions)
+			}
+			if config.ReferrerPolicy != "" {
+				header.Set("Referrer-Policy", config.ReferrerPolicy)
+			}
+			if config.PermissionsPolicy != "" {
+				header.Set("Permissions-Policy", config.PermissionsPolicy)
+			}
+			if config.HSTSMaxAge > 0 {
+				hsts := "max-age=" + strconv.Itoa(config.HSTSMaxAge)
+				if config.HSTSIncludeSubdomains {
+					hsts += "; includeSubDomains"
+				}
+				header.Set("Strict-Transport-Security", hsts)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceContextKey).(string)
+	return nonce
+}
+
+// cspReportHandler collects violation reports sent by browsers. Both the
+// legacy report-uri format ({"csp-report": {...}}) and Reporting API batches
+// are accepted and written to the application log.
+func cspReportHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCSPReportSize+1))
+	if err != nil || len(body) > maxCSPReportSize {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+
+	var reports []map[string]interface{}
+	var legacy struct {
+		Report map[string]interface{} `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &legacy); err == nil && legacy.Report != nil {
+		reports = append(reports, legacy.Report)
+	} else {
+		var batch []struct {
+			Type string                 `json:"type"`
+			Body map[string]interface{} `json:"body"`
+		}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			http.Error(w, "Invalid report", http.StatusBadRequest)
+			return
+		}
+		for _, report := range batch {
+			if report.Type == "csp-violation" && report.Body != nil {
+				reports = append(reports, report.Body)
+			}
+		}
+	}
+
+	for _, report := range reports {
+		fields := logrus.Fields{"event": "csp_violation", "user_agent": r.UserAgent()}
+		for key, value := range report {
+			fields["csp_"+key] = value
+		}
+		log.WithFields(fields).Warn("Content-Security-Policy violation reported")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,412 @@
+// Package smtptest provides an in-process SMTP server that accepts every
+// message and keeps it in memory, parsed into headers, text and HTML parts
+// and attachments. Tests point the application's SMTP mailer at it to
+// assert on the email a flow sends; in development it stands in for a real
+// mail server, with Handler serving a small web UI to read captured mail.
+//
+//	srv, err := smtptest.NewServer()
+//	if err != nil { ... }
+//	defer srv.Close()
+//	// send mail to srv.Host():srv.Port() ...
+//	msgs, err := srv.WaitForMessages(1, time.Second)
+//
+// The server does not offer STARTTLS or AUTH, so clients send in plain text
+// without logging in.
+package smtptest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxMessageSize is the largest message the server accepts, advertised with
+// the SIZE extension.
+const MaxMessageSize = 25 << 20
+
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Message is one captured email. From and To are the SMTP envelope, which
+// includes Bcc recipients that do not appear in the headers.
+type Message struct {
+	ID          int
+	From        string
+	To          []string
+	Header      mail.Header
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+	Raw         []byte
+	ReceivedAt  time.Time
+}
+
+type Server struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []*Message
+	nextID   int
+	changed  chan struct{}
+	conns    map[net.Conn]bool
+	rejects  map[string]string
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server on a free port on the loopback interface.
+func NewServer() (*Server, error) {
+	return Listen("127.0.0.1:0")
+}
+
+// Listen starts a server on addr.
+func Listen(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: listener,
+		nextID:   1,
+		changed:  make(chan struct{}),
+		conns:    make(map[net.Conn]bool),
+		rejects:  make(map[string]string),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the server and drops open connections. Captured messages stay
+// readable.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Messages returns the messages received so far, oldest first.
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.messages...)
+}
+
+// Message returns the message with the given ID, or nil.
+func (s *Server) Message(id int) *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range s.messages {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// Reset forgets all captured messages.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.messages = nil
+	s.mu.Unlock()
+}
+
+// RejectRecipient makes the server refuse RCPT TO for address with reply,
+// such as "550 5.1.1 No such user", to exercise bounce handling.
+func (s *Server) RejectRecipient(address, reply string) {
+	s.mu.Lock()
+	s.rejects[strings.ToLower(address)] = reply
+	s.mu.Unlock()
+}
+
+// WaitForMessages waits until at least n messages have been received, for
+// flows that send mail in the background.
+func (s *Server) WaitForMessages(n int, timeout time.Duration) ([]*Message, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		if len(s.messages) >= n {
+			messages := append([]*Message(nil), s.messages...)
+			s.mu.Unlock()
+			return messages, nil
+		}
+		changed := s.changed
+		got := len(s.messages)
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return nil, fmt.Errorf("smtptest: got %d messages, want %d", got, n)
+		}
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// handle speaks just enough SMTP for Go's net/smtp and gomail clients.
+func (s *Server) handle(conn net.Conn) {
+	text := textproto.NewConn(conn)
+	reply := func(code int, lines ...string) {
+		for i, line := range lines {
+			sep := "-"
+			if i == len(lines)-1 {
+				sep = " "
+			}
+			text.PrintfLine("%d%s%s", code, sep, line)
+		}
+	}
+
+	reply(220, "smtptest ESMTP ready")
+	var from string
+	var to []string
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply(250, "smtptest", "8BITMIME", "SIZE "+strconv.Itoa(MaxMessageSize))
+		case "HELO":
+			reply(250, "smtptest")
+		case "MAIL":
+			address, ok := pathArg(arg, "FROM:")
+			if !ok {
+				reply(501, "Syntax: MAIL FROM:<address>")
+				continue
+			}
+			from, to = address, nil
+			reply(250, "OK")
+		case "RCPT":
+			address, ok := pathArg(arg, "TO:")
+			if !ok || address == "" {
+				reply(501, "Syntax: RCPT TO:<address>")
+				continue
+			}
+			s.mu.Lock()
+			rejection := s.rejects[strings.ToLower(address)]
+			s.mu.Unlock()
+			if rejection != "" {
+				text.PrintfLine("%s", rejection)
+				continue
+			}
+			to = append(to, address)
+			reply(250, "OK")
+		case "DATA":
+			if len(to) == 0 {
+				reply(503, "RCPT TO required first")
+				continue
+			}
+			reply(354, "End data with <CR><LF>.<CR><LF>")
+			data := text.DotReader()
+			raw, err := io.ReadAll(io.LimitReader(data, MaxMessageSize+1))
+			if err != nil {
+				return
+			}
+			if len(raw) > MaxMessageSize {
+				if _, err := io.Copy(io.Discard, data); err != nil {
+					return
+				}
+				reply(552, "Message too large")
+				continue
+			}
+			if err := s.store(from, to, raw); err != nil {
+				reply(554, "Could not parse message: "+err.Error())
+				continue
+			}
+			from, to = "", nil
+			reply(250, "OK: queued")
+		case "RSET":
+			from, to = "", nil
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+// pathArg extracts the address from "FROM:<a@b> SIZE=123".
+func pathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(path, "<") {
+		return "", false
+	}
+	end := strings.Index(path, ">")
+	if end < 0 {
+		return "", false
+	}
+	return path[1:end], true
+}
+
+func (s *Server) store(from string, to []string, raw []byte) error {
+	msg, err := Parse(raw)
+	if err != nil {
+		return err
+	}
+	msg.From = from
+	msg.To = to
+	msg.ReceivedAt = time.Now()
+
+	s.mu.Lock()
+	msg.ID = s.nextID
+	s.nextID++
+	s.messages = append(s.messages, msg)
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+	return nil
+}
+
+// Parse decodes a raw RFC 5322 message into its headers, first text/plain
+// and text/html parts and attachments. Envelope fields are left empty.
+func Parse(raw []byte) (*Message, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{Header: parsed.Header, Raw: raw}
+	msg.Subject, err = new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		msg.Subject = parsed.Header.Get("Subject")
+	}
+	if err := msg.addPart(textproto.MIMEHeader(parsed.Header), parsed.Body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (m *Message) addPart(header textproto.MIMEHeader, body io.Reader) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.addPart(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	switch {
+	case disposition == "attachment" || filename != "":
+		m.Attachments = append(m.Attachments, Attachment{Filename: filename, ContentType: mediaType, Data: data})
+	case mediaType == "text/plain" && m.Text == "":
+		m.Text = normalizeNewlines(data)
+	case mediaType == "text/html" && m.HTML == "":
+		m.HTML = normalizeNewlines(data)
+	}
+	return nil
+}
+
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// The decoder skips the line breaks base64 bodies are wrapped with.
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+func normalizeNewlines(data []byte) string {
+	return strings.ReplaceAll(string(data), "\r\n", "\n")
+}
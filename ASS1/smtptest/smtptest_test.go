@@ -0,0 +1,126 @@
+package smtptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const multipartMessage = "From: Shop <shop@example.com>\r\n" +
+	"To: buyer@example.com\r\n" +
+	"Subject: =?UTF-8?q?Your_receipt_=E2=80=94_thanks?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=UTF-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Thanks for your order =E2=80=94 see attached.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=UTF-8\r\n" +
+	"\r\n" +
+	"<p>Thanks for your order</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"receipt.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"receipt.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--outer--\r\n"
+
+func TestServerCapturesMultipartMessage(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	err = smtp.SendMail(srv.Addr(), nil, "shop@example.com", []string{"buyer@example.com", "audit@example.com"}, []byte(multipartMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := srv.WaitForMessages(1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := msgs[0]
+	if msg.From != "shop@example.com" || len(msg.To) != 2 || msg.To[1] != "audit@example.com" {
+		t.Errorf("envelope = %q -> %q", msg.From, msg.To)
+	}
+	if msg.Subject != "Your receipt — thanks" {
+		t.Errorf("Subject = %q", msg.Subject)
+	}
+	if msg.Text != "Thanks for your order — see attached." {
+		t.Errorf("Text = %q", msg.Text)
+	}
+	if msg.HTML != "<p>Thanks for your order</p>" {
+		t.Errorf("HTML = %q", msg.HTML)
+	}
+	if len(msg.Attachments) != 1 {
+		t.Fatalf("got %d attachments, want 1", len(msg.Attachments))
+	}
+	attachment := msg.Attachments[0]
+	if attachment.Filename != "receipt.pdf" || attachment.ContentType != "application/pdf" || string(attachment.Data) != "%PDF-1.4\n" {
+		t.Errorf("attachment = %q %q %q", attachment.Filename, attachment.ContentType, attachment.Data)
+	}
+}
+
+func TestWaitForMessagesTimesOut(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if _, err := srv.WaitForMessages(1, 10*time.Millisecond); err == nil {
+		t.Error("WaitForMessages succeeded with no mail sent")
+	}
+}
+
+func TestHandlerShowsCapturedMail(t *testing.T) {
+	srv, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	err = smtp.SendMail(srv.Addr(), nil, "shop@example.com", []string{"buyer@example.com"}, []byte(multipartMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.WaitForMessages(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	if rr := get("/"); !strings.Contains(rr.Body.String(), "Your receipt — thanks") {
+		t.Errorf("list does not show the subject: %s", rr.Body.String())
+	}
+	if rr := get("/messages/1"); !strings.Contains(rr.Body.String(), "receipt.pdf") {
+		t.Errorf("message page does not list the attachment: %s", rr.Body.String())
+	}
+	rr := get("/messages/1/html")
+	if !strings.Contains(rr.Header().Get("Content-Security-Policy"), "sandbox") {
+		t.Errorf("HTML part served without a sandbox CSP: %q", rr.Header().Get("Content-Security-Policy"))
+	}
+	if rr := get("/messages/1/attachments/0"); rr.Body.String() != "%PDF-1.4\n" {
+		t.Errorf("attachment body = %q", rr.Body.String())
+	}
+	if rr := get("/messages/2"); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown message status = %d, want 404", rr.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package smtptest
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Handler serves a web UI listing the captured messages:
+//
+//	/                                 message list
+//	/messages/{id}                    headers, text and HTML parts
+//	/messages/{id}/html               the HTML part on its own
+//	/messages/{id}/raw                the message as received
+//	/messages/{id}/attachments/{n}    an attachment
+//
+// It is meant for development only and has no authentication.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(s.serveUI)
+}
+
+func (s *Server) serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		if r.Method == http.MethodPost {
+			s.Reset()
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		s.render(w, listTemplate, s.Messages())
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/messages/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(rest, "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	msg := s.Message(id)
+	if msg == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		s.render(w, messageTemplate, msg)
+	case len(parts) == 2 && parts[1] == "html":
+		// Captured HTML is untrusted; show it without scripts or forms.
+		w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; style-src 'unsafe-inline'; img-src * data:")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, msg.HTML)
+	case len(parts) == 2 && parts[1] == "raw":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(msg.Raw)
+	case len(parts) == 3 && parts[1] == "attachments":
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < 0 || n >= len(msg.Attachments) {
+			http.NotFound(w, r)
+			return
+		}
+		attachment := msg.Attachments[n]
+		w.Header().Set("Content-Type", attachment.ContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachment.Filename))
+		w.Write(attachment.Data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) render(w http.ResponseWriter, tmpl *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+const uiStyle = `<style>
+body { font-family: Arial, sans-serif; margin: 20px; color: #333; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 6px 8px; border-bottom: 1px solid #ddd; vertical-align: top; }
+pre { white-space: pre-wrap; background: #f8f8f8; padding: 10px; border: 1px solid #ddd; }
+iframe { width: 100%; height: 480px; border: 1px solid #ddd; }
+</style>`
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Captured Mail</title>` + uiStyle + `</head>
+<body>
+<h1>Captured Mail</h1>
+<form method="post" action="/"><button type="submit">Delete All</button></form>
+<table>
+    <tr><th>Received</th><th>From</th><th>To</th><th>Subject</th><th>Attachments</th></tr>
+    {{range .}}
+    <tr>
+        <td>{{.ReceivedAt.Format "15:04:05"}}</td>
+        <td>{{.From}}</td>
+        <td>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</td>
+        <td><a href="/messages/{{.ID}}">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a></td>
+        <td>{{len .Attachments}}</td>
+    </tr>
+    {{else}}
+    <tr><td colspan="5">No mail yet.</td></tr>
+    {{end}}
+</table>
+</body>
+</html>
+`))
+
+var messageTemplate = template.Must(template.New("message").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Subject}}</title>` + uiStyle + `</head>
+<body>
+<p><a href="/">All messages</a> | <a href="/messages/{{.ID}}/raw">Raw</a></p>
+<h1>{{.Subject}}</h1>
+<table>
+    {{range $name, $values := .Header}}
+    <tr><th>{{$name}}</th><td>{{range $values}}{{.}}<br>{{end}}</td></tr>
+    {{end}}
+</table>
+{{if .Attachments}}
+<h2>Attachments</h2>
+<ul>
+    {{$id := .ID}}
+    {{range $i, $a := .Attachments}}
+    <li><a href="/messages/{{$id}}/attachments/{{$i}}">{{$a.Filename}}</a> ({{$a.ContentType}}, {{len $a.Data}} bytes)</li>
+    {{end}}
+</ul>
+{{end}}
+{{if .HTML}}
+<h2>HTML</h2>
+<iframe sandbox src="/messages/{{.ID}}/html" title="HTML part"></iframe>
+{{end}}
+{{if .Text}}
+<h2>Text</h2>
+<pre>{{.Text}}</pre>
+{{end}}
+</body>
+</html>
+`))
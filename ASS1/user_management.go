@@ -0,0 +1,537 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ASS1/validation"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const passwordResetTTL = 2 * time.Hour
+
+var (
+	errAccountDisabled       = errors.New("This account has been disabled")
+	errPasswordResetRequired = errors.New("A password reset is required. Please use the link we sent to your email.")
+)
+
+type UserSummary struct {
+	ID                    int
+	Username              string
+	Email                 string
+	Confirmed             bool
+	Disabled              bool
+	PasswordResetRequired bool
+	EmailUndeliverable    bool
+	Roles                 []Role
+}
+
+// getUserRoles returns every role assigned to the user. A user's effective
+// access is the union of these roles.
+func getUserRoles(db *sql.DB, userID int) ([]Role, error) {
+	rows, err := db.Query("SELECT r.id, r.name FROM roles r JOIN user_roles ur ON r.id = ur.role_id WHERE ur.user_id = ? ORDER BY r.name", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Name); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func getAllRoles(db *sql.DB) ([]Role, error) {
+	rows, err := db.Query("SELECT id, name FROM roles ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Name); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	query := `SELECT u.id, u.username, u.email, u.confirmed, u.disabled, NOT ` + suppressionCondition() + `,
+		COALESCE(GROUP_CONCAT(r.name ORDER BY r.name SEPARATOR ', '), '')
+		FROM users u
+		LEFT JOIN user_roles ur ON ur.user_id = u.id
+		LEFT JOIN roles r ON r.id = ur.role_id`
+	var args []interface{}
+	if search != "" {
+		query += " WHERE u.username LIKE ? OR u.email LIKE ?"
+		pattern := "%" + search + "%"
+		args = append(args, pattern, pattern)
+	}
+	query += " GROUP BY u.id, u.username, u.email, u.confirmed, u.disabled ORDER BY u.username LIMIT 100"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Println("Failed to fetch users: ", err)
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type userRow struct {
+		UserSummary
+		RoleNames string
+	}
+	var users []userRow
+	for rows.Next() {
+		var u userRow
+		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.Confirmed, &u.Disabled, &u.EmailUndeliverable, &u.RoleNames); err != nil {
+			log.Println("Failed to scan user: ", err)
+			http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("User rows error: ", err)
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Search string
+		Users  []userRow
+	}{
+		PageSecurity: pageSecurity(r),
+		Search:       search,
+		Users:        users,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_users.html")
+	if err != nil {
+		log.Println("Failed to parse template: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println("Failed to execute template: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var user UserSummary
+	err = db.QueryRow("SELECT id, username, email, confirmed, disabled, password_reset_required FROM users WHERE id = ?", userID).Scan(&user.ID, &user.Username, &user.Email, &user.Confirmed, &user.Disabled, &user.PasswordResetRequired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Println("Failed to fetch user: ", err)
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	user.Roles, err = getUserRoles(db, userID)
+	if err != nil {
+		log.Println("Failed to fetch user roles: ", err)
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	suppression, err := getEmailSuppression(db, user.Email)
+	if err != nil {
+		log.Println("Failed to fetch email suppression: ", err)
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	user.EmailUndeliverable = suppression != nil
+	allRoles, err := getAllRoles(db)
+	if err != nil {
+		log.Println("Failed to fetch roles: ", err)
+		http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		User        UserSummary
+		Suppression *Suppression
+		AllRoles    []Role
+	}{
+		PageSecurity: pageSecurity(r),
+		User:         user,
+		Suppression:  suppression,
+		AllRoles:     allRoles,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_user.html")
+	if err != nil {
+		log.Println("Failed to parse template: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println("Failed to execute template: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// adminUserAction runs a change against the user in the URL and redirects
+// back to that user's page. The acting admin must hold every permission the
+// user has, so no one can lock out or take over a more privileged account.
+// The acting admin is recorded in the log.
+func adminUserAction(action string, apply func(db *sql.DB, userID int, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+
+		dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+		db, err := sql.Open(dbDriver, dsn)
+		if err != nil {
+			log.Println("Failed to open database connection: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+
+		err = checkUserManageable(r, userID)
+		if err == nil {
+			err = apply(db, userID, r)
+		}
+		if err != nil {
+			var badRequest badRequestError
+			if errors.As(err, &badRequest) {
+				http.Error(w, badRequest.Error(), http.StatusBadRequest)
+				return
+			}
+			var forbidden forbiddenError
+			if errors.As(err, &forbidden) {
+				http.Error(w, forbidden.Error(), http.StatusForbidden)
+				return
+			}
+			log.Println("Failed to "+action+": ", err)
+			http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+			return
+		}
+
+		invalidateUserPermissions(userID)
+		log.WithFields(logrus.Fields{
+			"event":    "admin_user_action",
+			"action":   action,
+			"user_id":  userID,
+			"admin_id": getUserIDFromRequest(r),
+		}).Info("Admin changed user account")
+
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", userID), http.StatusSeeOther)
+	}
+}
+
+type badRequestError string
+
+func (e badRequestError) Error() string { return string(e) }
+
+type forbiddenError string
+
+func (e forbiddenError) Error() string { return string(e) }
+
+// checkRoleDelegable returns a forbiddenError unless the acting user holds
+// every permission the role carries. Without it, user:manage alone would be
+// enough to hand out any role, admin included, to anyone or to oneself.
+func checkRoleDelegable(r *http.Request, rolePermissions []string) error {
+	for _, permission := range rolePermissions {
+		if !hasPermission(r, permission) {
+			return forbiddenError(fmt.Sprintf("You cannot manage a role with the %s permission, which you do not have", permission))
+		}
+	}
+	return nil
+}
+
+// checkUserManageable returns a forbiddenError unless the acting user holds
+// every permission the target user has.
+func checkUserManageable(r *http.Request, userID int) error {
+	permissions, err := userPermissions(userID)
+	if err != nil {
+		return err
+	}
+	for _, permission := range sortedPermissionNames(permissions) {
+		if !hasPermission(r, permission) {
+			return forbiddenError(fmt.Sprintf("You cannot manage a user with the %s permission, which you do not have", permission))
+		}
+	}
+	return nil
+}
+
+func rolePermissionNames(db *sql.DB, roleID int) ([]string, error) {
+	rows, err := db.Query("SELECT p.name FROM permissions p JOIN role_permissions rp ON rp.permission_id = p.id WHERE rp.role_id = ?", roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// delegableRole reads the role_id form value and checks that the acting user
+// may assign or revoke that role.
+func delegableRole(db *sql.DB, r *http.Request) (int, error) {
+	roleID, err := strconv.Atoi(r.FormValue("role_id"))
+	if err != nil {
+		return 0, badRequestError("Invalid role ID")
+	}
+	permissions, err := rolePermissionNames(db, roleID)
+	if err != nil {
+		return 0, err
+	}
+	return roleID, checkRoleDelegable(r, permissions)
+}
+
+var assignUserRoleHandler = adminUserAction("assign role", func(db *sql.DB, userID int, r *http.Request) error {
+	roleID, err := delegableRole(db, r)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT IGNORE INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE id = ?", userID, roleID)
+	return err
+})
+
+var revokeUserRoleHandler = adminUserAction("revoke role", func(db *sql.DB, userID int, r *http.Request) error {
+	roleID, err := delegableRole(db, r)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM user_roles WHERE user_id = ? AND role_id = ?", userID, roleID)
+	return err
+})
+
+var confirmUserHandler = adminUserAction("confirm user", func(db *sql.DB, userID int, r *http.Request) error {
+	_, err := db.Exec("UPDATE users SET confirmed = 1, token = '', token_expires_at = NULL WHERE id = ?", userID)
+	return err
+})
+
+var setUserDisabledHandler = adminUserAction("change account status", func(db *sql.DB, userID int, r *http.Request) error {
+	disabled := r.FormValue("disabled") == "1"
+	if disabled && strconv.Itoa(userID) == getUserIDFromRequest(r) {
+		return badRequestError("You cannot disable your own account")
+	}
+	_, err := db.Exec("UPDATE users SET disabled = ? WHERE id = ?", disabled, userID)
+	return err
+})
+
+var forcePasswordResetHandler = adminUserAction("force password reset", func(db *sql.DB, userID int, r *http.Request) error {
+	return startPasswordReset(db, userID)
+})
+
+var clearEmailSuppressionHandler = adminUserAction("clear email suppression", func(db *sql.DB, userID int, r *http.Request) error {
+	_, err := db.Exec("DELETE s FROM email_suppressions s JOIN users u ON u.email = s.email WHERE u.id = ?", userID)
+	return err
+})
+
+// startPasswordReset blocks password login for the user until they choose a
+// new password through the emailed reset link.
+func startPasswordReset(db *sql.DB, userID int) error {
+	var email string
+	if err := db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		return err
+	}
+
+	token, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET password_reset_required = 1 WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL", userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO password_resets (user_id, token, expires_at) VALUES (?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))", userID, token, int(passwordResetTTL.Seconds()))
+	if err != nil {
+		return err
+	}
+	// Resets are started by an admin, so the admin's browser language says
+	// nothing about the user's; the default locale is used.
+	msg, err := newTemplatedEmail(email, "password_reset", nil, map[string]interface{}{
+		"Link": "http://localhost:8080/reset-password?token=" + token,
+	})
+	if err != nil {
+		return err
+	}
+	if err := enqueueEmail(tx, msg); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var resetID, userID int
+	var username string
+	err = db.QueryRow(`SELECT pr.id, pr.user_id, u.username FROM password_resets pr JOIN users u ON u.id = pr.user_id
+		WHERE pr.token = ? AND pr.used_at IS NULL AND pr.expires_at > NOW()`, token).Scan(&resetID, &userID, &username)
+	if err != nil {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		renderResetPasswordForm(w, r, http.StatusOK, nil)
+		return
+	}
+
+	newPassword := r.FormValue("new-password")
+	errs := validation.Validate(validation.Field("new-password", newPassword, validation.Required, newPasswordRule(username)))
+	if !errs.Any() {
+		reused, err := passwordRecentlyUsed(strconv.Itoa(userID), newPassword)
+		if err != nil {
+			log.Error("Failed to check password history: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if reused {
+			errs.Add("new-password", "Choose a password you have not used recently")
+		}
+	}
+	if errs.Any() {
+		rejectInput(w, r, errs, renderResetPasswordForm)
+		return
+	}
+
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET password = ?, password_reset_required = 0 WHERE id = ?", hashedPassword, userID); err != nil {
+		log.Error("Failed to update password in database: ", err)
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+	if err := recordPasswordHistory(tx, int64(userID), hashedPassword); err != nil {
+		log.Error("Failed to record password history: ", err)
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE id = ?", resetID); err != nil {
+		log.Error("Failed to mark password reset as used: ", err)
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// renderResetPasswordForm shows the new-password form for the reset token in
+// the request, with any field errors.
+func renderResetPasswordForm(w http.ResponseWriter, r *http.Request, status int, errs validation.Errors) {
+	data := struct {
+		PageSecurity
+		Token  string
+		Errors validation.Errors
+	}{
+		PageSecurity: pageSecurity(r),
+		Token:        r.FormValue("token"),
+		Errors:       errs,
+	}
+
+	tmpl, err := template.ParseFiles("pages/reset_password.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Error("Failed to render template: ", err)
+	}
+}
@@ -0,0 +1,216 @@
+// Package validation checks user input against declarative per-field rules
+// and collects the failures as field-level error messages.
+//
+//	errs := validation.Validate(
+//		validation.Field("username", username, validation.Required, validation.Username),
+//		validation.Field("email", email, validation.Required, validation.Email),
+//	)
+//	if errs.Any() { ... }
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rule checks a single value and returns an error message, or "" if the
+// value is acceptable. Rules other than Required accept the empty string so
+// optional fields can be validated without also being required.
+type Rule func(value string) string
+
+// Errors maps field names to the first error found for that field. It is
+// rendered next to form fields and returned as the "errors" object in JSON.
+type Errors map[string]string
+
+// Add records message for field unless the field already has an error.
+func (e Errors) Add(field, message string) {
+	if _, ok := e[field]; !ok {
+		e[field] = message
+	}
+}
+
+func (e Errors) Any() bool {
+	return len(e) > 0
+}
+
+type FieldRules struct {
+	Name  string
+	Value string
+	Rules []Rule
+}
+
+func Field(name, value string, rules ...Rule) FieldRules {
+	return FieldRules{Name: name, Value: value, Rules: rules}
+}
+
+// Validate applies each field's rules in order and stops at the first
+// failure per field.
+func Validate(fields ...FieldRules) Errors {
+	errs := Errors{}
+	for _, field := range fields {
+		for _, rule := range field.Rules {
+			if message := rule(field.Value); message != "" {
+				errs.Add(field.Name, message)
+				break
+			}
+		}
+	}
+	return errs
+}
+
+func Required(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "This field is required"
+	}
+	return ""
+}
+
+func MinLength(n int) Rule {
+	return func(value string) string {
+		if value != "" && utf8.RuneCountInString(value) < n {
+			return fmt.Sprintf("Must be at least %d characters", n)
+		}
+		return ""
+	}
+}
+
+func MaxLength(n int) Rule {
+	return func(value string) string {
+		if utf8.RuneCountInString(value) > n {
+			return fmt.Sprintf("Must be at most %d characters", n)
+		}
+		return ""
+	}
+}
+
+// Matches requires the value to match pattern, reporting message otherwise.
+func Matches(pattern *regexp.Regexp, message string) Rule {
+	return func(value string) string {
+		if value != "" && !pattern.MatchString(value) {
+			return message
+		}
+		return ""
+	}
+}
+
+// Email accepts a bare address such as user@example.com; display names and
+// angle brackets are rejected.
+func Email(value string) string {
+	if value == "" {
+		return ""
+	}
+	if len(value) > 254 {
+		return "Email address is too long"
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value || !strings.Contains(value[strings.LastIndex(value, "@"):], ".") {
+		return "Enter a valid email address"
+	}
+	return ""
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+const (
+	UsernameMinLength = 3
+	UsernameMaxLength = 32
+)
+
+// Username allows 3-32 letters, digits, dots, dashes and underscores.
+func Username(value string) string {
+	for _, rule := range []Rule{
+		MinLength(UsernameMinLength),
+		MaxLength(UsernameMaxLength),
+		Matches(usernamePattern, "Use only letters, digits, dots, dashes and underscores"),
+	} {
+		if message := rule(value); message != "" {
+			return message
+		}
+	}
+	return ""
+}
+
+// PasswordMaxBytes is bcrypt's input limit; longer passwords would be
+// silently truncated.
+const PasswordMaxBytes = 72
+
+// PasswordPolicy describes the composition rules for new passwords.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireLetter bool
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// ForbidUsername rejects passwords containing the username, ignoring case.
+	ForbidUsername bool
+}
+
+// DefaultPasswordPolicy requires at least 8 characters including a letter
+// and a digit, and no username.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:      8,
+	RequireLetter:  true,
+	RequireDigit:   true,
+	ForbidUsername: true,
+}
+
+// Check returns the first rule the password breaks, or "".
+func (p PasswordPolicy) Check(password, username string) string {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Sprintf("Password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > PasswordMaxBytes {
+		return fmt.Sprintf("Password must be at most %d bytes", PasswordMaxBytes)
+	}
+
+	var letter, upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+			upper = upper || unicode.IsUpper(r)
+			lower = lower || unicode.IsLower(r)
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	switch {
+	case p.RequireLetter && !letter:
+		return "Password must contain a letter"
+	case p.RequireUpper && !upper:
+		return "Password must contain an uppercase letter"
+	case p.RequireLower && !lower:
+		return "Password must contain a lowercase letter"
+	case p.RequireDigit && !digit:
+		return "Password must contain a digit"
+	case p.RequireSymbol && !symbol:
+		return "Password must contain a symbol"
+	}
+
+	if p.ForbidUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return "Password must not contain your username"
+	}
+	return ""
+}
+
+// Rule adapts the policy for use with Field; username may be empty.
+func (p PasswordPolicy) Rule(username string) Rule {
+	return func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return p.Check(value, username)
+	}
+}
+
+// Password checks a value against DefaultPasswordPolicy.
+func Password(value string) string {
+	return DefaultPasswordPolicy.Rule("")(value)
+}
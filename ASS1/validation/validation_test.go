@@ -0,0 +1,79 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	errs := Validate(
+		Field("username", "ab", Required, Username),
+		Field("email", "not-an-email", Required, Email),
+		Field("password", "password", Required, Password),
+		Field("brand", "", Required, MaxLength(50)),
+		Field("model", "X100", Required, MaxLength(50)),
+	)
+
+	for _, field := range []string{"username", "email", "password", "brand"} {
+		if errs[field] == "" {
+			t.Errorf("Expected an error for %s", field)
+		}
+	}
+	if _, ok := errs["model"]; ok {
+		t.Errorf("Expected model to be valid, got %q", errs["model"])
+	}
+	if errs["brand"] != "This field is required" {
+		t.Errorf("Expected the first failing rule to win, got %q", errs["brand"])
+	}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		rule  Rule
+		value string
+		valid bool
+	}{
+		{Username, "john_doe-1.x", true},
+		{Username, "john doe", false},
+		{Username, strings.Repeat("a", UsernameMaxLength+1), false},
+		{Email, "user@example.com", true},
+		{Email, "User <user@example.com>", false},
+		{Email, "user@localhost", false},
+		{Password, "s3cretpass", true},
+		{Password, "short1", false},
+		{Password, "12345678", false},
+		{Password, strings.Repeat("a1", 40), false},
+		{MaxLength(3), "abcd", false},
+		{MinLength(3), "", true},
+	}
+
+	for _, test := range tests {
+		message := test.rule(test.value)
+		if (message == "") != test.valid {
+			t.Errorf("value %q: expected valid=%v, got message %q", test.value, test.valid, message)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true, ForbidUsername: true}
+
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"Corr3ct-Horse", true},
+		{"Sh0rt-pw", false},
+		{"corr3ct-horse", false},
+		{"CORR3CT-HORSE", false},
+		{"Correct-Horse", false},
+		{"Corr3ctHorse", false},
+		{"xJohnDoe-99x", false},
+	}
+	for _, test := range tests {
+		message := policy.Check(test.password, "johndoe")
+		if (message == "") != test.valid {
+			t.Errorf("password %q: expected valid=%v, got message %q", test.password, test.valid, message)
+		}
+	}
+}
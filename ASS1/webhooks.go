@@ -0,0 +1,768 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"ASS1/validation"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Outgoing webhooks tell external systems, such as the ERP, about catalog
+// and order changes. Like email, an event is written to webhook_deliveries
+// in the transaction making the change, one row per subscribed webhook, and
+// POSTed by background workers. Failed deliveries are retried on the email
+// outbox's backoff schedule until webhookMaxAttempts, after which they are
+// dead-lettered for an admin to retry. The rows double as the delivery log.
+const (
+	webhookWorkers      = 2
+	webhookMaxAttempts  = 8
+	webhookTimeout      = 10 * time.Second
+	webhookClaimTimeout = time.Minute
+	webhookPollInterval = 5 * time.Second
+	webhookLogSize      = 50
+	maxWebhookURLLength = 2048
+)
+
+// Webhook events. webhookTest is only sent from the admin page, to the
+// webhook being tested, and is not retried.
+const (
+	webhookDeviceCreated = "device.created"
+	webhookDeviceUpdated = "device.updated"
+	webhookDeviceDeleted = "device.deleted"
+	webhookOrderStatus   = "order.status_changed"
+	webhookTest          = "webhook.test"
+)
+
+// webhookEvents lists the events a webhook can subscribe to.
+var webhookEvents = []string{webhookDeviceCreated, webhookDeviceUpdated, webhookDeviceDeleted, webhookOrderStatus}
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookDead      = "dead"
+)
+
+// webhookClient does not follow redirects: a redirect counts as a failed
+// delivery, so the payload is never sent anywhere but the configured URL.
+// Its dialer refuses non-public addresses, checked after DNS resolution so a
+// hostname cannot be pointed at our own network, and it ignores proxy
+// settings so the address dialed is the webhook's own.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: webhookDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookAllowPrivate lets tests deliver to servers on the loopback
+// interface.
+var webhookAllowPrivate = false
+
+// nonPublicNetworks are ranges not covered by the net.IP predicates used in
+// publicIP: "this network", carrier-grade NAT, IETF protocol assignments,
+// benchmarking and the IPv6 NAT64 and documentation prefixes.
+var nonPublicNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "64:ff9b::/96", "2001:db8::/32"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// publicIP reports whether ip is routable on the internet, as opposed to a
+// loopback, private, link-local (including cloud metadata endpoints) or
+// otherwise reserved address.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl rejects connections to addresses that are not public.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("webhook destination %s is not an IP address", host)
+	}
+	if !publicIP(ip) && !webhookAllowPrivate {
+		return fmt.Errorf("webhook destination %s is not a public address", host)
+	}
+	return nil
+}
+
+// WebhookPayload is the JSON body POSTed to webhooks. ID is the same for
+// every webhook receiving the event, and across retries.
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt string      `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type orderStatusChange struct {
+	OrderID    int    `json:"order_id"`
+	CustomerID int    `json:"customer_id"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+}
+
+func newWebhookPayload(event string, data interface{}) ([]byte, error) {
+	id, err := generateToken(16)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(WebhookPayload{
+		ID:        id,
+		Event:     event,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Data:      data,
+	})
+}
+
+// enqueueWebhookEvent queues event for every active webhook subscribed to
+// it. Pass the transaction making the change so the event is sent if and
+// only if that change commits.
+func enqueueWebhookEvent(exec sqlExecer, event string, data interface{}) error {
+	payload, err := newWebhookPayload(event, data)
+	if err != nil {
+		return err
+	}
+	_, err = exec.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at)
+		SELECT id, ?, ?, ?, NOW() FROM webhooks WHERE active = 1 AND FIND_IN_SET(?, events) > 0`,
+		event, payload, webhookPending, event)
+	return err
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of "timestamp.body" keyed
+// with the webhook's secret. Receivers recompute it to check that a request
+// came from us, and reject old timestamps to stop replays.
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook POSTs a signed payload. It returns the response status code,
+// or 0 when there was no response, and an error unless the code is 2xx.
+// Response bodies are discarded: they are not ours to store.
+func sendWebhook(endpoint, secret string, deliveryID int, event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ASS1-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(deliveryID))
+	req.Header.Set("X-Webhook-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, webhookSignature(secret, timestamp, body)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+}
+
+// startWebhookWorkers starts n workers delivering queued webhook events,
+// claiming one delivery at a time with a lease like the outbox workers.
+func startWebhookWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				delivered, err := deliverNextWebhook()
+				if err != nil {
+					log.Error("Webhook worker failed: ", err)
+				}
+				if !delivered {
+					time.Sleep(webhookPollInterval)
+				}
+			}
+		}()
+	}
+}
+
+// deliverNextWebhook claims and sends one due delivery of an active webhook.
+// It reports false when nothing was due.
+func deliverNextWebhook() (bool, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	claim, err := generateToken(16)
+	if err != nil {
+		return false, err
+	}
+	result, err := db.Exec(`UPDATE webhook_deliveries SET claim_token = ?, locked_until = DATE_ADD(NOW(), INTERVAL ? SECOND)
+		WHERE status = ? AND next_attempt_at <= NOW() AND (locked_until IS NULL OR locked_until < NOW())
+		AND webhook_id IN (SELECT id FROM webhooks WHERE active = 1)
+		ORDER BY id LIMIT 1`, claim, int(webhookClaimTimeout.Seconds()), webhookPending)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	var id, attempts int
+	var event, payload, endpoint, secret string
+	err = db.QueryRow(`SELECT d.id, d.attempts, d.event, d.payload, w.url, w.secret
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE d.claim_token = ?`, claim).
+		Scan(&id, &attempts, &event, &payload, &endpoint, &secret)
+	if err != nil {
+		return false, err
+	}
+
+	code, sendErr := sendWebhook(endpoint, secret, id, event, []byte(payload))
+	return true, recordWebhookAttempt(db, id, attempts+1, event, code, sendErr)
+}
+
+func recordWebhookAttempt(db *sql.DB, id, attempts int, event string, code int, sendErr error) error {
+	responseStatus := sql.NullInt64{Int64: int64(code), Valid: code != 0}
+	if sendErr == nil {
+		_, err := db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, response_status = ?, last_error = NULL,
+			delivered_at = NOW(), claim_token = NULL, locked_until = NULL WHERE id = ?`,
+			webhookDelivered, attempts, responseStatus, id)
+		return err
+	}
+
+	fields := logrus.Fields{"event": "webhook_delivery_failed", "delivery_id": id, "webhook_event": event, "attempts": attempts}
+	if event == webhookTest || attempts >= webhookMaxAttempts {
+		log.WithFields(fields).Error("Webhook dead-lettered: ", sendErr)
+		_, err := db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, response_status = ?, last_error = ?,
+			claim_token = NULL, locked_until = NULL WHERE id = ?`,
+			webhookDead, attempts, responseStatus, sendErr.Error(), id)
+		return err
+	}
+
+	log.WithFields(fields).Warn("Webhook delivery failed, will retry: ", sendErr)
+	_, err := db.Exec(`UPDATE webhook_deliveries SET attempts = ?, response_status = ?, last_error = ?,
+		next_attempt_at = DATE_ADD(NOW(), INTERVAL ? SECOND), claim_token = NULL, locked_until = NULL WHERE id = ?`,
+		attempts, responseStatus, sendErr.Error(), int(outboxBackoff(attempts).Seconds()), id)
+	return err
+}
+
+type Webhook struct {
+	ID        int
+	URL       string
+	Secret    string
+	Events    []string
+	Active    bool
+	CreatedAt string
+	Failed    int
+}
+
+// Subscribes reports whether the webhook receives event.
+func (w Webhook) Subscribes(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDelivery struct {
+	ID             int
+	Event          string
+	Payload        string
+	Status         string
+	Attempts       int
+	ResponseStatus int
+	LastError      string
+	NextAttemptAt  string
+	CreatedAt      string
+	DeliveredAt    string
+}
+
+// webhookInput reads and validates the url (unless checkURL is false) and
+// event form values.
+func webhookInput(r *http.Request, checkURL bool) (string, []string, validation.Errors) {
+	r.ParseForm()
+	endpoint := strings.TrimSpace(r.FormValue("url"))
+	errs := validation.Errors{}
+	if checkURL {
+		errs = validation.Validate(validation.Field("url", endpoint, validation.Required, validation.MaxLength(maxWebhookURLLength)))
+		if u, err := url.Parse(endpoint); endpoint != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			errs.Add("url", "Enter an http:// or https:// URL")
+		} else if endpoint != "" && !publicHostname(u.Hostname()) {
+			errs.Add("url", "Webhooks must point to a public address")
+		}
+	}
+
+	selected := make(map[string]bool)
+	for _, event := range r.Form["event"] {
+		selected[event] = true
+	}
+	var events []string
+	for _, event := range webhookEvents {
+		if selected[event] {
+			events = append(events, event)
+			delete(selected, event)
+		}
+	}
+	if len(selected) > 0 {
+		errs.Add("event", "Unknown event")
+	} else if len(events) == 0 {
+		errs.Add("event", "Choose at least one event")
+	}
+	return endpoint, events, errs
+}
+
+// publicHostname catches webhook URLs that obviously point inside our
+// network. Hostnames can still resolve anywhere; webhookDialControl checks
+// the address actually dialed.
+func publicHostname(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return publicIP(ip)
+	}
+	return true
+}
+
+func renderWebhooksPage(w http.ResponseWriter, r *http.Request, status int, errs validation.Errors) {
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		log.Println("Failed to open database connection: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT w.id, w.url, w.events, w.active, w.created_at,
+		(SELECT COUNT(*) FROM webhook_deliveries d WHERE d.webhook_id = w.id AND d.status = ?)
+		FROM webhooks w ORDER BY w.id`, webhookDead)
+	if err != nil {
+		log.Println("Failed to fetch webhooks: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var hook Webhook
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.URL, &events, &hook.Active, &hook.CreatedAt, &hook.Failed); err != nil {
+			log.Println("Failed to scan webhook: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		hook.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	r.ParseForm()
+	data := struct {
+		PageSecurity
+		Webhooks []Webhook
+		Events   []string
+		Errors   validation.Errors
+		URL      string
+		Selected Webhook
+	}{
+		PageSecurity: pageSecurity(r),
+		Webhooks:     webhooks,
+		Events:       webhookEvents,
+		Errors:       errs,
+		URL:          r.FormValue("url"),
+		Selected:     Webhook{Events: r.Form["event"]},
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_webhooks.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		log.Println("Failed to render template:", err)
+	}
+}
+
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	renderWebhooksPage(w, r, http.StatusOK, nil)
+}
+
+// createWebhookHandler adds a webhook with a new random signing secret.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	endpoint, events, errs := webhookInput(r, true)
+	if errs.Any() {
+		rejectInput(w, r, errs, renderWebhooksPage)
+		return
+	}
+
+	secret, err := generateToken(32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO webhooks (url, secret, events, active, created_at) VALUES (?, ?, ?, 1, NOW())",
+		endpoint, secret, strings.Join(events, ","))
+	if err != nil {
+		log.Println("Failed to create webhook: ", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":      "webhook_created",
+		"webhook_id": id,
+		"admin_id":   getUserIDFromRequest(r),
+	}).Info("Webhook created: ", endpoint)
+	http.Redirect(w, r, "/admin/webhooks/"+strconv.FormatInt(id, 10), http.StatusSeeOther)
+}
+
+// webhookHandler shows a webhook, its signing secret and its latest
+// deliveries.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	hook := Webhook{ID: id}
+	var events string
+	err = db.QueryRow("SELECT url, secret, events, active, created_at FROM webhooks WHERE id = ?", id).
+		Scan(&hook.URL, &hook.Secret, &events, &hook.Active, &hook.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to fetch webhook: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	hook.Events = strings.Split(events, ",")
+
+	rows, err := db.Query(`SELECT id, event, payload, status, attempts, response_status, last_error, next_attempt_at, created_at, delivered_at
+		FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`, id, webhookLogSize)
+	if err != nil {
+		log.Println("Failed to fetch webhook deliveries: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var responseStatus sql.NullInt64
+		var lastError, deliveredAt sql.NullString
+		if err := rows.Scan(&d.ID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &responseStatus, &lastError, &d.NextAttemptAt, &d.CreatedAt, &deliveredAt); err != nil {
+			log.Println("Failed to scan webhook delivery: ", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		d.ResponseStatus = int(responseStatus.Int64)
+		d.LastError = lastError.String
+		d.DeliveredAt = deliveredAt.String
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		PageSecurity
+		Webhook     Webhook
+		Events      []string
+		Deliveries  []WebhookDelivery
+		MaxAttempts int
+	}{
+		PageSecurity: pageSecurity(r),
+		Webhook:      hook,
+		Events:       webhookEvents,
+		Deliveries:   deliveries,
+		MaxAttempts:  webhookMaxAttempts,
+	}
+
+	tmpl, err := template.ParseFiles("pages/admin_webhook.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		return
+	}
+}
+
+// updateWebhookHandler changes a webhook's events and pauses or resumes it.
+// Deliveries of a paused webhook wait in the queue until it is resumed.
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	_, events, errs := webhookInput(r, false)
+	if errs.Any() {
+		http.Error(w, errs["event"], http.StatusBadRequest)
+		return
+	}
+	active := r.FormValue("active") == "1"
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("UPDATE webhooks SET events = ?, active = ? WHERE id = ?", strings.Join(events, ","), active, id)
+	if err != nil {
+		log.Println("Failed to update webhook: ", err)
+		http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		if db.QueryRow("SELECT EXISTS(SELECT 1 FROM webhooks WHERE id = ?)", id).Scan(&exists); !exists {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":      "webhook_updated",
+		"webhook_id": id,
+		"active":     active,
+		"events":     events,
+		"admin_id":   getUserIDFromRequest(r),
+	}).Info("Webhook updated")
+	http.Redirect(w, r, "/admin/webhooks/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// deleteWebhookHandler removes a webhook along with its delivery log and any
+// undelivered events.
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		log.Println("Failed to delete webhook deliveries: ", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM webhooks WHERE id = ?", id); err != nil {
+		log.Println("Failed to delete webhook: ", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":      "webhook_deleted",
+		"webhook_id": id,
+		"admin_id":   getUserIDFromRequest(r),
+	}).Info("Webhook deleted")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// testWebhookHandler sends a webhook.test event to the webhook straight
+// away, paused or not, and shows the result in its delivery log.
+func testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var endpoint, secret string
+	err = db.QueryRow("SELECT url, secret FROM webhooks WHERE id = ?", id).Scan(&endpoint, &secret)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	payload, err := newWebhookPayload(webhookTest, map[string]interface{}{"webhook_id": id})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// The lease keeps workers away while the request is in flight.
+	result, err := db.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, locked_until)
+		VALUES (?, ?, ?, ?, NOW(), DATE_ADD(NOW(), INTERVAL ? SECOND))`,
+		id, webhookTest, payload, webhookPending, int(webhookClaimTimeout.Seconds()))
+	if err != nil {
+		log.Println("Failed to queue test webhook: ", err)
+		http.Error(w, "Failed to send test event", http.StatusInternalServerError)
+		return
+	}
+	deliveryID, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	code, sendErr := sendWebhook(endpoint, secret, int(deliveryID), webhookTest, payload)
+	if err := recordWebhookAttempt(db, int(deliveryID), 1, webhookTest, code, sendErr); err != nil {
+		log.Println("Failed to record test webhook: ", err)
+	}
+	http.Redirect(w, r, "/admin/webhooks/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// retryWebhookDeliveryHandler requeues a dead-lettered delivery with a fresh
+// set of attempts.
+func retryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhookID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	deliveryID, err := strconv.Atoi(vars["delivery"])
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(sql12.freesqldatabase.com)/%s", dbUser, dbPass, dbName)
+	db, err := sql.Open(dbDriver, dsn)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	result, err := db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = NOW() WHERE id = ? AND webhook_id = ? AND status = ?",
+		webhookPending, deliveryID, webhookID, webhookDead)
+	if err != nil {
+		log.Println("Failed to retry webhook delivery: ", err)
+		http.Error(w, "Failed to retry delivery", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Only failed deliveries can be retried", http.StatusBadRequest)
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":       "webhook_retry",
+		"webhook_id":  webhookID,
+		"delivery_id": deliveryID,
+		"admin_id":    getUserIDFromRequest(r),
+	}).Info("Dead-lettered webhook delivery requeued")
+	http.Redirect(w, r, "/admin/webhooks/"+strconv.Itoa(webhookID), http.StatusSeeOther)
+}